@@ -0,0 +1,81 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Info describes the audio stream of a file
+type Info struct {
+	// Duration in seconds
+	Duration   float64
+	SampleRate int
+	Channels   int
+	// Codec is the ffprobe codec name of the first audio stream, e.g. "mp3" or "pcm_s16le"
+	Codec string
+	// Container is the ffprobe format name, e.g. "mp3" or "wav"
+	Container string
+}
+
+// ffprobeOutput is the part of `ffprobe -print_format json` output we read
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType  string `json:"codec_type"`
+		CodecName  string `json:"codec_name"`
+		SampleRate string `json:"sample_rate"`
+		Channels   int    `json:"channels"`
+		Duration   string `json:"duration"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+// Probe reads the duration, sample rate and channel count of an audio file with the ffprobe
+// executable at ffprobePath
+func Probe(ctx context.Context, ffprobePath, path string) (Info, error) {
+	cmd := exec.CommandContext(ctx, ffprobePath,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-select_streams", "a:0",
+		path,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Info{}, fmt.Errorf("ffprobe failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var out ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Info{}, fmt.Errorf("error parsing ffprobe output: %w", err)
+	}
+	if len(out.Streams) == 0 {
+		return Info{}, fmt.Errorf("no audio stream found in %s", path)
+	}
+
+	stream := out.Streams[0]
+	info := Info{
+		Channels:  stream.Channels,
+		Codec:     stream.CodecName,
+		Container: out.Format.FormatName,
+	}
+	info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+
+	// The container duration is more reliable than the stream one for VBR MP3
+	duration := out.Format.Duration
+	if duration == "" {
+		duration = stream.Duration
+	}
+	info.Duration, _ = strconv.ParseFloat(duration, 64)
+
+	return info, nil
+}
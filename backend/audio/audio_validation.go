@@ -0,0 +1,153 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Format is an audio container recognized from the first bytes of a file
+type Format string
+
+const (
+	FormatMP3  Format = "mp3"
+	FormatWAV  Format = "wav"
+	FormatFLAC Format = "flac"
+	FormatOGG  Format = "ogg"
+	FormatM4A  Format = "m4a"
+)
+
+// AllowedFormats are the containers accepted for upload
+var AllowedFormats = []Format{FormatMP3, FormatWAV, FormatFLAC, FormatOGG, FormatM4A}
+
+// sniffSize is how many leading bytes Sniff needs to recognize every allowed format
+const sniffSize = 12
+
+// Limits bounds what an uploaded audio file may be. A zero field disables its check.
+type Limits struct {
+	// MaxBytes is the largest accepted file size
+	MaxBytes int64
+	// MinDuration and MaxDuration bound the audio duration in seconds
+	MinDuration float64
+	MaxDuration float64
+	// MinSampleRate is the lowest accepted sample rate in Hz
+	MinSampleRate int
+}
+
+// ErrFileTooLarge is wrapped by the ValidationError of a file larger than Limits.MaxBytes
+var ErrFileTooLarge = errors.New("file too large")
+
+// ValidationError is returned when an upload is not acceptable audio. Its message can be shown to the user.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// m4aBrands are the ISO media major brands accepted as M4A. Other brands are video (qt, 3gp)
+// or images (heic, avif), which would only be rejected later as undecodable audio.
+var m4aBrands = [][]byte{[]byte("M4A "), []byte("M4B "), []byte("mp42"), []byte("isom"), []byte("dash")}
+
+// Sniff recognizes the container of an audio file from its leading bytes
+func Sniff(header []byte) (Format, bool) {
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return FormatMP3, true
+	case len(header) >= 12 && bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return FormatWAV, true
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return FormatFLAC, true
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return FormatOGG, true
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		for _, brand := range m4aBrands {
+			if bytes.Equal(header[8:12], brand) {
+				return FormatM4A, true
+			}
+		}
+		return "", false
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && header[1]&0x06 != 0:
+		// MPEG audio frame sync without an ID3 tag; layer bits 00 would be AAC ADTS
+		return FormatMP3, true
+	}
+	return "", false
+}
+
+// SniffFile recognizes the container of the audio file at path
+func SniffFile(path string) (Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	format, ok := Sniff(header[:n])
+	if !ok {
+		return "", &ValidationError{Reason: fmt.Sprintf("unsupported audio format, allowed formats are %s", FormatList())}
+	}
+	return format, nil
+}
+
+// Validate checks that the file at path is allowed audio within limits, probing it with the ffprobe
+// executable at ffprobePath, and returns what was found.
+// A *ValidationError means the file itself was rejected; any other error is a server-side failure.
+func Validate(ctx context.Context, ffprobePath, path string, limits Limits) (Format, Info, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", Info{}, err
+	}
+	if limits.MaxBytes > 0 && stat.Size() > limits.MaxBytes {
+		return "", Info{}, &ValidationError{Reason: fmt.Sprintf("file is %d bytes, the limit is %d bytes", stat.Size(), limits.MaxBytes), Err: ErrFileTooLarge}
+	}
+
+	format, err := SniffFile(path)
+	if err != nil {
+		return "", Info{}, err
+	}
+
+	info, err := Probe(ctx, ffprobePath, path)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || ctx.Err() != nil {
+			return format, Info{}, err
+		}
+		return format, Info{}, &ValidationError{Reason: fmt.Sprintf("file looks like %s but could not be decoded: %v", format, err)}
+	}
+
+	switch {
+	case info.Duration <= 0:
+		return format, info, &ValidationError{Reason: "audio has no measurable duration"}
+	case limits.MinDuration > 0 && info.Duration < limits.MinDuration:
+		return format, info, &ValidationError{Reason: fmt.Sprintf("audio is %.1f seconds long, the minimum is %.0f seconds", info.Duration, limits.MinDuration)}
+	case limits.MaxDuration > 0 && info.Duration > limits.MaxDuration:
+		return format, info, &ValidationError{Reason: fmt.Sprintf("audio is %.1f seconds long, the maximum is %.0f seconds", info.Duration, limits.MaxDuration)}
+	case limits.MinSampleRate > 0 && info.SampleRate < limits.MinSampleRate:
+		return format, info, &ValidationError{Reason: fmt.Sprintf("audio sample rate is %d Hz, the minimum is %d Hz", info.SampleRate, limits.MinSampleRate)}
+	}
+	return format, info, nil
+}
+
+// FormatList returns the allowed formats as a comma separated list
+func FormatList() string {
+	names := make([]string, len(AllowedFormats))
+	for i, format := range AllowedFormats {
+		names[i] = string(format)
+	}
+	return strings.Join(names, ", ")
+}
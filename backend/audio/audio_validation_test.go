@@ -0,0 +1,107 @@
+package audio
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   Format
+	}{
+		{"wav", "RIFF\x24\x08\x00\x00WAVEfmt ", FormatWAV},
+		{"mp3_id3", "ID3\x04\x00\x00\x00\x00\x00\x23TSSE", FormatMP3},
+		{"mp3_mpeg1_layer3", "\xFF\xFB\x90\x64\x00\x00\x00\x00\x00\x00\x00\x00", FormatMP3},
+		{"mp3_mpeg2_layer3", "\xFF\xF3\x48\xC4", FormatMP3},
+		{"mp3_mpeg25_layer3", "\xFF\xE3\x18\xC4", FormatMP3},
+		{"flac", "fLaC\x00\x00\x00\x22\x10\x00\x10\x00", FormatFLAC},
+		{"ogg", "OggS\x00\x02\x00\x00\x00\x00\x00\x00", FormatOGG},
+		{"m4a", "\x00\x00\x00\x20ftypM4A ", FormatM4A},
+		{"m4b", "\x00\x00\x00\x20ftypM4B ", FormatM4A},
+		{"mp4", "\x00\x00\x00\x18ftypmp42", FormatM4A},
+		{"isom", "\x00\x00\x00\x1cftypisom", FormatM4A},
+		{"dash", "\x00\x00\x00\x18ftypdash", FormatM4A},
+		// ISO media that isn't audio
+		{"heic", "\x00\x00\x00\x18ftypheic", ""},
+		{"avif", "\x00\x00\x00\x1cftypavif", ""},
+		{"mov", "\x00\x00\x00\x14ftypqt  ", ""},
+		{"3gp", "\x00\x00\x00\x18ftyp3gp4", ""},
+		{"riff_avi", "RIFF\x24\x08\x00\x00AVI LIST", ""},
+		{"riff_webp", "RIFF\x24\x08\x00\x00WEBPVP8 ", ""},
+		// Layer bits 00 are AAC ADTS, not MPEG audio
+		{"adts", "\xFF\xF1\x50\x80\x02\x1F\xFC", ""},
+		{"text_as_mp3", "Hello, this is not an mp3 file", ""},
+		{"html_as_mp3", "<!DOCTYPE html><html>", ""},
+		{"zip", "PK\x03\x04\x14\x00\x00\x00", ""},
+		{"empty", "", ""},
+		{"short_id3", "ID", ""},
+		{"short_riff", "RIFF\x24\x08\x00\x00WAV", ""},
+		{"short_ftyp", "\x00\x00\x00\x20fty", ""},
+		{"ftyp_without_brand", "\x00\x00\x00\x20ftypM4", ""},
+		{"short_sync", "\xFF", ""},
+		{"short_flac", "fLa", ""},
+		{"short_ogg", "Ogg", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := Sniff([]byte(test.header))
+			if ok != (test.want != "") || got != test.want {
+				t.Errorf("Sniff(%q) = %q, %v, want %q", test.header, got, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestSniffFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    Format
+	}{
+		{"song.wav", "RIFF\x24\x08\x00\x00WAVEfmt \x10\x00\x00\x00", FormatWAV},
+		// Shorter than sniffSize, but long enough for its magic
+		{"short.flac", "fLaC", FormatFLAC},
+		{"notes.mp3", "just some text renamed to .mp3\n", ""},
+		{"empty.mp3", "", ""},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := SniffFile(path)
+		if test.want != "" {
+			if err != nil || got != test.want {
+				t.Errorf("SniffFile(%s) = %q, %v, want %q", test.name, got, err, test.want)
+			}
+			continue
+		}
+		var validation *ValidationError
+		if !errors.As(err, &validation) {
+			t.Errorf("SniffFile(%s) = %q, %v, want a ValidationError", test.name, got, err)
+		}
+	}
+
+	if _, err := SniffFile(filepath.Join(dir, "missing.wav")); err == nil || errors.As(err, new(*ValidationError)) {
+		t.Errorf("SniffFile of a missing file = %v, want a server-side error", err)
+	}
+}
+
+func TestValidateFileTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.wav")
+	if err := os.WriteFile(path, make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected on its size before ffprobe is run
+	_, _, err := Validate(context.Background(), "ffprobe-not-installed", path, Limits{MaxBytes: 1024})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("Validate of a file over MaxBytes = %v, want a ValidationError wrapping ErrFileTooLarge", err)
+	}
+}
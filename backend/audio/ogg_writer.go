@@ -0,0 +1,128 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Ogg page header flags
+const (
+	oggBOS = 0x02
+	oggEOS = 0x04
+)
+
+// oggMaxPageData is the payload size after which a page is flushed, a common choice that
+// keeps pages small enough for seeking
+const oggMaxPageData = 4096
+
+// oggCRCTable is the lookup table of the Ogg CRC-32 (polynomial 0x04c11db7, no reflection)
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OggWriter writes packets of a single logical bitstream into Ogg pages
+type OggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+	started  bool
+
+	// The page being built: its lacing values, payload and the granule position of its last packet
+	segments []byte
+	data     []byte
+	granule  int64
+}
+
+// NewOggWriter creates a writer for the logical bitstream identified by serial
+func NewOggWriter(w io.Writer, serial uint32) *OggWriter {
+	return &OggWriter{w: w, serial: serial}
+}
+
+// WritePacket appends a packet ending at granule. Packets are never split across pages:
+// the current page is flushed first when the packet doesn't fit.
+func (o *OggWriter) WritePacket(packet []byte, granule int64) error {
+	lacing := len(packet)/255 + 1
+	if lacing > 255 {
+		return fmt.Errorf("ogg packet of %d bytes is too large", len(packet))
+	}
+	if len(o.segments) > 0 && (len(o.segments)+lacing > 255 || len(o.data)+len(packet) > oggMaxPageData) {
+		if err := o.writePage(0); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < lacing-1; i++ {
+		o.segments = append(o.segments, 255)
+	}
+	o.segments = append(o.segments, byte(len(packet)%255))
+	o.data = append(o.data, packet...)
+	o.granule = granule
+	return nil
+}
+
+// Flush ends the current page, so the next packet starts a new one. Header packets must be
+// flushed on their own pages.
+func (o *OggWriter) Flush() error {
+	if len(o.segments) == 0 {
+		return nil
+	}
+	return o.writePage(0)
+}
+
+// Close writes the last page with the end-of-stream flag
+func (o *OggWriter) Close() error {
+	return o.writePage(oggEOS)
+}
+
+// writePage writes the pending packets as one page
+func (o *OggWriter) writePage(flags byte) error {
+	if !o.started {
+		flags |= oggBOS
+		o.started = true
+	}
+
+	header := make([]byte, 27, 27+len(o.segments))
+	copy(header, "OggS")
+	header[4] = 0 // stream structure version
+	header[5] = flags
+	binary.LittleEndian.PutUint64(header[6:14], uint64(o.granule))
+	binary.LittleEndian.PutUint32(header[14:18], o.serial)
+	binary.LittleEndian.PutUint32(header[18:22], o.sequence)
+	header[26] = byte(len(o.segments))
+	header = append(header, o.segments...)
+
+	crc := oggCRC(oggCRC(0, header), o.data)
+	binary.LittleEndian.PutUint32(header[22:26], crc)
+
+	if _, err := o.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := o.w.Write(o.data); err != nil {
+		return err
+	}
+
+	o.sequence++
+	o.segments = o.segments[:0]
+	o.data = o.data[:0]
+	return nil
+}
@@ -0,0 +1,236 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestOggCRC(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint32
+	}{
+		{"", 0},
+		// CRC-32 with polynomial 0x04c11db7, zero initial value, no reflection and no final xor
+		{"123456789", 0x89a1897f},
+		{"\x01", 0x04c11db7},
+	}
+	for _, test := range tests {
+		if got := oggCRC(0, []byte(test.data)); got != test.want {
+			t.Errorf("oggCRC(%q) = %#08x, want %#08x", test.data, got, test.want)
+		}
+	}
+
+	// Checksumming in pieces gives the same result as in one go
+	if got := oggCRC(oggCRC(0, []byte("12345")), []byte("6789")); got != 0x89a1897f {
+		t.Errorf("oggCRC in two pieces = %#08x, want %#08x", got, 0x89a1897f)
+	}
+}
+
+// oggPage is a parsed Ogg page
+type oggPage struct {
+	flags    byte
+	granule  int64
+	serial   uint32
+	sequence uint32
+	segments []byte
+	data     []byte
+}
+
+// parseOggPages splits a stream into pages, checking the capture pattern, version and CRC of each
+func parseOggPages(t *testing.T, stream []byte) []oggPage {
+	t.Helper()
+	var pages []oggPage
+	for len(stream) > 0 {
+		if len(stream) < 27 || string(stream[:4]) != "OggS" {
+			t.Fatalf("page %d: no capture pattern", len(pages))
+		}
+		if stream[4] != 0 {
+			t.Fatalf("page %d: stream structure version %d, want 0", len(pages), stream[4])
+		}
+		count := int(stream[26])
+		size := 27 + count
+		segments := stream[27:size]
+		for _, lacing := range segments {
+			size += int(lacing)
+		}
+		if len(stream) < size {
+			t.Fatalf("page %d: truncated", len(pages))
+		}
+
+		page := slices.Clone(stream[:size])
+		crc := binary.LittleEndian.Uint32(page[22:26])
+		clear(page[22:26])
+		if want := oggCRC(0, page); crc != want {
+			t.Fatalf("page %d: CRC %#08x, want %#08x", len(pages), crc, want)
+		}
+
+		pages = append(pages, oggPage{
+			flags:    stream[5],
+			granule:  int64(binary.LittleEndian.Uint64(stream[6:14])),
+			serial:   binary.LittleEndian.Uint32(stream[14:18]),
+			sequence: binary.LittleEndian.Uint32(stream[18:22]),
+			segments: segments,
+			data:     stream[27+count : size],
+		})
+		stream = stream[size:]
+	}
+	return pages
+}
+
+// packet returns size bytes counting up from seed
+func packet(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i)
+	}
+	return data
+}
+
+func TestOggWriterLacing(t *testing.T) {
+	tests := []struct {
+		size     int
+		segments []byte
+	}{
+		{0, []byte{0}},
+		{1, []byte{1}},
+		{254, []byte{254}},
+		// A packet that is a multiple of 255 bytes ends with a zero lacing value
+		{255, []byte{255, 0}},
+		{256, []byte{255, 1}},
+		{510, []byte{255, 255, 0}},
+		{600, []byte{255, 255, 90}},
+	}
+	for _, test := range tests {
+		var stream bytes.Buffer
+		ogg := NewOggWriter(&stream, 1)
+		data := packet(test.size, 7)
+		if err := ogg.WritePacket(data, 960); err != nil {
+			t.Fatal(err)
+		}
+		if err := ogg.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		pages := parseOggPages(t, stream.Bytes())
+		if len(pages) != 1 {
+			t.Fatalf("%d-byte packet: got %d pages, want 1", test.size, len(pages))
+		}
+		if !bytes.Equal(pages[0].segments, test.segments) {
+			t.Errorf("%d-byte packet: lacing values %v, want %v", test.size, pages[0].segments, test.segments)
+		}
+		if !bytes.Equal(pages[0].data, data) {
+			t.Errorf("%d-byte packet: page data differs from the packet", test.size)
+		}
+	}
+}
+
+func TestOggWriterSegmentLimit(t *testing.T) {
+	var stream bytes.Buffer
+	ogg := NewOggWriter(&stream, 1)
+	// 300 one-segment packets need more than the 255 lacing values a page can hold
+	for i := 1; i <= 300; i++ {
+		if err := ogg.WritePacket(packet(3, byte(i)), int64(i)*960); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ogg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := parseOggPages(t, stream.Bytes())
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	if len(pages[0].segments) != 255 || len(pages[1].segments) != 45 {
+		t.Errorf("pages hold %d and %d segments, want 255 and 45", len(pages[0].segments), len(pages[1].segments))
+	}
+	// A page carries the granule position of the last packet ending on it
+	if pages[0].granule != 255*960 || pages[1].granule != 300*960 {
+		t.Errorf("granule positions %d and %d, want %d and %d", pages[0].granule, pages[1].granule, 255*960, 300*960)
+	}
+	// Packets are never split, so the second page starts with packet 256
+	if want := packet(3, byte(256%256)); !bytes.Equal(pages[1].data[:3], want) {
+		t.Errorf("second page starts with %v, want packet 256 %v", pages[1].data[:3], want)
+	}
+}
+
+func TestOggWriterPageSize(t *testing.T) {
+	var stream bytes.Buffer
+	ogg := NewOggWriter(&stream, 1)
+	// A packet that doesn't fit in what is left of oggMaxPageData starts a new page
+	for i := 0; i < 3; i++ {
+		if err := ogg.WritePacket(packet(1500, byte(i)), int64(i+1)*960); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ogg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := parseOggPages(t, stream.Bytes())
+	if len(pages) != 2 || len(pages[0].data) != 3000 || len(pages[1].data) != 1500 {
+		t.Fatalf("got %d pages, want 3000 and 1500 bytes of data", len(pages))
+	}
+
+	// 65025 bytes and up need more than 255 lacing values, which no page can hold
+	if err := NewOggWriter(&stream, 1).WritePacket(make([]byte, 255*255), 0); err == nil {
+		t.Error("a 65025-byte packet was accepted")
+	}
+}
+
+func TestOggWriterHeaders(t *testing.T) {
+	var stream bytes.Buffer
+	ogg := NewOggWriter(&stream, 0xdeadbeef)
+	if err := ogg.WritePacket([]byte("head"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ogg.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Flushing without pending packets writes no empty page
+	if err := ogg.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ogg.WritePacket([]byte("tags"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ogg.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ogg.WritePacket([]byte("audio"), 1272); err != nil {
+		t.Fatal(err)
+	}
+	if err := ogg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []oggPage{
+		{flags: oggBOS, granule: 0, data: []byte("head")},
+		{flags: 0, granule: 0, data: []byte("tags")},
+		{flags: oggEOS, granule: 1272, data: []byte("audio")},
+	}
+	pages := parseOggPages(t, stream.Bytes())
+	if len(pages) != len(want) {
+		t.Fatalf("got %d pages, want %d", len(pages), len(want))
+	}
+	for i, page := range pages {
+		if page.flags != want[i].flags {
+			t.Errorf("page %d: flags %#x, want %#x", i, page.flags, want[i].flags)
+		}
+		if page.granule != want[i].granule {
+			t.Errorf("page %d: granule position %d, want %d", i, page.granule, want[i].granule)
+		}
+		if page.serial != 0xdeadbeef {
+			t.Errorf("page %d: serial %#x, want 0xdeadbeef", i, page.serial)
+		}
+		if page.sequence != uint32(i) {
+			t.Errorf("page %d: sequence number %d", i, page.sequence)
+		}
+		if !bytes.Equal(page.data, want[i].data) {
+			t.Errorf("page %d: data %q, want %q", i, page.data, want[i].data)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+//go:build opus
+
+package audio
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+// opus_encoder_ctl is variadic, which cgo can't call directly
+static int karaoke_opus_set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+}
+
+static int karaoke_opus_get_lookahead(OpusEncoder *enc, opus_int32 *lookahead) {
+	return opus_encoder_ctl(enc, OPUS_GET_LOOKAHEAD(lookahead));
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// OpusAvailable reports whether the binary was built with the libopus binding (-tags opus)
+const OpusAvailable = true
+
+// OpusVersion returns the version string of the linked libopus
+func OpusVersion() string {
+	return C.GoString(C.opus_get_version_string())
+}
+
+// opusEncoder wraps a libopus encoder
+type opusEncoder struct {
+	enc      *C.OpusEncoder
+	channels int
+}
+
+func newOpusEncoder(sampleRate, channels, bitrate int) (*opusEncoder, error) {
+	var status C.int
+	enc := C.opus_encoder_create(C.opus_int32(sampleRate), C.int(channels), C.OPUS_APPLICATION_AUDIO, &status)
+	if status != C.OPUS_OK {
+		return nil, fmt.Errorf("error creating Opus encoder: %s", C.GoString(C.opus_strerror(status)))
+	}
+	if status := C.karaoke_opus_set_bitrate(enc, C.opus_int32(bitrate)); status != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, fmt.Errorf("error setting Opus bitrate %d: %s", bitrate, C.GoString(C.opus_strerror(status)))
+	}
+	return &opusEncoder{enc: enc, channels: channels}, nil
+}
+
+// lookahead returns the encoder delay in samples at the input sample rate
+func (e *opusEncoder) lookahead() int {
+	var lookahead C.opus_int32
+	if C.karaoke_opus_get_lookahead(e.enc, &lookahead) != C.OPUS_OK {
+		return 0
+	}
+	return int(lookahead)
+}
+
+// encode compresses one frame of interleaved samples into out and returns the packet size
+func (e *opusEncoder) encode(pcm []float32, out []byte) (int, error) {
+	frameSize := len(pcm) / e.channels
+	n := C.opus_encode_float(e.enc, (*C.float)(unsafe.Pointer(&pcm[0])), C.int(frameSize),
+		(*C.uchar)(unsafe.Pointer(&out[0])), C.opus_int32(len(out)))
+	if n < 0 {
+		return 0, fmt.Errorf("error encoding Opus frame: %s", C.GoString(C.opus_strerror(n)))
+	}
+	return int(n), nil
+}
+
+func (e *opusEncoder) close() {
+	C.opus_encoder_destroy(e.enc)
+}
+
+// opusDecoder wraps a libopus decoder. The pipeline never decodes, the tests use it to check
+// what the encoder wrote.
+type opusDecoder struct {
+	dec      *C.OpusDecoder
+	channels int
+}
+
+func newOpusDecoder(sampleRate, channels int) (*opusDecoder, error) {
+	var status C.int
+	dec := C.opus_decoder_create(C.opus_int32(sampleRate), C.int(channels), &status)
+	if status != C.OPUS_OK {
+		return nil, fmt.Errorf("error creating Opus decoder: %s", C.GoString(C.opus_strerror(status)))
+	}
+	return &opusDecoder{dec: dec, channels: channels}, nil
+}
+
+// decode decompresses one packet into pcm as interleaved samples and returns the samples per channel
+func (d *opusDecoder) decode(packet []byte, pcm []float32) (int, error) {
+	n := C.opus_decode_float(d.dec, (*C.uchar)(unsafe.Pointer(&packet[0])), C.opus_int32(len(packet)),
+		(*C.float)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/d.channels), 0)
+	if n < 0 {
+		return 0, fmt.Errorf("error decoding Opus packet: %s", C.GoString(C.opus_strerror(n)))
+	}
+	return int(n), nil
+}
+
+func (d *opusDecoder) close() {
+	C.opus_decoder_destroy(d.dec)
+}
@@ -0,0 +1,114 @@
+//go:build opus
+
+package audio
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// oggPackets reassembles the packets of pages from their lacing values
+func oggPackets(pages []oggPage) [][]byte {
+	var packets [][]byte
+	var current []byte
+	for _, page := range pages {
+		data := page.data
+		for _, lacing := range page.segments {
+			current = append(current, data[:lacing]...)
+			data = data[lacing:]
+			if lacing < 255 {
+				packets = append(packets, current)
+				current = nil
+			}
+		}
+	}
+	return packets
+}
+
+// writeSineWAV writes a second of a 16-bit mono sine at rate into a temp WAV file
+func writeSineWAV(t *testing.T, rate int, frequency, amplitude float64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sine.wav")
+	writer, err := CreateWAV(path, WAVFormat{SampleRate: rate, Channels: 1, BitsPerSample: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteSamples(sine(rate, frequency, amplitude, rate)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncodeOggOpusRoundTrip(t *testing.T) {
+	const rate, frequency, amplitude = 48000, 440.0, 0.5
+	wavPath := writeSineWAV(t, rate, frequency, amplitude)
+
+	for _, channels := range []int{1, 2} {
+		oggPath := filepath.Join(t.TempDir(), "sine.ogg")
+		if err := EncodeOggOpus(context.Background(), wavPath, oggPath, OpusOptions{Bitrate: 64000, Channels: channels}); err != nil {
+			t.Fatal(err)
+		}
+		stream, err := os.ReadFile(oggPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages := parseOggPages(t, stream)
+		packets := oggPackets(pages)
+		if len(packets) < 3 {
+			t.Fatalf("%d channels: %d packets, want the headers and audio", channels, len(packets))
+		}
+		head, tags := packets[0], packets[1]
+		if string(head[:8]) != "OpusHead" || int(head[9]) != channels || binary.LittleEndian.Uint32(head[12:16]) != rate {
+			t.Errorf("%d channels: OpusHead %x", channels, head)
+		}
+		if string(tags[:8]) != "OpusTags" || !strings.Contains(string(tags), OpusVersion()) {
+			t.Errorf("%d channels: OpusTags %q doesn't name %q", channels, tags, OpusVersion())
+		}
+
+		// The last granule position marks the real end of the input, after the encoder delay
+		preSkip := int(binary.LittleEndian.Uint16(head[10:12]))
+		last := pages[len(pages)-1]
+		if last.flags&0x04 == 0 {
+			t.Errorf("%d channels: last page has no end of stream flag", channels)
+		}
+		if want := int64(preSkip + rate); last.granule != want {
+			t.Errorf("%d channels: last granule %d, want %d", channels, last.granule, want)
+		}
+
+		decoder, err := newOpusDecoder(rate, channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.close()
+		var decoded []float32
+		pcm := make([]float32, 5760*channels)
+		for _, packet := range packets[2:] {
+			n, err := decoder.decode(packet, pcm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the first channel is checked, the encoder duplicates mono input
+			for i := 0; i < n; i++ {
+				decoded = append(decoded, pcm[i*channels])
+			}
+		}
+		if len(decoded) < preSkip+rate {
+			t.Fatalf("%d channels: decoded %d samples, want at least %d", channels, len(decoded), preSkip+rate)
+		}
+		decoded = decoded[preSkip : preSkip+rate]
+
+		// Opus is lossy, but a pure tone at 64 kbps comes back close to the original
+		got, snr := fitSine(decoded[rate/10:rate*9/10], rate, frequency)
+		if got < amplitude*0.9 || got > amplitude*1.1 || snr < 20 {
+			t.Errorf("%d channels: decoded a %.3f sine at %.1f dB SNR, want %.1f above 20 dB", channels, got, snr, amplitude)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package audio
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+)
+
+// ErrOpusUnavailable is returned by EncodeOggOpus when the binary was built without the libopus binding
+var ErrOpusUnavailable = errors.New("built without Opus support, rebuild with -tags opus")
+
+// OpusOptions controls the Ogg/Opus encoding of a WAV file
+type OpusOptions struct {
+	// Bitrate in bits per second, between 6000 and 510000
+	Bitrate int
+	// Channels of the output, 1 for mono or 2 for stereo; the input is down- or up-mixed as needed
+	Channels int
+}
+
+// Validate reports an option libopus would reject
+func (o OpusOptions) Validate() error {
+	if o.Bitrate < 6000 || o.Bitrate > 510000 {
+		return fmt.Errorf("opus bitrate must be between 6000 and 510000 bps, got %d", o.Bitrate)
+	}
+	if o.Channels != 1 && o.Channels != 2 {
+		return fmt.Errorf("opus channels must be 1 or 2, got %d", o.Channels)
+	}
+	return nil
+}
+
+const (
+	// opusGranuleRate is the rate of Ogg/Opus granule positions, whatever the input rate
+	opusGranuleRate = 48000
+	// opusFramesPerSecond gives 20 ms frames, the usual choice for music
+	opusFramesPerSecond = 50
+	// opusMaxPacket is the output buffer size recommended by libopus
+	opusMaxPacket = 4000
+)
+
+// opusSampleRates are the input rates libopus accepts
+var opusSampleRates = map[int]bool{8000: true, 12000: true, 16000: true, 24000: true, 48000: true}
+
+// EncodeOggOpus encodes a WAV file into an Ogg/Opus file (RFC 7845). The output is written to a
+// temporary file and renamed, so oggPath never holds a partial file.
+func EncodeOggOpus(ctx context.Context, wavPath, oggPath string, options OpusOptions) error {
+	if !OpusAvailable {
+		return ErrOpusUnavailable
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	reader, err := OpenWAV(wavPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	rate := reader.Format.SampleRate
+	if !opusSampleRates[rate] {
+		return fmt.Errorf("opus can't encode %d Hz audio, resample to 48000 Hz first", rate)
+	}
+
+	encoder, err := newOpusEncoder(rate, options.Channels, options.Bitrate)
+	if err != nil {
+		return err
+	}
+	defer encoder.close()
+
+	tmpPath := oggPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	out := bufio.NewWriter(file)
+	if err := writeOggOpus(ctx, out, reader, encoder, options.Channels); err != nil {
+		file.Close()
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, oggPath)
+}
+
+// writeOggOpus writes the Opus header pages and then every audio frame of reader
+func writeOggOpus(ctx context.Context, w io.Writer, reader *WAVReader, encoder *opusEncoder, channels int) error {
+	rate := reader.Format.SampleRate
+	scale := int64(opusGranuleRate / rate)
+	preSkip := int64(encoder.lookahead()) * scale
+
+	ogg := NewOggWriter(w, rand.Uint32())
+	if err := ogg.WritePacket(opusHead(channels, preSkip, rate), 0); err != nil {
+		return err
+	}
+	if err := ogg.Flush(); err != nil {
+		return err
+	}
+	if err := ogg.WritePacket(opusTags(), 0); err != nil {
+		return err
+	}
+	if err := ogg.Flush(); err != nil {
+		return err
+	}
+
+	frameSize := rate / opusFramesPerSecond
+	inChannels := reader.Format.Channels
+	input := make([]float32, frameSize*inChannels)
+	frame := make([]float32, frameSize*channels)
+	packet := make([]byte, opusMaxPacket)
+
+	var samples, encoded int64
+	eof := false
+	for frames := 0; ; frames++ {
+		if frames%opusFramesPerSecond == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Fill a whole frame; the last one is padded with silence
+		filled := 0
+		for !eof && filled < len(input) {
+			n, err := reader.ReadSamples(input[filled:])
+			filled += n
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		clear(input[filled:])
+		samples += int64(filled / inChannels)
+		mixChannels(input, inChannels, frame, channels)
+
+		n, err := encoder.encode(frame, packet)
+		if err != nil {
+			return err
+		}
+		encoded += int64(frameSize)
+
+		// Keep encoding silence after the input ends until the encoder delay is flushed out,
+		// then mark the real end in the last granule position so players trim the padding
+		end := preSkip + samples*scale
+		if eof && encoded*scale >= end {
+			if err := ogg.WritePacket(packet[:n], end); err != nil {
+				return err
+			}
+			return ogg.Close()
+		}
+		if err := ogg.WritePacket(packet[:n], encoded*scale); err != nil {
+			return err
+		}
+	}
+}
+
+// mixChannels converts a frame of inChannels interleaved samples to outChannels:
+// mono output averages every input channel, stereo output duplicates mono input
+// or keeps the first two channels
+func mixChannels(in []float32, inChannels int, out []float32, outChannels int) {
+	frames := len(out) / outChannels
+	for i := 0; i < frames; i++ {
+		src := in[i*inChannels : (i+1)*inChannels]
+		switch {
+		case outChannels == inChannels:
+			copy(out[i*outChannels:], src)
+		case outChannels == 1:
+			var sum float32
+			for _, sample := range src {
+				sum += sample
+			}
+			out[i] = sum / float32(inChannels)
+		case inChannels == 1:
+			out[2*i], out[2*i+1] = src[0], src[0]
+		default:
+			out[2*i], out[2*i+1] = src[0], src[1]
+		}
+	}
+}
+
+// opusHead builds the identification header of an Ogg/Opus stream (RFC 7845 section 5.1)
+func opusHead(channels int, preSkip int64, inputRate int) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:12], uint16(preSkip))
+	binary.LittleEndian.PutUint32(head[12:16], uint32(inputRate))
+	binary.LittleEndian.PutUint16(head[16:18], 0) // output gain
+	head[18] = 0                                  // channel mapping family: mono or stereo
+	return head
+}
+
+// opusTags builds the comment header of an Ogg/Opus stream (RFC 7845 section 5.2)
+func opusTags() []byte {
+	vendor := "karaoke_generator"
+	if version := OpusVersion(); version != "" {
+		vendor += " " + version
+	}
+	tags := make([]byte, 0, 16+len(vendor))
+	tags = append(tags, "OpusTags"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // no user comments
+	return tags
+}
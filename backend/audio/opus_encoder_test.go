@@ -0,0 +1,100 @@
+package audio
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestOpusHead(t *testing.T) {
+	tests := []struct {
+		channels  int
+		preSkip   int64
+		inputRate int
+		want      []byte
+	}{
+		{1, 312, 48000, []byte{
+			'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+			1,          // version
+			1,          // channel count
+			0x38, 0x01, // pre-skip 312
+			0x80, 0xbb, 0x00, 0x00, // input sample rate 48000
+			0x00, 0x00, // output gain
+			0, // channel mapping family
+		}},
+		{2, 3840, 16000, []byte{
+			'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+			1,
+			2,
+			0x00, 0x0f,
+			0x80, 0x3e, 0x00, 0x00,
+			0x00, 0x00,
+			0,
+		}},
+	}
+	for _, test := range tests {
+		if got := opusHead(test.channels, test.preSkip, test.inputRate); !bytes.Equal(got, test.want) {
+			t.Errorf("opusHead(%d, %d, %d) = % x, want % x", test.channels, test.preSkip, test.inputRate, got, test.want)
+		}
+	}
+}
+
+func TestOpusTags(t *testing.T) {
+	vendor := "karaoke_generator"
+	if version := OpusVersion(); version != "" {
+		vendor += " " + version
+	}
+	want := []byte("OpusTags")
+	want = append(want, byte(len(vendor)), 0, 0, 0) // vendor string length
+	want = append(want, vendor...)
+	want = append(want, 0, 0, 0, 0) // user comment list length
+	if got := opusTags(); !bytes.Equal(got, want) {
+		t.Errorf("opusTags() = % x, want % x", got, want)
+	}
+}
+
+func TestMixChannels(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          []float32
+		inChannels  int
+		outChannels int
+		want        []float32
+	}{
+		{"mono", []float32{0.1, 0.2, 0.3}, 1, 1, []float32{0.1, 0.2, 0.3}},
+		{"stereo", []float32{0.1, -0.1, 0.2, -0.2}, 2, 2, []float32{0.1, -0.1, 0.2, -0.2}},
+		{"stereo_to_mono", []float32{0.5, 0.25, -1, 1}, 2, 1, []float32{0.375, 0}},
+		{"surround_to_mono", []float32{0.5, 0.5, 0.5, 0.5, 0.5, -0.5}, 6, 1, []float32{1.0 / 3}},
+		{"mono_to_stereo", []float32{0.5, -0.25}, 1, 2, []float32{0.5, 0.5, -0.25, -0.25}},
+		{"surround_to_stereo", []float32{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, -0.1, -0.2, -0.3, -0.4, -0.5, -0.6}, 6, 2, []float32{0.1, 0.2, -0.1, -0.2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := make([]float32, len(test.want))
+			mixChannels(test.in, test.inChannels, out, test.outChannels)
+			if !slices.Equal(out, test.want) {
+				t.Errorf("got %v, want %v", out, test.want)
+			}
+		})
+	}
+}
+
+func TestOpusOptionsValidate(t *testing.T) {
+	tests := []struct {
+		options OpusOptions
+		valid   bool
+	}{
+		{OpusOptions{Bitrate: 48000, Channels: 1}, true},
+		{OpusOptions{Bitrate: 6000, Channels: 2}, true},
+		{OpusOptions{Bitrate: 510000, Channels: 2}, true},
+		{OpusOptions{Bitrate: 5999, Channels: 1}, false},
+		{OpusOptions{Bitrate: 510001, Channels: 1}, false},
+		{OpusOptions{Bitrate: 48000, Channels: 0}, false},
+		{OpusOptions{Bitrate: 48000, Channels: 3}, false},
+	}
+	for _, test := range tests {
+		if err := test.options.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: Validate() = %v, want valid %v", test.options, err, test.valid)
+		}
+	}
+}
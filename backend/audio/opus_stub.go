@@ -0,0 +1,28 @@
+//go:build !opus
+
+package audio
+
+// OpusAvailable reports whether the binary was built with the libopus binding (-tags opus)
+const OpusAvailable = false
+
+// OpusVersion returns the version string of the linked libopus
+func OpusVersion() string {
+	return ""
+}
+
+// opusEncoder is never created without the libopus binding
+type opusEncoder struct{}
+
+func newOpusEncoder(sampleRate, channels, bitrate int) (*opusEncoder, error) {
+	return nil, ErrOpusUnavailable
+}
+
+func (e *opusEncoder) lookahead() int {
+	return 0
+}
+
+func (e *opusEncoder) encode(pcm []float32, out []byte) (int, error) {
+	return 0, ErrOpusUnavailable
+}
+
+func (e *opusEncoder) close() {}
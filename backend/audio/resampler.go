@@ -0,0 +1,281 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// ResampleQuality selects the length and stopband of the resampling filter
+type ResampleQuality string
+
+const (
+	// ResampleLow is a short filter: fast, but with a wider transition band and more aliasing
+	ResampleLow ResampleQuality = "low"
+	// ResampleMedium is a good default for stems that are encoded to Opus afterwards
+	ResampleMedium ResampleQuality = "medium"
+	// ResampleHigh cuts off at 95% of the lower Nyquist frequency with about 100 dB of stopband attenuation
+	ResampleHigh ResampleQuality = "high"
+)
+
+// resampleFilter is the windowed-sinc design of a quality level
+type resampleFilter struct {
+	// Zero crossings of the sinc on each side of the center, i.e. taps per phase / 2
+	halfTaps int
+	// Kaiser window beta
+	beta float64
+	// Cutoff as a fraction of the lower Nyquist frequency
+	rolloff float64
+}
+
+var resampleFilters = map[ResampleQuality]resampleFilter{
+	ResampleLow:    {halfTaps: 8, beta: 6, rolloff: 0.85},
+	ResampleMedium: {halfTaps: 16, beta: 8.5, rolloff: 0.91},
+	ResampleHigh:   {halfTaps: 32, beta: 10, rolloff: 0.95},
+}
+
+// maxResamplePhases bounds the filter table for rate pairs with a large reduced ratio
+const maxResamplePhases = 1 << 12
+
+// ParseResampleQuality parses a quality name, case-insensitively
+func ParseResampleQuality(name string) (ResampleQuality, error) {
+	quality := ResampleQuality(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := resampleFilters[quality]; !ok {
+		return "", fmt.Errorf("unknown resample quality %q, expected low, medium or high", name)
+	}
+	return quality, nil
+}
+
+// Resampler converts interleaved samples between two rates with a polyphase windowed-sinc filter.
+// The ratio out/in is reduced to up/down; output sample m is the input interpolated at
+// m*down/up, with no added delay.
+type Resampler struct {
+	channels int
+	up       int
+	down     int
+	taps     int
+	// filter[phase*taps+j] weights the input sample j positions before the phase's center
+	filter []float32
+
+	// Per-channel input samples starting at absolute index base
+	history [][]float32
+	base    int64
+	// Total input frames seen and next output frame to produce
+	frames int64
+	next   int64
+}
+
+// NewResampler creates a resampler for interleaved audio with the given channel count
+func NewResampler(inRate, outRate, channels int, quality ResampleQuality) (*Resampler, error) {
+	design, ok := resampleFilters[quality]
+	if !ok {
+		return nil, fmt.Errorf("unknown resample quality %q", quality)
+	}
+	if inRate < 1 || outRate < 1 || channels < 1 {
+		return nil, fmt.Errorf("invalid resampler: %d Hz to %d Hz, %d channels", inRate, outRate, channels)
+	}
+
+	divisor := gcd(inRate, outRate)
+	up, down := outRate/divisor, inRate/divisor
+	if up > maxResamplePhases {
+		return nil, fmt.Errorf("can't resample %d Hz to %d Hz: ratio %d/%d is too fine", inRate, outRate, up, down)
+	}
+
+	r := &Resampler{
+		channels: channels,
+		up:       up,
+		down:     down,
+		taps:     2 * design.halfTaps,
+		history:  make([][]float32, channels),
+	}
+	r.filter = designFilter(up, down, design)
+	return r, nil
+}
+
+// designFilter computes the polyphase table of a Kaiser-windowed sinc lowpass at the upsampled
+// rate. Every phase is normalized to unity gain at DC.
+func designFilter(up, down int, design resampleFilter) []float32 {
+	taps := 2 * design.halfTaps
+	center := float64(up * design.halfTaps)
+	// Cutoff in cycles per upsampled sample
+	cutoff := design.rolloff * 0.5 / float64(max(up, down))
+	norm := besselI0(design.beta)
+
+	filter := make([]float32, up*taps)
+	for phase := 0; phase < up; phase++ {
+		row := make([]float64, taps)
+		var sum float64
+		for j := range row {
+			x := float64(phase+j*up) - center
+			value := 2 * cutoff * sinc(2*cutoff*x)
+			if ratio := x / center; math.Abs(ratio) <= 1 {
+				value *= besselI0(design.beta*math.Sqrt(1-ratio*ratio)) / norm
+			} else {
+				value = 0
+			}
+			row[j] = value
+			sum += value
+		}
+		for j, value := range row {
+			filter[phase*taps+j] = float32(value / sum)
+		}
+	}
+	return filter
+}
+
+// Process resamples interleaved input and appends the resulting interleaved output to out.
+// Output lags by half the filter length until Flush.
+func (r *Resampler) Process(in []float32, out []float32) []float32 {
+	frames := len(in) / r.channels
+	for c := range r.history {
+		for i := 0; i < frames; i++ {
+			r.history[c] = append(r.history[c], in[i*r.channels+c])
+		}
+	}
+	r.frames += int64(frames)
+	return r.drain(out, false)
+}
+
+// Flush produces the remaining output, treating the input as followed by silence
+func (r *Resampler) Flush(out []float32) []float32 {
+	return r.drain(out, true)
+}
+
+// drain produces every output frame whose filter window is covered by the buffered input.
+// At the end of the stream the window may run past the input, which is read as zero.
+func (r *Resampler) drain(out []float32, final bool) []float32 {
+	half := int64(r.taps / 2)
+	up, down := int64(r.up), int64(r.down)
+	total := (r.frames*up + down - 1) / down
+	available := r.base + int64(len(r.history[0]))
+
+	for r.next < total {
+		position := r.next*down + half*up
+		newest := position / up
+		if newest >= available && !final {
+			break
+		}
+		coefficients := r.filter[(position-newest*up)*int64(r.taps):][:r.taps]
+
+		for c := 0; c < r.channels; c++ {
+			samples := r.history[c]
+			var sum float32
+			for j, weight := range coefficients {
+				k := newest - int64(j) - r.base
+				if k < 0 {
+					break
+				}
+				if k < int64(len(samples)) {
+					sum += weight * samples[k]
+				}
+			}
+			out = append(out, sum)
+		}
+		r.next++
+	}
+
+	// Drop input that no later output frame reaches
+	oldest := (r.next*down+half*up)/up - int64(r.taps) + 1
+	if drop := oldest - r.base; drop > 0 {
+		drop = min(drop, int64(len(r.history[0])))
+		for c := range r.history {
+			r.history[c] = append(r.history[c][:0], r.history[c][drop:]...)
+		}
+		r.base += drop
+	}
+	return out
+}
+
+// ResampleWAV converts a WAV file to outRate, keeping its channels and sample encoding. The output
+// is written to a temporary file and renamed, so outPath never holds a partial file.
+func ResampleWAV(ctx context.Context, inPath, outPath string, outRate int, quality ResampleQuality) error {
+	reader, err := OpenWAV(inPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	format := reader.Format
+	inRate := format.SampleRate
+	format.SampleRate = outRate
+
+	// Same rate: pass the samples through untouched
+	var resampler *Resampler
+	if inRate != outRate {
+		resampler, err = NewResampler(inRate, outRate, format.Channels, quality)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpPath := outPath + ".tmp"
+	writer, err := CreateWAV(tmpPath, format)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	// About a second of audio per read
+	input := make([]float32, inRate*format.Channels)
+	var output []float32
+	for {
+		if err := ctx.Err(); err != nil {
+			writer.Close()
+			return err
+		}
+		n, readErr := reader.ReadSamples(input)
+		if readErr != nil && readErr != io.EOF {
+			writer.Close()
+			return readErr
+		}
+
+		output = output[:0]
+		if resampler == nil {
+			output = append(output, input[:n]...)
+		} else {
+			output = resampler.Process(input[:n], output)
+			if readErr == io.EOF {
+				output = resampler.Flush(output)
+			}
+		}
+		if err := writer.WriteSamples(output); err != nil {
+			writer.Close()
+			return err
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, outPath)
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind, by its power series
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > sum*1e-12; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,264 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// sine returns frames samples of a mono sine wave
+func sine(rate int, frequency, amplitude float64, frames int) []float32 {
+	samples := make([]float32, frames)
+	for i := range samples {
+		samples[i] = float32(amplitude * math.Sin(2*math.Pi*frequency*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+// resampleAll runs mono input through a resampler in uneven chunks, then flushes it
+func resampleAll(t *testing.T, in []float32, inRate, outRate int, quality ResampleQuality) []float32 {
+	t.Helper()
+	r, err := NewResampler(inRate, outRate, 1, quality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []float32
+	for start, size := 0, 1; start < len(in); start, size = start+size, size%997+331 {
+		out = r.Process(in[start:min(start+size, len(in))], out)
+	}
+	return r.Flush(out)
+}
+
+// fitSine fits a sine of the given frequency to samples by least squares. It returns the
+// amplitude of the fit and the ratio in dB of its power to the power of the residual.
+func fitSine(samples []float32, rate int, frequency float64) (amplitude, snr float64) {
+	var ss, sc, cc, ys, yc float64
+	for i, y := range samples {
+		phase := 2 * math.Pi * frequency * float64(i) / float64(rate)
+		s, c := math.Sin(phase), math.Cos(phase)
+		ss += s * s
+		sc += s * c
+		cc += c * c
+		ys += float64(y) * s
+		yc += float64(y) * c
+	}
+	det := ss*cc - sc*sc
+	a := (ys*cc - yc*sc) / det
+	b := (yc*ss - ys*sc) / det
+
+	var signal, noise float64
+	for i, y := range samples {
+		phase := 2 * math.Pi * frequency * float64(i) / float64(rate)
+		fit := a*math.Sin(phase) + b*math.Cos(phase)
+		signal += fit * fit
+		noise += (float64(y) - fit) * (float64(y) - fit)
+	}
+	return math.Hypot(a, b), 10 * math.Log10(signal/noise)
+}
+
+// zeroCrossingFrequency estimates the frequency of a sine from its rising zero crossings,
+// interpolated between samples
+func zeroCrossingFrequency(samples []float32, rate int) float64 {
+	first, last := -1.0, -1.0
+	cycles := -1
+	for i := 1; i < len(samples); i++ {
+		if samples[i-1] < 0 && samples[i] >= 0 {
+			at := float64(i-1) + float64(samples[i-1]/(samples[i-1]-samples[i]))
+			if first < 0 {
+				first = at
+			}
+			last = at
+			cycles++
+		}
+	}
+	return float64(cycles) * float64(rate) / (last - first)
+}
+
+func decibels(ratio float64) float64 {
+	return 20 * math.Log10(ratio)
+}
+
+func TestResamplerSines(t *testing.T) {
+	const amplitude = 0.5
+	tests := []struct {
+		quality   ResampleQuality
+		frequency float64
+		// maxGainError is the largest passband gain error in dB
+		maxGainError float64
+		// minSNR is the smallest ratio of the tone to everything else in the output, in dB
+		minSNR float64
+		// maxImage bounds the image of the tone mirrored around the input Nyquist frequency,
+		// which aliases to 48000 - (44100 - frequency) in the output
+		maxImage float64
+	}{
+		{ResampleLow, 1000, 0.01, 70, -70},
+		{ResampleLow, 15000, 0.5, 70, -70},
+		{ResampleMedium, 1000, 0.01, 85, -80},
+		{ResampleMedium, 15000, 0.01, 85, -85},
+		{ResampleHigh, 1000, 0.01, 105, -80},
+		{ResampleHigh, 15000, 0.01, 110, -110},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s_%gHz", test.quality, test.frequency), func(t *testing.T) {
+			in := sine(44100, test.frequency, amplitude, 44100)
+			out := resampleAll(t, in, 44100, 48000, test.quality)
+			if len(out) != 48000 {
+				t.Fatalf("%v Hz: got %d output samples, want 48000", test.frequency, len(out))
+			}
+
+			// The edges are where the filter runs past the start and end of the tone
+			steady := out[2000 : len(out)-2000]
+			if got := zeroCrossingFrequency(steady, 48000); math.Abs(got-test.frequency) > 1 {
+				t.Errorf("%v Hz: output frequency is %.2f Hz", test.frequency, got)
+			}
+			got, snr := fitSine(steady, 48000, test.frequency)
+			if gain := decibels(got / amplitude); math.Abs(gain) > test.maxGainError {
+				t.Errorf("%v Hz: gain is %.3f dB, want within %.2f dB", test.frequency, gain, test.maxGainError)
+			}
+			if snr < test.minSNR {
+				t.Errorf("%v Hz: signal to noise and distortion is %.1f dB, want at least %.0f dB", test.frequency, snr, test.minSNR)
+			}
+			image, _ := fitSine(steady, 48000, 48000-(44100-test.frequency))
+			if level := decibels(image / amplitude); level > test.maxImage {
+				t.Errorf("%v Hz: image is %.1f dB, want at most %.0f dB", test.frequency, level, test.maxImage)
+			}
+		})
+	}
+}
+
+func TestResamplerStopband(t *testing.T) {
+	// 23 kHz is above the 22.05 kHz Nyquist frequency of the output and would alias to 21.1 kHz
+	tests := []struct {
+		quality  ResampleQuality
+		maxAlias float64
+	}{
+		{ResampleLow, -30},
+		{ResampleMedium, -35},
+		{ResampleHigh, -55},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.quality), func(t *testing.T) {
+			out := resampleAll(t, sine(48000, 23000, 0.5, 48000), 48000, 44100, test.quality)
+			if len(out) != 44100 {
+				t.Fatalf("got %d output samples, want 44100", len(out))
+			}
+			alias, _ := fitSine(out[2000:len(out)-2000], 44100, 44100-23000)
+			if level := decibels(alias / 0.5); level > test.maxAlias {
+				t.Errorf("alias is %.1f dB, want at most %.0f dB", level, test.maxAlias)
+			}
+		})
+	}
+}
+
+func TestResamplerImpulse(t *testing.T) {
+	for _, quality := range []ResampleQuality{ResampleLow, ResampleMedium, ResampleHigh} {
+		t.Run(string(quality), func(t *testing.T) {
+			in := make([]float32, 4410)
+			in[1000] = 1
+			out := resampleAll(t, in, 44100, 48000, quality)
+			if len(out) != 4800 {
+				t.Fatalf("got %d output samples, want 4800", len(out))
+			}
+
+			// No delay is added: the peak sits at the impulse time, 1000 * 48000 / 44100 = 1088.4
+			peak := 0
+			var sum float64
+			for i, sample := range out {
+				sum += float64(sample)
+				if math.Abs(float64(sample)) > math.Abs(float64(out[peak])) {
+					peak = i
+				}
+			}
+			if peak != 1088 {
+				t.Errorf("impulse peak at output sample %d, want 1088", peak)
+			}
+			// Unity gain at DC spreads the impulse over 48000 / 44100 output samples
+			if want := 48000.0 / 44100; math.Abs(sum-want) > 1e-3 {
+				t.Errorf("impulse response sums to %.5f, want %.5f", sum, want)
+			}
+			// The response is confined to the filter length around the peak
+			reach := resampleFilters[quality].halfTaps*48000/44100 + 2
+			for i, sample := range out {
+				if (i < peak-reach || i > peak+reach) && sample != 0 {
+					t.Fatalf("output sample %d is %g, outside the filter reach of the impulse", i, sample)
+				}
+			}
+		})
+	}
+}
+
+func TestResamplerOutputLength(t *testing.T) {
+	for _, frames := range []int{0, 1, 146, 147, 1000, 44099} {
+		in := sine(44100, 440, 0.5, frames)
+		out := resampleAll(t, in, 44100, 48000, ResampleHigh)
+		if want := (frames*160 + 146) / 147; len(out) != want {
+			t.Errorf("%d input frames: got %d output frames, want %d", frames, len(out), want)
+		}
+	}
+}
+
+func TestResampleWAV(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "in.wav")
+	outPath := filepath.Join(dir, "out.wav")
+
+	// Stereo 24-bit, with a different tone on each channel
+	left := sine(44100, 1000, 0.5, 44100)
+	right := sine(44100, 3000, 0.25, 44100)
+	interleaved := make([]float32, 0, 2*len(left))
+	for i := range left {
+		interleaved = append(interleaved, left[i], right[i])
+	}
+	writer, err := CreateWAV(inPath, WAVFormat{SampleRate: 44100, Channels: 2, BitsPerSample: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteSamples(interleaved); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResampleWAV(context.Background(), inPath, outPath, 48000, ResampleHigh); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenWAV(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if want := (WAVFormat{SampleRate: 48000, Channels: 2, BitsPerSample: 24}); reader.Format != want {
+		t.Fatalf("output format is %+v, want %+v", reader.Format, want)
+	}
+	if reader.Frames != 48000 {
+		t.Fatalf("output has %d frames, want 48000", reader.Frames)
+	}
+
+	samples := make([]float32, 2*reader.Frames)
+	n, err := reader.ReadSamples(samples)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	samples = samples[:n]
+	for channel, tone := range []struct{ frequency, amplitude float64 }{{1000, 0.5}, {3000, 0.25}} {
+		var mono []float32
+		for i := channel + 4000; i < len(samples)-4000; i += 2 {
+			mono = append(mono, samples[i])
+		}
+		amplitude, snr := fitSine(mono, 48000, tone.frequency)
+		if gain := decibels(amplitude / tone.amplitude); math.Abs(gain) > 0.01 {
+			t.Errorf("channel %d: gain is %.3f dB", channel, gain)
+		}
+		// 24-bit quantization limits the ratio to about 140 dB for a full-scale tone
+		if snr < 100 {
+			t.Errorf("channel %d: signal to noise and distortion is %.1f dB", channel, snr)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// WAV format tags of the fmt chunk
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// WAVFormat describes the samples of a WAV file
+type WAVFormat struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	// Float is true for IEEE float samples, false for integer PCM
+	Float bool
+}
+
+// WAVReader streams the samples of a PCM or IEEE float WAV file as interleaved float32 in [-1, 1]
+type WAVReader struct {
+	Format WAVFormat
+	// Frames is the number of samples per channel in the data chunk
+	Frames int64
+
+	file      *os.File
+	data      *bufio.Reader
+	remaining int64
+	frameSize int
+	buf       []byte
+}
+
+// OpenWAV opens a WAV file and reads its header. 8, 16, 24 and 32-bit integer PCM and
+// 32 and 64-bit float samples are supported, in plain or WAVE_FORMAT_EXTENSIBLE files.
+func OpenWAV(path string) (*WAVReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newWAVReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading WAV %s: %w", path, err)
+	}
+	return reader, nil
+}
+
+func newWAVReader(file *os.File) (*WAVReader, error) {
+	data := bufio.NewReaderSize(file, 64<<10)
+
+	var riff [12]byte
+	if _, err := io.ReadFull(data, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("not a RIFF/WAVE file")
+	}
+
+	reader := &WAVReader{file: file, data: data}
+	haveFormat := false
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(data, header[:]); err != nil {
+			if !haveFormat {
+				return nil, errors.New("missing fmt chunk")
+			}
+			return nil, errors.New("missing data chunk")
+		}
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(data, chunk); err != nil {
+				return nil, err
+			}
+			if err := reader.parseFormat(chunk); err != nil {
+				return nil, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return nil, errors.New("data chunk before fmt chunk")
+			}
+			// Streaming writers leave the size at 0 or 0xFFFFFFFF; read until the end of the file then
+			if size == 0 || size == 0xFFFFFFFF {
+				size = math.MaxInt64
+			}
+			reader.remaining = size - size%int64(reader.frameSize)
+			reader.Frames = reader.remaining / int64(reader.frameSize)
+			if size == math.MaxInt64 {
+				reader.Frames = -1
+				if stat, err := file.Stat(); err == nil {
+					offset, _ := file.Seek(0, io.SeekCurrent)
+					reader.Frames = (stat.Size() - offset + int64(data.Buffered())) / int64(reader.frameSize)
+				}
+			}
+			return reader, nil
+		default:
+			if _, err := data.Discard(int(size)); err != nil {
+				return nil, err
+			}
+		}
+		// Chunks are word aligned
+		if size%2 == 1 {
+			data.Discard(1)
+		}
+	}
+}
+
+// parseFormat reads the fmt chunk
+func (r *WAVReader) parseFormat(chunk []byte) error {
+	if len(chunk) < 16 {
+		return errors.New("fmt chunk too short")
+	}
+	tag := binary.LittleEndian.Uint16(chunk[0:2])
+	r.Format.Channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+	r.Format.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+	blockAlign := int(binary.LittleEndian.Uint16(chunk[12:14]))
+	r.Format.BitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:16]))
+
+	if tag == wavFormatExtensible {
+		if len(chunk) < 26 {
+			return errors.New("WAVE_FORMAT_EXTENSIBLE fmt chunk too short")
+		}
+		// The sub format GUID starts with the actual format tag
+		tag = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+
+	switch {
+	case tag == wavFormatPCM && (r.Format.BitsPerSample == 8 || r.Format.BitsPerSample == 16 ||
+		r.Format.BitsPerSample == 24 || r.Format.BitsPerSample == 32):
+	case tag == wavFormatFloat && (r.Format.BitsPerSample == 32 || r.Format.BitsPerSample == 64):
+		r.Format.Float = true
+	default:
+		return fmt.Errorf("unsupported WAV encoding: format %#x with %d bits per sample", tag, r.Format.BitsPerSample)
+	}
+	if r.Format.Channels < 1 || r.Format.SampleRate < 1 {
+		return fmt.Errorf("invalid WAV header: %d channels at %d Hz", r.Format.Channels, r.Format.SampleRate)
+	}
+
+	r.frameSize = r.Format.Channels * r.Format.BitsPerSample / 8
+	if blockAlign > r.frameSize {
+		return fmt.Errorf("unsupported WAV block alignment %d for %d-bit samples", blockAlign, r.Format.BitsPerSample)
+	}
+	return nil
+}
+
+// ReadSamples fills dst with interleaved samples and returns how many it read, always a whole
+// number of frames. It returns io.EOF once every sample has been read.
+func (r *WAVReader) ReadSamples(dst []float32) (int, error) {
+	bytesPerSample := r.Format.BitsPerSample / 8
+	frames := len(dst) / r.Format.Channels
+	if int64(frames*r.frameSize) > r.remaining {
+		frames = int(r.remaining / int64(r.frameSize))
+	}
+	if frames == 0 {
+		return 0, io.EOF
+	}
+
+	size := frames * r.frameSize
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size)
+	}
+	buf := r.buf[:size]
+	n, err := io.ReadFull(r.data, buf)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0) {
+		// Truncated file or a data chunk of unknown size: keep the whole frames that were read
+		r.remaining = 0
+		buf = buf[:n-n%r.frameSize]
+		if len(buf) == 0 {
+			return 0, io.EOF
+		}
+	} else if err != nil {
+		return 0, err
+	} else {
+		r.remaining -= int64(size)
+	}
+
+	count := len(buf) / bytesPerSample
+	for i := 0; i < count; i++ {
+		dst[i] = decodeSample(buf[i*bytesPerSample:], r.Format)
+	}
+	return count, nil
+}
+
+// decodeSample converts one little-endian sample to a float32 in [-1, 1]
+func decodeSample(b []byte, format WAVFormat) float32 {
+	switch {
+	case format.Float && format.BitsPerSample == 32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b))
+	case format.Float:
+		return float32(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case format.BitsPerSample == 8:
+		// 8-bit WAV is unsigned
+		return float32(int(b[0])-128) / 128
+	case format.BitsPerSample == 16:
+		return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case format.BitsPerSample == 24:
+		value := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float32(value) / (1 << 23)
+	default:
+		return float32(float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31))
+	}
+}
+
+// Close closes the underlying file
+func (r *WAVReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,143 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// WAVWriter streams interleaved float32 samples into a PCM or IEEE float WAV file.
+// The RIFF and data sizes are patched in by Close.
+type WAVWriter struct {
+	Format WAVFormat
+
+	file    *os.File
+	out     *bufio.Writer
+	written int64
+	buf     []byte
+}
+
+// CreateWAV creates a WAV file with the given format; see OpenWAV for the supported encodings
+func CreateWAV(path string, format WAVFormat) (*WAVWriter, error) {
+	if err := checkWAVFormat(format); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := &WAVWriter{Format: format, file: file, out: bufio.NewWriterSize(file, 64<<10)}
+	if err := writer.writeHeader(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+func checkWAVFormat(format WAVFormat) error {
+	switch {
+	case format.Channels < 1 || format.SampleRate < 1:
+		return fmt.Errorf("invalid WAV format: %d channels at %d Hz", format.Channels, format.SampleRate)
+	case format.Float && (format.BitsPerSample == 32 || format.BitsPerSample == 64):
+	case !format.Float && (format.BitsPerSample == 8 || format.BitsPerSample == 16 ||
+		format.BitsPerSample == 24 || format.BitsPerSample == 32):
+	default:
+		return fmt.Errorf("unsupported WAV encoding: %d-bit (float %v)", format.BitsPerSample, format.Float)
+	}
+	return nil
+}
+
+// writeHeader writes the 44-byte canonical header for a data chunk of dataSize bytes
+func (w *WAVWriter) writeHeader(dataSize int64) error {
+	tag := uint16(wavFormatPCM)
+	if w.Format.Float {
+		tag = wavFormatFloat
+	}
+	blockAlign := w.Format.Channels * w.Format.BitsPerSample / 8
+
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(36+dataSize))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, tag)
+	header = binary.LittleEndian.AppendUint16(header, uint16(w.Format.Channels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(w.Format.SampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(w.Format.SampleRate*blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(w.Format.BitsPerSample))
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(dataSize))
+
+	_, err := w.out.Write(header)
+	return err
+}
+
+// WriteSamples appends interleaved samples; integer formats are clipped to [-1, 1]
+func (w *WAVWriter) WriteSamples(samples []float32) error {
+	bytesPerSample := w.Format.BitsPerSample / 8
+	size := len(samples) * bytesPerSample
+	if cap(w.buf) < size {
+		w.buf = make([]byte, size)
+	}
+	buf := w.buf[:size]
+	for i, sample := range samples {
+		encodeSample(buf[i*bytesPerSample:], sample, w.Format)
+	}
+	if _, err := w.out.Write(buf); err != nil {
+		return err
+	}
+	w.written += int64(size)
+	return nil
+}
+
+// encodeSample converts a float32 sample to little-endian bytes in the writer's format
+func encodeSample(b []byte, sample float32, format WAVFormat) {
+	if format.Float {
+		if format.BitsPerSample == 32 {
+			binary.LittleEndian.PutUint32(b, math.Float32bits(sample))
+		} else {
+			binary.LittleEndian.PutUint64(b, math.Float64bits(float64(sample)))
+		}
+		return
+	}
+
+	value := math.Max(-1, math.Min(1, float64(sample)))
+	switch format.BitsPerSample {
+	case 8:
+		b[0] = byte(math.Round(value*127) + 128)
+	case 16:
+		binary.LittleEndian.PutUint16(b, uint16(int16(math.Round(value*math.MaxInt16))))
+	case 24:
+		scaled := int32(math.Round(value * (1<<23 - 1)))
+		b[0], b[1], b[2] = byte(scaled), byte(scaled>>8), byte(scaled>>16)
+	default:
+		binary.LittleEndian.PutUint32(b, uint32(int32(math.Round(value*math.MaxInt32))))
+	}
+}
+
+// Close flushes the samples, writes the final chunk sizes and closes the file
+func (w *WAVWriter) Close() error {
+	err := w.out.Flush()
+	if err == nil && w.written%2 == 1 {
+		// Chunks are word aligned
+		_, err = w.file.Write([]byte{0})
+	}
+	if err == nil {
+		_, err = w.file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		w.out.Reset(w.file)
+		err = w.writeHeader(w.written)
+	}
+	if err == nil {
+		err = w.out.Flush()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
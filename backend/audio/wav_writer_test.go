@@ -0,0 +1,114 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAVRoundTrip(t *testing.T) {
+	tests := []struct {
+		format WAVFormat
+		// tolerance is the largest difference allowed by the quantization of the encoding
+		tolerance float64
+	}{
+		{WAVFormat{SampleRate: 8000, Channels: 1, BitsPerSample: 8}, 1.5 / 128},
+		{WAVFormat{SampleRate: 44100, Channels: 2, BitsPerSample: 16}, 1.5 / (1 << 15)},
+		{WAVFormat{SampleRate: 48000, Channels: 2, BitsPerSample: 24}, 1.5 / (1 << 23)},
+		{WAVFormat{SampleRate: 48000, Channels: 1, BitsPerSample: 32}, 1e-7},
+		{WAVFormat{SampleRate: 96000, Channels: 2, BitsPerSample: 32, Float: true}, 0},
+		{WAVFormat{SampleRate: 22050, Channels: 1, BitsPerSample: 64, Float: true}, 0},
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprintf("%dbit_%dch", test.format.BitsPerSample, test.format.Channels)
+		if test.format.Float {
+			name += "_float"
+		}
+		t.Run(name, func(t *testing.T) {
+			// An odd frame count makes the 8-bit mono data chunk odd, which needs a pad byte
+			const frames = 1001
+			samples := make([]float32, frames*test.format.Channels)
+			for i := range samples {
+				samples[i] = float32(0.9 * math.Sin(float64(i)*0.37))
+			}
+			// Full scale in both directions
+			samples[0], samples[1] = 1, -1
+
+			path := filepath.Join(t.TempDir(), "round_trip.wav")
+			writer, err := CreateWAV(path, test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Written in two calls to cover appending to the data chunk
+			if err := writer.WriteSamples(samples[:len(samples)/2]); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.WriteSamples(samples[len(samples)/2:]); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataSize := int64(len(samples) * test.format.BitsPerSample / 8)
+			if want := 44 + dataSize + dataSize%2; info.Size() != want {
+				t.Errorf("file is %d bytes, want %d", info.Size(), want)
+			}
+
+			reader, err := OpenWAV(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			if reader.Format != test.format {
+				t.Fatalf("read format %+v, want %+v", reader.Format, test.format)
+			}
+			if reader.Frames != frames {
+				t.Fatalf("read %d frames, want %d", reader.Frames, frames)
+			}
+
+			// Read in small chunks to cover partial reads
+			var read []float32
+			chunk := make([]float32, 64*test.format.Channels)
+			for {
+				n, err := reader.ReadSamples(chunk)
+				read = append(read, chunk[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(read) != len(samples) {
+				t.Fatalf("read %d samples, want %d", len(read), len(samples))
+			}
+			for i := range samples {
+				if diff := math.Abs(float64(read[i] - samples[i])); diff > test.tolerance {
+					t.Fatalf("sample %d: read %g, wrote %g", i, read[i], samples[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateWAVRejectsUnsupportedFormats(t *testing.T) {
+	for _, format := range []WAVFormat{
+		{SampleRate: 48000, Channels: 0, BitsPerSample: 16},
+		{SampleRate: 0, Channels: 1, BitsPerSample: 16},
+		{SampleRate: 48000, Channels: 1, BitsPerSample: 12},
+		{SampleRate: 48000, Channels: 1, BitsPerSample: 16, Float: true},
+	} {
+		if _, err := CreateWAV(filepath.Join(t.TempDir(), "bad.wav"), format); err == nil {
+			t.Errorf("CreateWAV accepted %+v", format)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"karaoke_generator/audio"
+	"karaoke_generator/function"
+)
+
+// DefaultPath is the configuration file read when none is given and it exists
+const DefaultPath = "config.yaml"
+
+// Duration is a time.Duration written as a string such as "45m" in YAML and TOML files
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = value
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Config is the whole server configuration
+type Config struct {
+	Server   ServerConfig          `yaml:"server" toml:"server"`
+	Tools    ToolsConfig           `yaml:"tools" toml:"tools"`
+	Storage  StorageConfig         `yaml:"storage" toml:"storage"`
+	Queue    QueueConfig           `yaml:"queue" toml:"queue"`
+	Steps    map[string]StepConfig `yaml:"steps" toml:"steps"`
+	Ogg      OggConfig             `yaml:"ogg" toml:"ogg"`
+	Resample ResampleConfig        `yaml:"resample" toml:"resample"`
+	ASS      ASSConfig             `yaml:"ass" toml:"ass"`
+	Cache    CacheConfig           `yaml:"cache" toml:"cache"`
+	Upload   UploadConfig          `yaml:"upload" toml:"upload"`
+	Janitor  JanitorConfig         `yaml:"janitor" toml:"janitor"`
+	Progress ProgressConfig        `yaml:"progress" toml:"progress"`
+}
+
+// ServerConfig controls the HTTP server
+type ServerConfig struct {
+	// Addr is the listen address, e.g. ":8080"
+	Addr string `yaml:"addr" toml:"addr"`
+}
+
+// ToolsConfig locates the external programs run by the pipeline
+type ToolsConfig struct {
+	// Conda is the conda executable; empty means look it up on PATH
+	Conda         string `yaml:"conda" toml:"conda"`
+	DemucsEnv     string `yaml:"demucs_env" toml:"demucs_env"`
+	MFAEnv        string `yaml:"mfa_env" toml:"mfa_env"`
+	Python        string `yaml:"python" toml:"python"`
+	PitchAnalyzer string `yaml:"pitch_analyzer" toml:"pitch_analyzer"`
+	FFmpeg        string `yaml:"ffmpeg" toml:"ffmpeg"`
+	FFprobe       string `yaml:"ffprobe" toml:"ffprobe"`
+}
+
+// StorageConfig holds the directories the server writes to
+type StorageConfig struct {
+	UploadDir    string `yaml:"upload_dir" toml:"upload_dir"`
+	TempDir      string `yaml:"temp_dir" toml:"temp_dir"`
+	WorkspaceDir string `yaml:"workspace_dir" toml:"workspace_dir"`
+}
+
+// QueueConfig bounds how many jobs run and wait at once
+type QueueConfig struct {
+	Workers   int `yaml:"workers" toml:"workers"`
+	MaxQueued int `yaml:"max_queued" toml:"max_queued"`
+}
+
+// StepConfig overrides the timeout and retries of a pipeline step; unset fields keep the step's default
+type StepConfig struct {
+	Timeout *Duration `yaml:"timeout" toml:"timeout"`
+	Retries *int      `yaml:"retries" toml:"retries"`
+}
+
+// OggConfig controls the Opus encoding of the OGG stems
+type OggConfig struct {
+	BitrateKbps int `yaml:"bitrate_kbps" toml:"bitrate_kbps"`
+	// Channels is 1 for mono or 2 for stereo
+	Channels int `yaml:"channels" toml:"channels"`
+}
+
+// ResampleConfig controls the conversion of the stems to 48 kHz
+type ResampleConfig struct {
+	// Quality is "low", "medium" or "high"
+	Quality string `yaml:"quality" toml:"quality"`
+}
+
+// ASSConfig controls the look of the ASS karaoke subtitles
+type ASSConfig struct {
+	Font     string `yaml:"font" toml:"font"`
+	FontSize int    `yaml:"font_size" toml:"font_size"`
+	// Colors are "#RRGGBB" or "#RRGGBBAA"
+	SungColor    string  `yaml:"sung_color" toml:"sung_color"`
+	UnsungColor  string  `yaml:"unsung_color" toml:"unsung_color"`
+	OutlineColor string  `yaml:"outline_color" toml:"outline_color"`
+	ShadowColor  string  `yaml:"shadow_color" toml:"shadow_color"`
+	Outline      float64 `yaml:"outline" toml:"outline"`
+	Shadow       float64 `yaml:"shadow" toml:"shadow"`
+	MarginV      int     `yaml:"margin_v" toml:"margin_v"`
+	// Lines is 1 for a single centered line or 2 for alternating lines
+	Lines   int      `yaml:"lines" toml:"lines"`
+	PreRoll Duration `yaml:"pre_roll" toml:"pre_roll"`
+	// Fill sweeps the color across each word (\kf) instead of switching it at once (\k)
+	Fill bool `yaml:"fill" toml:"fill"`
+}
+
+// CacheConfig controls the stem cache
+type CacheConfig struct {
+	Dir string `yaml:"dir" toml:"dir"`
+	// MaxMB bounds the cache size; 0 disables the cache
+	MaxMB int `yaml:"max_mb" toml:"max_mb"`
+}
+
+// UploadConfig bounds uploaded audio files; a zero limit disables its check
+type UploadConfig struct {
+	MaxMB           int `yaml:"max_mb" toml:"max_mb"`
+	MinAudioSeconds int `yaml:"min_audio_seconds" toml:"min_audio_seconds"`
+	MaxAudioSeconds int `yaml:"max_audio_seconds" toml:"max_audio_seconds"`
+	MinSampleRate   int `yaml:"min_sample_rate" toml:"min_sample_rate"`
+}
+
+// JanitorConfig controls how long session artifacts are kept; a zero TTL keeps them forever
+type JanitorConfig struct {
+	Interval         Duration `yaml:"interval" toml:"interval"`
+	SessionTTL       Duration `yaml:"session_ttl" toml:"session_ttl"`
+	FailedSessionTTL Duration `yaml:"failed_session_ttl" toml:"failed_session_ttl"`
+	UploadTTL        Duration `yaml:"upload_ttl" toml:"upload_ttl"`
+	TempTTL          Duration `yaml:"temp_ttl" toml:"temp_ttl"`
+}
+
+// ProgressConfig controls where progress and learned step durations are stored
+type ProgressConfig struct {
+	// Store is "file" to keep sessions across restarts or "memory"
+	Store string `yaml:"store" toml:"store"`
+	// StorePath is the directory of the file store, one state and one history file per session
+	StorePath    string `yaml:"store_path" toml:"store_path"`
+	ETAStorePath string `yaml:"eta_store_path" toml:"eta_store_path"`
+}
+
+// Default returns the configuration used when neither a file nor the environment set a value
+func Default() *Config {
+	defaults := function.DefaultJobOptions()
+	tools := defaults.Tools
+
+	return &Config{
+		Server: ServerConfig{Addr: ":8080"},
+		Tools: ToolsConfig{
+			DemucsEnv:     tools.DemucsEnv,
+			MFAEnv:        tools.MFAEnv,
+			Python:        tools.PythonPath,
+			PitchAnalyzer: tools.PitchAnalyzerScript,
+			FFmpeg:        tools.FFmpegPath,
+			FFprobe:       tools.FFprobePath,
+		},
+		Storage: StorageConfig{
+			UploadDir:    "./uploads",
+			TempDir:      "./temp",
+			WorkspaceDir: defaults.WorkspaceDir,
+		},
+		Queue: QueueConfig{Workers: 1, MaxQueued: 10},
+		Steps: make(map[string]StepConfig),
+		Ogg: OggConfig{
+			BitrateKbps: defaults.Ogg.Bitrate / 1000,
+			Channels:    defaults.Ogg.Channels,
+		},
+		Resample: ResampleConfig{Quality: string(defaults.Resample)},
+		ASS: ASSConfig{
+			Font:         defaults.ASS.Font,
+			FontSize:     defaults.ASS.FontSize,
+			SungColor:    defaults.ASS.SungColor,
+			UnsungColor:  defaults.ASS.UnsungColor,
+			OutlineColor: defaults.ASS.OutlineColor,
+			ShadowColor:  defaults.ASS.ShadowColor,
+			Outline:      defaults.ASS.Outline,
+			Shadow:       defaults.ASS.Shadow,
+			MarginV:      defaults.ASS.MarginV,
+			Lines:        defaults.ASS.Lines,
+			PreRoll:      Duration{defaults.ASS.PreRoll},
+			Fill:         defaults.ASS.Fill,
+		},
+		Cache: CacheConfig{
+			Dir:   defaults.Cache.Dir,
+			MaxMB: int(defaults.Cache.MaxBytes >> 20),
+		},
+		Upload: UploadConfig{
+			MaxMB:           100,
+			MinAudioSeconds: 5,
+			MaxAudioSeconds: 15 * 60,
+			MinSampleRate:   16000,
+		},
+		Janitor: JanitorConfig{
+			Interval:         Duration{10 * time.Minute},
+			SessionTTL:       Duration{24 * time.Hour},
+			FailedSessionTTL: Duration{72 * time.Hour},
+			UploadTTL:        Duration{24 * time.Hour},
+			TempTTL:          Duration{time.Hour},
+		},
+		Progress: ProgressConfig{
+			Store:        "file",
+			StorePath:    "./data/progress",
+			ETAStorePath: "./data/step_durations.json",
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, then the file at path (YAML or TOML,
+// chosen by extension), then the KARAOKE_* environment variables, and validates the result.
+// An empty path reads DefaultPath if it exists.
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	if path == "" {
+		if _, err := os.Stat(DefaultPath); err == nil {
+			path = DefaultPath
+		}
+	}
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadFile overlays the values set in a YAML or TOML file
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		// An empty file decodes to io.EOF and simply keeps the defaults
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(content), c)
+		if err != nil {
+			return fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("error parsing config file %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("unsupported config file %s: use .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Validate reports every invalid value at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must not be empty")
+	check(c.Tools.DemucsEnv != "", "tools.demucs_env must not be empty")
+	check(c.Tools.MFAEnv != "", "tools.mfa_env must not be empty")
+	check(c.Tools.Python != "", "tools.python must not be empty")
+	check(c.Tools.PitchAnalyzer != "", "tools.pitch_analyzer must not be empty")
+	check(c.Tools.FFmpeg != "", "tools.ffmpeg must not be empty")
+	check(c.Tools.FFprobe != "", "tools.ffprobe must not be empty")
+	check(c.Storage.UploadDir != "", "storage.upload_dir must not be empty")
+	check(c.Storage.TempDir != "", "storage.temp_dir must not be empty")
+	check(c.Storage.WorkspaceDir != "", "storage.workspace_dir must not be empty")
+	check(c.Queue.Workers >= 1, "queue.workers must be at least 1, got %d", c.Queue.Workers)
+	check(c.Queue.MaxQueued >= 1, "queue.max_queued must be at least 1, got %d", c.Queue.MaxQueued)
+	if err := c.oggOptions().Validate(); err != nil {
+		problems = append(problems, "ogg: "+err.Error())
+	}
+	if _, err := audio.ParseResampleQuality(c.Resample.Quality); err != nil {
+		problems = append(problems, "resample.quality: "+err.Error())
+	}
+	if err := c.ASSOptions().Validate(); err != nil {
+		problems = append(problems, "ass: "+err.Error())
+	}
+	check(c.Cache.Dir != "", "cache.dir must not be empty")
+	check(c.Cache.MaxMB >= 0, "cache.max_mb must not be negative, got %d", c.Cache.MaxMB)
+	check(c.Upload.MaxMB >= 0, "upload.max_mb must not be negative, got %d", c.Upload.MaxMB)
+	check(c.Upload.MinAudioSeconds >= 0, "upload.min_audio_seconds must not be negative, got %d", c.Upload.MinAudioSeconds)
+	check(c.Upload.MaxAudioSeconds >= 0, "upload.max_audio_seconds must not be negative, got %d", c.Upload.MaxAudioSeconds)
+	check(c.Upload.MaxAudioSeconds == 0 || c.Upload.MaxAudioSeconds >= c.Upload.MinAudioSeconds,
+		"upload.max_audio_seconds (%d) must not be below upload.min_audio_seconds (%d)", c.Upload.MaxAudioSeconds, c.Upload.MinAudioSeconds)
+	check(c.Upload.MinSampleRate >= 0, "upload.min_sample_rate must not be negative, got %d", c.Upload.MinSampleRate)
+	check(c.Progress.Store == "file" || c.Progress.Store == "memory", "progress.store must be \"file\" or \"memory\", got %q", c.Progress.Store)
+	check(c.Progress.Store != "file" || c.Progress.StorePath != "", "progress.store_path must not be empty when progress.store is \"file\"")
+
+	for name, value := range map[string]Duration{
+		"janitor.interval":           c.Janitor.Interval,
+		"janitor.session_ttl":        c.Janitor.SessionTTL,
+		"janitor.failed_session_ttl": c.Janitor.FailedSessionTTL,
+		"janitor.upload_ttl":         c.Janitor.UploadTTL,
+		"janitor.temp_ttl":           c.Janitor.TempTTL,
+	} {
+		check(value.Duration >= 0, "%s must not be negative, got %s", name, value.Duration)
+	}
+
+	defaultPolicies := function.DefaultStepPolicies()
+	for name, step := range c.Steps {
+		_, known := defaultPolicies[name]
+		check(known, "steps.%s is not a pipeline step", name)
+		check(step.Timeout == nil || step.Timeout.Duration >= 0, "steps.%s.timeout must not be negative", name)
+		check(step.Retries == nil || *step.Retries >= 0, "steps.%s.retries must not be negative", name)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// JobOptions returns the tool locations, storage, step policies and encoding settings handed
+// to every pipeline job
+func (c *Config) JobOptions() function.JobOptions {
+	return function.JobOptions{
+		Tools: function.Tools{
+			CondaPath:           c.Tools.Conda,
+			DemucsEnv:           c.Tools.DemucsEnv,
+			MFAEnv:              c.Tools.MFAEnv,
+			PythonPath:          c.Tools.Python,
+			PitchAnalyzerScript: c.Tools.PitchAnalyzer,
+			FFmpegPath:          c.Tools.FFmpeg,
+			FFprobePath:         c.Tools.FFprobe,
+		},
+		WorkspaceDir: c.Storage.WorkspaceDir,
+		Ogg:          c.oggOptions(),
+		Resample:     c.resampleQuality(),
+		StepPolicies: c.StepPolicies(),
+		Cache: function.StemCacheOptions{
+			Dir:      c.Cache.Dir,
+			MaxBytes: int64(c.Cache.MaxMB) << 20,
+		},
+		ASS: c.ASSOptions(),
+	}
+}
+
+func (c *Config) oggOptions() audio.OpusOptions {
+	return audio.OpusOptions{Bitrate: c.Ogg.BitrateKbps * 1000, Channels: c.Ogg.Channels}
+}
+
+// resampleQuality returns the configured quality; Validate has already rejected unknown names
+func (c *Config) resampleQuality() audio.ResampleQuality {
+	quality, _ := audio.ParseResampleQuality(c.Resample.Quality)
+	return quality
+}
+
+// ASSOptions returns the look of the ASS karaoke subtitles
+func (c *Config) ASSOptions() function.ASSOptions {
+	return function.ASSOptions{
+		Font:         c.ASS.Font,
+		FontSize:     c.ASS.FontSize,
+		SungColor:    c.ASS.SungColor,
+		UnsungColor:  c.ASS.UnsungColor,
+		OutlineColor: c.ASS.OutlineColor,
+		ShadowColor:  c.ASS.ShadowColor,
+		Outline:      c.ASS.Outline,
+		Shadow:       c.ASS.Shadow,
+		MarginV:      c.ASS.MarginV,
+		Lines:        c.ASS.Lines,
+		PreRoll:      c.ASS.PreRoll.Duration,
+		Fill:         c.ASS.Fill,
+	}
+}
+
+// StepPolicies returns the step policies with the configured overrides applied
+func (c *Config) StepPolicies() map[string]function.StepPolicy {
+	policies := function.DefaultStepPolicies()
+	for name, step := range c.Steps {
+		policy := policies[name]
+		if step.Timeout != nil {
+			policy.Timeout = step.Timeout.Duration
+		}
+		if step.Retries != nil {
+			policy.Retries = *step.Retries
+		}
+		policies[name] = policy
+	}
+	return policies
+}
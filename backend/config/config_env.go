@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"karaoke_generator/function"
+)
+
+// applyEnv overlays the KARAOKE_* environment variables. Unlike values that are simply
+// missing, a variable that is set but can't be parsed is reported as an error.
+func (c *Config) applyEnv() error {
+	var problems []string
+
+	str := func(name string, target *string) {
+		if value := os.Getenv(name); value != "" {
+			*target = value
+		}
+	}
+	integer := func(name string, target *int) {
+		value := os.Getenv(name)
+		if value == "" {
+			return
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q is not an integer", name, value))
+			return
+		}
+		*target = parsed
+	}
+	duration := func(name string, target *Duration) {
+		value := os.Getenv(name)
+		if value == "" {
+			return
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q is not a duration such as \"45m\"", name, value))
+			return
+		}
+		target.Duration = parsed
+	}
+
+	str("KARAOKE_ADDR", &c.Server.Addr)
+	if port := os.Getenv("KARAOKE_PORT"); port != "" {
+		c.Server.Addr = ":" + port
+	}
+
+	str("KARAOKE_CONDA_PATH", &c.Tools.Conda)
+	str("KARAOKE_DEMUCS_ENV", &c.Tools.DemucsEnv)
+	str("KARAOKE_MFA_ENV", &c.Tools.MFAEnv)
+	str("KARAOKE_PYTHON_PATH", &c.Tools.Python)
+	str("KARAOKE_PITCH_ANALYZER", &c.Tools.PitchAnalyzer)
+	str("KARAOKE_FFMPEG_PATH", &c.Tools.FFmpeg)
+	str("KARAOKE_FFPROBE_PATH", &c.Tools.FFprobe)
+
+	str("KARAOKE_UPLOAD_DIR", &c.Storage.UploadDir)
+	str("KARAOKE_TEMP_DIR", &c.Storage.TempDir)
+	str("KARAOKE_WORKSPACE_DIR", &c.Storage.WorkspaceDir)
+
+	integer("KARAOKE_WORKERS", &c.Queue.Workers)
+	integer("KARAOKE_MAX_QUEUED", &c.Queue.MaxQueued)
+
+	// Timeout and retries of every step, e.g. KARAOKE_ALIGNMENT_TIMEOUT=45m, KARAOKE_ALIGNMENT_RETRIES=2.
+	// An empty "steps:" in the config file leaves the map nil.
+	if c.Steps == nil {
+		c.Steps = make(map[string]StepConfig)
+	}
+	for name := range function.DefaultStepPolicies() {
+		prefix := "KARAOKE_" + strings.ToUpper(name)
+		step := c.Steps[name]
+		if os.Getenv(prefix+"_TIMEOUT") != "" {
+			timeout := Duration{}
+			if step.Timeout != nil {
+				timeout = *step.Timeout
+			}
+			duration(prefix+"_TIMEOUT", &timeout)
+			step.Timeout = &timeout
+		}
+		if os.Getenv(prefix+"_RETRIES") != "" {
+			retries := 0
+			if step.Retries != nil {
+				retries = *step.Retries
+			}
+			integer(prefix+"_RETRIES", &retries)
+			step.Retries = &retries
+		}
+		if step.Timeout != nil || step.Retries != nil {
+			c.Steps[name] = step
+		}
+	}
+
+	integer("KARAOKE_OGG_BITRATE_KBPS", &c.Ogg.BitrateKbps)
+	integer("KARAOKE_OGG_CHANNELS", &c.Ogg.Channels)
+	str("KARAOKE_RESAMPLE_QUALITY", &c.Resample.Quality)
+
+	str("KARAOKE_ASS_FONT", &c.ASS.Font)
+	integer("KARAOKE_ASS_FONT_SIZE", &c.ASS.FontSize)
+	duration("KARAOKE_ASS_PRE_ROLL", &c.ASS.PreRoll)
+
+	str("KARAOKE_STEM_CACHE_DIR", &c.Cache.Dir)
+	integer("KARAOKE_STEM_CACHE_MAX_MB", &c.Cache.MaxMB)
+
+	integer("KARAOKE_MAX_UPLOAD_MB", &c.Upload.MaxMB)
+	integer("KARAOKE_MIN_AUDIO_SECONDS", &c.Upload.MinAudioSeconds)
+	integer("KARAOKE_MAX_AUDIO_SECONDS", &c.Upload.MaxAudioSeconds)
+	integer("KARAOKE_MIN_SAMPLE_RATE", &c.Upload.MinSampleRate)
+
+	duration("KARAOKE_JANITOR_INTERVAL", &c.Janitor.Interval)
+	duration("KARAOKE_SESSION_TTL", &c.Janitor.SessionTTL)
+	duration("KARAOKE_FAILED_SESSION_TTL", &c.Janitor.FailedSessionTTL)
+	duration("KARAOKE_UPLOAD_TTL", &c.Janitor.UploadTTL)
+	duration("KARAOKE_TEMP_TTL", &c.Janitor.TempTTL)
+
+	str("KARAOKE_PROGRESS_STORE", &c.Progress.Store)
+	str("KARAOKE_PROGRESS_STORE_PATH", &c.Progress.StorePath)
+	str("KARAOKE_ETA_STORE_PATH", &c.Progress.ETAStorePath)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid environment:\n  %s", strings.Join(problems, "\n  "))
+}
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"karaoke_generator/function"
+)
+
+// writeConfig writes a config file named name into a temp dir and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	config, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Addr != ":8080" || config.Queue.Workers != 1 || config.Ogg.BitrateKbps != 48 {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+	if policies := config.StepPolicies(); len(policies) != len(function.DefaultStepPolicies()) {
+		t.Errorf("got %d step policies, want every step", len(policies))
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"config.yaml", `
+server:
+  addr: ":9000"
+queue:
+  workers: 3
+steps:
+  alignment:
+    timeout: 45m
+  stem_cache_store:
+    retries: 0
+janitor:
+  session_ttl: 2h
+`},
+		{"config.toml", `
+[server]
+addr = ":9000"
+
+[queue]
+workers = 3
+
+[steps.alignment]
+timeout = "45m"
+
+[steps.stem_cache_store]
+retries = 0
+
+[janitor]
+session_ttl = "2h"
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := Load(writeConfig(t, test.name, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Server.Addr != ":9000" || config.Queue.Workers != 3 {
+				t.Errorf("file values not applied: server %+v, queue %+v", config.Server, config.Queue)
+			}
+			// Values the file doesn't set keep their defaults
+			if config.Queue.MaxQueued != 10 || config.Janitor.FailedSessionTTL.Duration != 72*time.Hour {
+				t.Errorf("defaults lost: queue %+v, janitor %+v", config.Queue, config.Janitor)
+			}
+			if config.Janitor.SessionTTL.Duration != 2*time.Hour {
+				t.Errorf("janitor.session_ttl = %s, want 2h", config.Janitor.SessionTTL.Duration)
+			}
+
+			policy := config.StepPolicies()[function.StepAlignment]
+			if want := function.DefaultStepPolicies()[function.StepAlignment]; policy.Timeout != 45*time.Minute || policy.Retries != want.Retries {
+				t.Errorf("alignment policy = %+v, want a 45m timeout and the default %d retries", policy, want.Retries)
+			}
+		})
+	}
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		// A typo must not silently keep the default
+		{"config.yaml", "queue:\n  worker: 3\n", "worker"},
+		{"config.yml", "sever:\n  addr: \":9000\"\n", "sever"},
+		{"config.toml", "[queue]\nworker = 3\n", "queue.worker"},
+		{"config.toml", "[sever]\naddr = \":9000\"\n", "sever"},
+		{"config.yaml", "steps:\n  alignmnet:\n    retries: 2\n", "steps.alignmnet is not a pipeline step"},
+		{"config.toml", "[steps.separation]\nattempts = 2\n", "steps.separation.attempts"},
+		{"config.json", "{}", "unsupported config file"},
+	}
+	for _, test := range tests {
+		_, err := Load(writeConfig(t, test.name, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s %q: error %v, want it to mention %q", test.name, test.content, err, test.want)
+		}
+	}
+}
+
+func TestLoadEmptyFile(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.toml"} {
+		config, err := Load(writeConfig(t, name, ""))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if config.Server.Addr != Default().Server.Addr {
+			t.Errorf("%s: defaults not kept", name)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+server:
+  addr: ":9000"
+steps:
+  alignment:
+    retries: 3
+`)
+	t.Setenv("KARAOKE_PORT", "9090")
+	t.Setenv("KARAOKE_WORKERS", "4")
+	t.Setenv("KARAOKE_CONDA_PATH", "/opt/conda/bin/conda")
+	t.Setenv("KARAOKE_SESSION_TTL", "90m")
+	t.Setenv("KARAOKE_ASS_PRE_ROLL", "1500ms")
+	t.Setenv("KARAOKE_ALIGNMENT_TIMEOUT", "45m")
+	t.Setenv("KARAOKE_SEPARATION_RETRIES", "0")
+	t.Setenv("KARAOKE_STEM_CACHE_STORE_TIMEOUT", "30s")
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The environment wins over the file
+	if config.Server.Addr != ":9090" {
+		t.Errorf("server.addr = %q, want :9090", config.Server.Addr)
+	}
+	if config.Queue.Workers != 4 || config.Tools.Conda != "/opt/conda/bin/conda" {
+		t.Errorf("queue %+v, tools %+v", config.Queue, config.Tools)
+	}
+	if config.Janitor.SessionTTL.Duration != 90*time.Minute || config.ASS.PreRoll.Duration != 1500*time.Millisecond {
+		t.Errorf("janitor.session_ttl = %s, ass.pre_roll = %s", config.Janitor.SessionTTL.Duration, config.ASS.PreRoll.Duration)
+	}
+
+	policies := config.StepPolicies()
+	// A step set in both keeps the file's retries and takes the environment's timeout
+	if policy := policies[function.StepAlignment]; policy.Timeout != 45*time.Minute || policy.Retries != 3 {
+		t.Errorf("alignment policy = %+v, want 45m and 3 retries", policy)
+	}
+	if policy, want := policies[function.StepSeparation], function.DefaultStepPolicies()[function.StepSeparation]; policy.Retries != 0 || policy.Timeout != want.Timeout {
+		t.Errorf("separation policy = %+v, want 0 retries and the default timeout", policy)
+	}
+	if policy := policies[function.StepCacheStore]; policy.Timeout != 30*time.Second {
+		t.Errorf("stem_cache_store policy = %+v, want a 30s timeout", policy)
+	}
+	if _, ok := config.Steps[function.StepPitchAnalysis]; ok {
+		t.Error("a step without overrides was added to steps")
+	}
+}
+
+func TestLoadEnvEmptySteps(t *testing.T) {
+	// "steps:" without entries decodes to a nil map, which the step overrides must not write to
+	path := writeConfig(t, "config.yaml", "steps:\n")
+	t.Setenv("KARAOKE_ALIGNMENT_RETRIES", "2")
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy := config.StepPolicies()[function.StepAlignment]; policy.Retries != 2 {
+		t.Errorf("alignment retries = %d, want 2", policy.Retries)
+	}
+}
+
+func TestLoadEnvInvalid(t *testing.T) {
+	t.Setenv("KARAOKE_WORKERS", "four")
+	t.Setenv("KARAOKE_SESSION_TTL", "tomorrow")
+	t.Setenv("KARAOKE_ALIGNMENT_RETRIES", "-")
+	_, err := Load("")
+	if err == nil {
+		t.Fatal("unparseable environment variables were accepted")
+	}
+	for _, name := range []string{"KARAOKE_WORKERS", "KARAOKE_SESSION_TTL", "KARAOKE_ALIGNMENT_RETRIES"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error doesn't mention %s:\n%v", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	negative := -1
+	config := Default()
+	config.Server.Addr = ""
+	config.Queue.Workers = 0
+	config.Queue.MaxQueued = 0
+	config.Ogg.Channels = 3
+	config.Resample.Quality = "best"
+	config.Cache.MaxMB = -1
+	config.Upload.MinAudioSeconds = 60
+	config.Upload.MaxAudioSeconds = 30
+	config.Progress.Store = "redis"
+	config.Janitor.TempTTL = Duration{-time.Minute}
+	config.Steps["separation"] = StepConfig{Retries: &negative}
+	config.Steps["mixing"] = StepConfig{}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("an invalid configuration was accepted")
+	}
+	// Every problem is reported at once, one per line
+	want := []string{
+		"server.addr",
+		"queue.workers",
+		"queue.max_queued",
+		"ogg: opus channels",
+		"resample.quality",
+		"cache.max_mb",
+		"upload.max_audio_seconds (30) must not be below upload.min_audio_seconds (60)",
+		"progress.store",
+		"janitor.temp_ttl",
+		"steps.separation.retries",
+		"steps.mixing is not a pipeline step",
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(want)+1 {
+		t.Errorf("got %d problems, want %d:\n%v", len(lines)-1, len(want), err)
+	}
+	for _, problem := range want {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error doesn't mention %q:\n%v", problem, err)
+		}
+	}
+
+	if err := Default().Validate(); err != nil {
+		t.Errorf("the defaults are invalid: %v", err)
+	}
+}
+
+func TestValidateCacheSteps(t *testing.T) {
+	// The cache steps are pipeline steps like the others
+	config := Default()
+	timeout := Duration{time.Minute}
+	config.Steps[function.StepCacheLookup] = StepConfig{Timeout: &timeout}
+	config.Steps[function.StepCacheStore] = StepConfig{Timeout: &timeout}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
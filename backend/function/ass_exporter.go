@@ -0,0 +1,238 @@
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ASSOptions controls the look and timing of the ASS karaoke subtitles
+type ASSOptions struct {
+	Font     string
+	FontSize int
+	// Colors are "#RRGGBB" or "#RRGGBBAA" with AA the opacity; sung words turn from
+	// UnsungColor to SungColor
+	SungColor    string
+	UnsungColor  string
+	OutlineColor string
+	ShadowColor  string
+	Outline      float64
+	Shadow       float64
+	// MarginV is the distance of the lowest line from the bottom of a 1920x1080 frame
+	MarginV int
+	// Lines is 1 to show one centered line at a time, or 2 to alternate a left and a right line
+	// so the next line is readable before it is sung
+	Lines int
+	// PreRoll shows each line this long before its first word is sung
+	PreRoll time.Duration
+	// Fill sweeps the color across each word (\kf) instead of switching it at once (\k)
+	Fill bool
+}
+
+// DefaultASSOptions are white lines filled in blue, in the classic two-line karaoke layout
+var DefaultASSOptions = ASSOptions{
+	Font:         "Arial",
+	FontSize:     72,
+	SungColor:    "#3399FF",
+	UnsungColor:  "#FFFFFF",
+	OutlineColor: "#000000",
+	ShadowColor:  "#00000080",
+	Outline:      3,
+	Shadow:       2,
+	MarginV:      80,
+	Lines:        2,
+	PreRoll:      2 * time.Second,
+	Fill:         true,
+}
+
+const (
+	assPlayResX = 1920
+	assPlayResY = 1080
+	// assMarginH keeps the alternating lines away from the frame edges
+	assMarginH = 120
+)
+
+// Validate reports an option the renderer can't use
+func (o ASSOptions) Validate() error {
+	var problems []string
+	if strings.TrimSpace(o.Font) == "" || strings.ContainsAny(o.Font, ",\n") {
+		problems = append(problems, fmt.Sprintf("font %q must be a non-empty name without commas", o.Font))
+	}
+	if o.FontSize < 8 || o.FontSize > 400 {
+		problems = append(problems, fmt.Sprintf("font size must be between 8 and 400, got %d", o.FontSize))
+	}
+	for _, color := range []struct{ name, value string }{
+		{"sung color", o.SungColor}, {"unsung color", o.UnsungColor},
+		{"outline color", o.OutlineColor}, {"shadow color", o.ShadowColor},
+	} {
+		if _, err := assColor(color.value); err != nil {
+			problems = append(problems, color.name+": "+err.Error())
+		}
+	}
+	if o.Outline < 0 || o.Shadow < 0 {
+		problems = append(problems, "outline and shadow must not be negative")
+	}
+	if o.MarginV < 0 || o.MarginV > assPlayResY/2 {
+		problems = append(problems, fmt.Sprintf("vertical margin must be between 0 and %d, got %d", assPlayResY/2, o.MarginV))
+	}
+	if o.Lines != 1 && o.Lines != 2 {
+		problems = append(problems, fmt.Sprintf("lines must be 1 or 2, got %d", o.Lines))
+	}
+	if o.PreRoll < 0 {
+		problems = append(problems, "pre-roll must not be negative")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// RenderASS renders lyrics as Advanced SubStation Alpha karaoke subtitles. Every segment is a
+// dialogue line whose words are timed with \k or \kf tags from their start and end times.
+func RenderASS(lyrics *LyricsJSON, metadata LyricsMetadata, options ASSOptions) ([]byte, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	title := metadata.Title
+	if metadata.Artist != "" {
+		title = metadata.Artist + " - " + title
+	}
+	buf.WriteString("[Script Info]\n")
+	fmt.Fprintf(&buf, "Title: %s\n", assText(title))
+	buf.WriteString("ScriptType: v4.00+\n")
+	// Karaoke lines must never be wrapped, a wrapped line loses its layout
+	buf.WriteString("WrapStyle: 2\n")
+	buf.WriteString("ScaledBorderAndShadow: yes\n")
+	buf.WriteString("YCbCr Matrix: TV.709\n")
+	fmt.Fprintf(&buf, "PlayResX: %d\nPlayResY: %d\n\n", assPlayResX, assPlayResY)
+
+	styles := assStyles(options)
+	buf.WriteString("[V4+ Styles]\n")
+	buf.WriteString("Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, " +
+		"Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, " +
+		"Alignment, MarginL, MarginR, MarginV, Encoding\n")
+	for _, style := range styles {
+		buf.WriteString(style.line(options))
+	}
+
+	buf.WriteString("\n[Events]\n")
+	buf.WriteString("Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+
+	offset := float64(metadata.OffsetMs) / 1000
+	preRoll := options.PreRoll.Seconds()
+	tag := `\k`
+	if options.Fill {
+		tag = `\kf`
+	}
+
+	// rowFree is when the previous line on each row leaves the screen
+	rowFree := make([]float64, len(styles))
+	for i, segment := range lyrics.Segments {
+		row := i % len(styles)
+		start := math.Max(segment.Start-offset, 0)
+		end := math.Max(segment.End-offset, start)
+		shown := math.Max(math.Max(start-preRoll, rowFree[row]), 0)
+		rowFree[row] = end
+
+		fmt.Fprintf(&buf, "Dialogue: 0,%s,%s,%s,,0,0,0,,%s\n",
+			assTime(shown), assTime(end), styles[row].name, assKaraoke(segment, shown, end, offset, tag))
+	}
+	return buf.Bytes(), nil
+}
+
+// assKaraoke builds the text of a dialogue line: a silent \k tag for the lead-in and every gap
+// between words, and a timed tag before every word. Tags are computed from times rounded to
+// centiseconds, so their sum never drifts from the word times.
+func assKaraoke(segment Segment, shown, end, offset float64, tag string) string {
+	if len(segment.Words) == 0 {
+		return assText(segment.Text)
+	}
+
+	var text strings.Builder
+	cursor := centiseconds(shown)
+	for _, word := range segment.Words {
+		wordStart := max(centiseconds(word.Start-offset), cursor)
+		wordEnd := max(centiseconds(word.End-offset), wordStart)
+		if gap := wordStart - cursor; gap > 0 {
+			fmt.Fprintf(&text, `{\k%d}`, gap)
+		}
+		fmt.Fprintf(&text, "{%s%d}%s", tag, wordEnd-wordStart, assText(word.Word))
+		cursor = wordEnd
+	}
+	if rest := centiseconds(end) - cursor; rest > 0 {
+		fmt.Fprintf(&text, `{\k%d}`, rest)
+	}
+	return text.String()
+}
+
+// assStyle is one row of the layout
+type assStyle struct {
+	name      string
+	alignment int
+	marginL   int
+	marginR   int
+	marginV   int
+}
+
+// assStyles returns one style per row, top row first. Two rows alternate a left aligned upper
+// line and a right aligned lower line.
+func assStyles(options ASSOptions) []assStyle {
+	if options.Lines == 1 {
+		return []assStyle{{name: "Karaoke", alignment: 2, marginL: assMarginH, marginR: assMarginH, marginV: options.MarginV}}
+	}
+	lineHeight := int(math.Round(float64(options.FontSize) * 1.4))
+	return []assStyle{
+		{name: "KaraokeUpper", alignment: 1, marginL: assMarginH, marginR: assMarginH, marginV: options.MarginV + lineHeight},
+		{name: "KaraokeLower", alignment: 3, marginL: assMarginH, marginR: assMarginH, marginV: options.MarginV},
+	}
+}
+
+func (s assStyle) line(options ASSOptions) string {
+	// Validate has checked the colors
+	sung, _ := assColor(options.SungColor)
+	unsung, _ := assColor(options.UnsungColor)
+	outline, _ := assColor(options.OutlineColor)
+	shadow, _ := assColor(options.ShadowColor)
+	return fmt.Sprintf("Style: %s,%s,%d,%s,%s,%s,%s,-1,0,0,0,100,100,0,0,1,%s,%s,%d,%d,%d,%d,1\n",
+		s.name, assText(options.Font), options.FontSize, sung, unsung, outline, shadow,
+		strconv.FormatFloat(options.Outline, 'f', -1, 64), strconv.FormatFloat(options.Shadow, 'f', -1, 64),
+		s.alignment, s.marginL, s.marginR, s.marginV)
+}
+
+// assColor converts "#RRGGBB" or "#RRGGBBAA" (AA the opacity) to the ASS "&HAABBGGRR" form,
+// whose alpha is a transparency
+func assColor(hex string) (string, error) {
+	value := strings.TrimPrefix(hex, "#")
+	if len(value) != 6 && len(value) != 8 || len(value) == len(hex) {
+		return "", fmt.Errorf("color %q must be #RRGGBB or #RRGGBBAA", hex)
+	}
+	rgba, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("color %q must be #RRGGBB or #RRGGBBAA", hex)
+	}
+	if len(value) == 6 {
+		rgba = rgba<<8 | 0xFF
+	}
+	r, g, b, a := rgba>>24, rgba>>16&0xFF, rgba>>8&0xFF, rgba&0xFF
+	return fmt.Sprintf("&H%02X%02X%02X%02X", 0xFF-a, b, g, r), nil
+}
+
+// assTime formats seconds as h:mm:ss.cc
+func assTime(seconds float64) string {
+	cs := centiseconds(seconds)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+func centiseconds(seconds float64) int {
+	return int(math.Round(math.Max(seconds, 0) * 100))
+}
+
+// assText keeps lyrics from being read as override tags or line breaks
+func assText(text string) string {
+	return strings.NewReplacer("{", "(", "}", ")", `\`, "/", "\n", " ", "\r", " ").Replace(text)
+}
@@ -0,0 +1,203 @@
+package function
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestASSTime(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "0:00:00.00"},
+		{-0.5, "0:00:00.00"},
+		{1.234, "0:00:01.23"},
+		{59.994, "0:00:59.99"},
+		{59.996, "0:01:00.00"},
+		{3599.996, "1:00:00.00"},
+		{4000.5, "1:06:40.50"},
+	}
+	for _, test := range tests {
+		if got := assTime(test.seconds); got != test.want {
+			t.Errorf("assTime(%v) = %q, want %q", test.seconds, got, test.want)
+		}
+	}
+}
+
+func TestASSColor(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want string
+	}{
+		{"#3399FF", "&H00FF9933"},
+		{"#ffffff", "&H00FFFFFF"},
+		// The alpha of the option is an opacity, the ASS alpha a transparency
+		{"#00000080", "&H7F000000"},
+		{"#112233FF", "&H00332211"},
+		{"#11223300", "&HFF332211"},
+		{"3399FF", ""},
+		{"#39F", ""},
+		{"#GG0000", ""},
+	}
+	for _, test := range tests {
+		got, err := assColor(test.hex)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("assColor(%q) = %q, want an error", test.hex, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("assColor(%q) = %q, %v, want %q", test.hex, got, err, test.want)
+		}
+	}
+}
+
+// assEvents returns the dialogue lines of an ASS file
+func assEvents(data []byte) []string {
+	var events []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Dialogue: ") {
+			events = append(events, line)
+		}
+	}
+	return events
+}
+
+func TestRenderASS(t *testing.T) {
+	oneLine := DefaultASSOptions
+	oneLine.Lines = 1
+	oneLine.Fill = false
+
+	tests := []struct {
+		name    string
+		options ASSOptions
+		styles  []string
+		events  []string
+	}{
+		{
+			name:    "two_lines",
+			options: DefaultASSOptions,
+			styles: []string{
+				"Style: KaraokeUpper,Arial,72,&H00FF9933,&H00FFFFFF,&H00000000,&H7F000000,-1,0,0,0,100,100,0,0,1,3,2,1,120,120,181,1",
+				"Style: KaraokeLower,Arial,72,&H00FF9933,&H00FFFFFF,&H00000000,&H7F000000,-1,0,0,0,100,100,0,0,1,3,2,3,120,120,80,1",
+			},
+			events: []string{
+				// The pre-roll of the first line can't start before zero
+				`Dialogue: 0,0:00:00.00,0:00:03.25,KaraokeUpper,,0,0,0,,{\k150}{\kf50}Hello{\k25}{\kf100} world`,
+				`Dialogue: 0,0:00:02.00,0:00:05.50,KaraokeLower,,0,0,0,,{\k200}{\kf50}Sing{\kf100} on`,
+				`Dialogue: 0,0:00:58.00,0:01:01.00,KaraokeUpper,,0,0,0,,{\k200}{\kf100}Again`,
+			},
+		},
+		{
+			name:    "one_line",
+			options: oneLine,
+			styles: []string{
+				"Style: Karaoke,Arial,72,&H00FF9933,&H00FFFFFF,&H00000000,&H7F000000,-1,0,0,0,100,100,0,0,1,3,2,2,120,120,80,1",
+			},
+			events: []string{
+				`Dialogue: 0,0:00:00.00,0:00:03.25,Karaoke,,0,0,0,,{\k150}{\k50}Hello{\k25}{\k100} world`,
+				// The pre-roll waits for the previous line on the row to leave the screen
+				`Dialogue: 0,0:00:03.25,0:00:05.50,Karaoke,,0,0,0,,{\k75}{\k50}Sing{\k100} on`,
+				`Dialogue: 0,0:00:58.00,0:01:01.00,Karaoke,,0,0,0,,{\k200}{\k100}Again`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := RenderASS(testLyrics(), LyricsMetadata{Title: "Song", Artist: "Band"}, test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), "[Script Info]\nTitle: Band - Song\nScriptType: v4.00+\n") {
+				t.Errorf("unexpected script info:\n%s", data)
+			}
+			for _, style := range test.styles {
+				if !strings.Contains(string(data), "\n"+style+"\n") {
+					t.Errorf("missing style line %q in:\n%s", style, data)
+				}
+			}
+			events := assEvents(data)
+			if strings.Join(events, "\n") != strings.Join(test.events, "\n") {
+				t.Errorf("got events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(test.events, "\n"))
+			}
+		})
+	}
+}
+
+var assKaraokeTag = regexp.MustCompile(`\{\\kf?(\d+)\}`)
+
+func TestRenderASSKaraokeSums(t *testing.T) {
+	// Times that don't fall on centiseconds, overlapping words and an offset
+	lyrics := &LyricsJSON{Segments: []Segment{
+		{Start: 0.333, End: 2.667, Words: []WordInfo{
+			{Word: "one", Start: 0.333, End: 0.667},
+			{Word: " two", Start: 0.666, End: 1.001},
+			{Word: " three", Start: 1.335, End: 2.667},
+		}},
+		{Start: 3.004, End: 4.996, Words: []WordInfo{
+			{Word: "four", Start: 3.004, End: 3.5049},
+			{Word: " five", Start: 3.4, End: 4.996},
+		}},
+		{Start: 7.125, End: 9.875, Words: []WordInfo{
+			{Word: "six", Start: 7.125, End: 9.875},
+		}},
+	}}
+	for _, offsetMs := range []int{0, 333, -1234} {
+		data, err := RenderASS(lyrics, LyricsMetadata{OffsetMs: offsetMs}, DefaultASSOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := assEvents(data)
+		if len(events) != len(lyrics.Segments) {
+			t.Fatalf("offset %d ms: got %d dialogue lines, want %d", offsetMs, len(events), len(lyrics.Segments))
+		}
+		for _, event := range events {
+			fields := strings.SplitN(strings.TrimPrefix(event, "Dialogue: "), ",", 10)
+			duration := assCentiseconds(t, fields[2]) - assCentiseconds(t, fields[1])
+			sum := 0
+			for _, match := range assKaraokeTag.FindAllStringSubmatch(fields[9], -1) {
+				cs, _ := strconv.Atoi(match[1])
+				sum += cs
+			}
+			// The tags fill the line exactly, so the last word ends when the line leaves the screen
+			if sum != duration {
+				t.Errorf("offset %d ms: \\k tags sum to %d cs on a %d cs line: %s", offsetMs, sum, duration, event)
+			}
+		}
+	}
+}
+
+// assCentiseconds parses an h:mm:ss.cc time
+func assCentiseconds(t *testing.T, value string) int {
+	t.Helper()
+	var h, m, s, cs int
+	if _, err := fmt.Sscanf(value, "%d:%02d:%02d.%02d", &h, &m, &s, &cs); err != nil {
+		t.Fatalf("bad ASS time %q: %v", value, err)
+	}
+	return ((h*60+m)*60+s)*100 + cs
+}
+
+func TestASSOptionsValidate(t *testing.T) {
+	options := DefaultASSOptions
+	options.Font = "Arial, Bold"
+	options.Lines = 3
+	options.SungColor = "blue"
+	err := options.Validate()
+	if err == nil {
+		t.Fatal("invalid options were accepted")
+	}
+	// Every problem is reported at once
+	for _, problem := range []string{"font", "lines", "sung color"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q doesn't mention the %s", err, problem)
+		}
+	}
+	if err := DefaultASSOptions.Validate(); err != nil {
+		t.Errorf("default options are invalid: %v", err)
+	}
+}
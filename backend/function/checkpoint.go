@@ -0,0 +1,148 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"karaoke_generator/audio"
+)
+
+// checkpointFile is the name of the checkpoint manifest inside a session workspace
+const checkpointFile = "checkpoint.json"
+
+// StepCheckpoint records a pipeline step that completed successfully
+type StepCheckpoint struct {
+	Name        string    `json:"name"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// Checkpoint is the manifest written in a session workspace after every completed step.
+// It keeps the job parameters so an interrupted or failed job can be resumed later.
+type Checkpoint struct {
+	SessionID      string           `json:"session_id"`
+	AudioFile      string           `json:"audio_file"`
+	LyricsFile     string           `json:"lyrics_file"`
+	Language       int              `json:"language"`
+	AudioHash      string           `json:"audio_hash"`
+	AudioSeconds   float64          `json:"audio_seconds"`
+	OutputProfiles []OutputProfile  `json:"output_profiles,omitempty"`
+	CompletedSteps []StepCheckpoint `json:"completed_steps"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+}
+
+// CheckpointPath is the location of the checkpoint manifest of the workspace
+func (w Workspace) CheckpointPath() string {
+	return filepath.Join(w.Root, checkpointFile)
+}
+
+// LoadCheckpoint reads the checkpoint manifest of a session workspace
+func LoadCheckpoint(ws Workspace) (*Checkpoint, error) {
+	data, err := os.ReadFile(ws.CheckpointPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint manifest: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// loadOrCreateCheckpoint returns the manifest of a job, creating it for a new job.
+// Hashing and probing the input stop early when ctx is cancelled.
+func loadOrCreateCheckpoint(ctx context.Context, config Config) (*Checkpoint, error) {
+	checkpoint, err := LoadCheckpoint(config.Workspace)
+	if err == nil {
+		return checkpoint, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// The hash is taken when the job starts, so a resumed job keeps its stem cache key
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	audioHash, err := hashFile(config.InputAudioFile)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing input audio: %w", err)
+	}
+
+	// The duration scales the ETA; without ffprobe the ETA just falls back to extrapolation
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var audioSeconds float64
+	if info, err := audio.Probe(ctx, config.Tools.FFprobePath, config.InputAudioFile); err == nil {
+		audioSeconds = info.Duration
+	} else {
+		fmt.Println("Could not probe input audio duration:", err)
+	}
+
+	checkpoint = &Checkpoint{
+		SessionID:      config.SessionID,
+		AudioFile:      config.InputAudioFile,
+		LyricsFile:     config.InputLyricsSrc,
+		Language:       config.language,
+		AudioHash:      audioHash,
+		AudioSeconds:   audioSeconds,
+		OutputProfiles: config.OutputProfiles,
+	}
+	return checkpoint, checkpoint.save(config.Workspace)
+}
+
+// IsCompleted reports whether a step already completed in a previous run
+func (c *Checkpoint) IsCompleted(step string) bool {
+	for _, s := range c.CompletedSteps {
+		if s.Name == step {
+			return true
+		}
+	}
+	return false
+}
+
+// markCompleted records a completed step and persists the manifest
+func (c *Checkpoint) markCompleted(ws Workspace, step string) error {
+	if !c.IsCompleted(step) {
+		c.CompletedSteps = append(c.CompletedSteps, StepCheckpoint{Name: step, CompletedAt: time.Now()})
+	}
+	return c.save(ws)
+}
+
+// forget drops the checkpoints of the given steps so they run again
+func (c *Checkpoint) forget(steps ...string) {
+	drop := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		drop[step] = true
+	}
+	kept := c.CompletedSteps[:0]
+	for _, s := range c.CompletedSteps {
+		if !drop[s.Name] {
+			kept = append(kept, s)
+		}
+	}
+	c.CompletedSteps = kept
+}
+
+// save writes the manifest atomically so a crash never leaves a truncated file
+func (c *Checkpoint) save(ws Workspace) error {
+	c.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error marshaling checkpoint manifest: %w", err)
+	}
+
+	tmpPath := ws.CheckpointPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("error writing checkpoint manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, ws.CheckpointPath()); err != nil {
+		return fmt.Errorf("error writing checkpoint manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stderrTailSize is how many trailing bytes of a tool's stderr are kept for error reports
+const stderrTailSize = 4096
+
+// CommandError is returned when an external tool exits with an error
+type CommandError struct {
+	Command    string
+	StderrTail string
+	Err        error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Command, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer is an io.Writer that only remembers the last max bytes written to it
+type tailBuffer struct {
+	max  int
+	data []byte
+	mu   sync.Mutex
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data = append(t.data, p...)
+	if len(t.data) > t.max {
+		t.data = t.data[len(t.data)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSpace(string(t.data))
+}
+
+// commandWaitDelay bounds how long a killed tool may keep its output pipes open
+const commandWaitDelay = 5 * time.Second
+
+// newCommand prepares an external tool that is killed together with its
+// children as soon as ctx is cancelled
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	configureProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+// runCommand runs an external tool, streaming its output to the console by default
+// while keeping the tail of stderr so a failure can be reported to the user
+func runCommand(cmd *exec.Cmd) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	tail := &tailBuffer{max: stderrTailSize}
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, tail)
+
+	if err := cmd.Run(); err != nil {
+		return &CommandError{
+			Command:    filepath.Base(cmd.Path),
+			StderrTail: tail.String(),
+			Err:        err,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// Tools locates the external programs and conda environments the pipeline runs.
+// It is passed into every job through Config so nothing is hard-coded in the steps.
+type Tools struct {
+	// CondaPath is the conda executable; empty means look it up on PATH
+	CondaPath string
+	// DemucsEnv is the conda environment Demucs is installed in
+	DemucsEnv string
+	// MFAEnv is the conda environment the Montreal Forced Aligner is installed in
+	MFAEnv string
+	// PythonPath is the interpreter that runs the pitch analyzer
+	PythonPath string
+	// PitchAnalyzerScript is the vocal pitch analyzer script
+	PitchAnalyzerScript string
+	// FFmpegPath is the ffmpeg executable
+	FFmpegPath string
+	// FFprobePath is the ffprobe executable used to inspect audio files
+	FFprobePath string
+}
+
+// DefaultTools returns the tool locations used when the configuration doesn't override them
+func DefaultTools() Tools {
+	return Tools{
+		DemucsEnv:           "demucs_env",
+		MFAEnv:              "mfa",
+		PythonPath:          "python",
+		PitchAnalyzerScript: "./function/vocal_pitch_analyzer.py",
+		FFmpegPath:          "ffmpeg",
+		FFprobePath:         "ffprobe",
+	}
+}
+
+// FindConda returns the conda executable: the configured one if set, otherwise the one on PATH
+func (t Tools) FindConda() (string, error) {
+	if t.CondaPath != "" {
+		path, err := exec.LookPath(t.CondaPath)
+		if err != nil {
+			return "", fmt.Errorf("configured conda executable %s not found: %w", t.CondaPath, err)
+		}
+		return path, nil
+	}
+	path, err := exec.LookPath("conda")
+	if err != nil {
+		return "", fmt.Errorf("conda executable not found on PATH, set tools.conda or KARAOKE_CONDA_PATH: %w", err)
+	}
+	return path, nil
+}
+
+// condaCommand prepares a tool that runs inside a conda environment. Arguments are passed as
+// an argument vector, never through a shell, so file names can't inject commands.
+func (t Tools) condaCommand(ctx context.Context, env, name string, args ...string) (*exec.Cmd, error) {
+	conda, err := t.FindConda()
+	if err != nil {
+		return nil, err
+	}
+	condaArgs := append([]string{"run", "-n", env, "--no-capture-output", name}, args...)
+	return newCommand(ctx, conda, condaArgs...), nil
+}
@@ -0,0 +1,60 @@
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// lrcClearGap is how long a line may stay on screen after it ends; past that an empty
+// line clears the display until the next line starts
+const lrcClearGap = 5.0
+
+// RenderLRC renders lyrics as LRC, one [mm:ss.xx] line per segment. Enhanced LRC also
+// tags every word with its start time, <mm:ss.xx>, and closes the line with its end time.
+func RenderLRC(lyrics *LyricsJSON, metadata LyricsMetadata, enhanced bool) []byte {
+	var buf bytes.Buffer
+	if metadata.Title != "" {
+		fmt.Fprintf(&buf, "[ti:%s]\n", lrcTagValue(metadata.Title))
+	}
+	if metadata.Artist != "" {
+		fmt.Fprintf(&buf, "[ar:%s]\n", lrcTagValue(metadata.Artist))
+	}
+	if metadata.Length > 0 {
+		seconds := int(math.Round(metadata.Length))
+		fmt.Fprintf(&buf, "[length:%02d:%02d]\n", seconds/60, seconds%60)
+	}
+	fmt.Fprintf(&buf, "[offset:%+d]\n", metadata.OffsetMs)
+	buf.WriteString("[re:karaoke_generator]\n")
+
+	for i, segment := range lyrics.Segments {
+		buf.WriteString("[" + lrcTime(segment.Start) + "]")
+		if enhanced && len(segment.Words) > 0 {
+			for _, word := range segment.Words {
+				buf.WriteString("<" + lrcTime(word.Start) + ">" + strings.TrimSpace(word.Word) + " ")
+			}
+			buf.WriteString("<" + lrcTime(segment.End) + ">")
+		} else {
+			buf.WriteString(segment.Text)
+		}
+		buf.WriteByte('\n')
+
+		// Clear the last line, and any line followed by a long instrumental break
+		if i == len(lyrics.Segments)-1 || lyrics.Segments[i+1].Start-segment.End > lrcClearGap {
+			buf.WriteString("[" + lrcTime(segment.End) + "]\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// lrcTime formats seconds as mm:ss.xx
+func lrcTime(seconds float64) string {
+	centiseconds := int(math.Round(math.Max(seconds, 0) * 100))
+	return fmt.Sprintf("%02d:%02d.%02d", centiseconds/6000, centiseconds/100%60, centiseconds%100)
+}
+
+// lrcTagValue keeps an ID tag on one line and inside its brackets
+func lrcTagValue(value string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ", "[", "(", "]", ")").Replace(value)
+}
@@ -0,0 +1,114 @@
+package function
+
+import "testing"
+
+// midiNote returns a pointer to a word's MIDI note
+func midiNote(note int) *int {
+	return &note
+}
+
+// testLyrics are two lines the way the TextGrid converter writes them, every word after the
+// first with a leading space, followed by an instrumental break and a line without pitch
+func testLyrics() *LyricsJSON {
+	return &LyricsJSON{Segments: []Segment{
+		{Start: 1.5, End: 3.25, Text: "Hello world", Words: []WordInfo{
+			{Word: "Hello", Start: 1.5, End: 2, Note: midiNote(60)},
+			{Word: " world", Start: 2.25, End: 3.25, Note: midiNote(62)},
+		}},
+		{Start: 4, End: 5.5, Text: "Sing on", Words: []WordInfo{
+			{Word: "Sing", Start: 4, End: 4.5, Note: midiNote(64)},
+			{Word: " on", Start: 4.5, End: 5.5, Note: midiNote(-1)},
+		}},
+		{Start: 59.996, End: 61.004, Text: "Again", Words: []WordInfo{
+			{Word: "Again", Start: 59.996, End: 61.004},
+		}},
+	}}
+}
+
+func TestLRCTime(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "00:00.00"},
+		{-1, "00:00.00"},
+		{1.234, "00:01.23"},
+		{1.236, "00:01.24"},
+		{59.994, "00:59.99"},
+		// Rounding up to the next centisecond carries into the minutes
+		{59.996, "01:00.00"},
+		{119.999, "02:00.00"},
+		{754.5, "12:34.50"},
+		// LRC has no hours, the minutes keep counting
+		{3600, "60:00.00"},
+	}
+	for _, test := range tests {
+		if got := lrcTime(test.seconds); got != test.want {
+			t.Errorf("lrcTime(%v) = %q, want %q", test.seconds, got, test.want)
+		}
+	}
+}
+
+func TestRenderLRC(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata LyricsMetadata
+		enhanced bool
+		want     string
+	}{
+		{
+			name:     "lines",
+			metadata: LyricsMetadata{Title: "Song", Artist: "Band", Length: 125.4},
+			want: "[ti:Song]\n" +
+				"[ar:Band]\n" +
+				"[length:02:05]\n" +
+				"[offset:+0]\n" +
+				"[re:karaoke_generator]\n" +
+				"[00:01.50]Hello world\n" +
+				"[00:04.00]Sing on\n" +
+				// More than lrcClearGap before the next line, so it is cleared
+				"[00:05.50]\n" +
+				"[01:00.00]Again\n" +
+				"[01:01.00]\n",
+		},
+		{
+			name:     "enhanced",
+			metadata: LyricsMetadata{OffsetMs: -250},
+			enhanced: true,
+			want: "[offset:-250]\n" +
+				"[re:karaoke_generator]\n" +
+				"[00:01.50]<00:01.50>Hello <00:02.25>world <00:03.25>\n" +
+				"[00:04.00]<00:04.00>Sing <00:04.50>on <00:05.50>\n" +
+				"[00:05.50]\n" +
+				"[01:00.00]<01:00.00>Again <01:01.00>\n" +
+				"[01:01.00]\n",
+		},
+		{
+			name:     "tags",
+			metadata: LyricsMetadata{Title: "Live [2024]\nencore", Artist: "A]B", OffsetMs: 120},
+			want: "[ti:Live (2024) encore]\n" +
+				"[ar:A)B]\n" +
+				"[offset:+120]\n" +
+				"[re:karaoke_generator]\n" +
+				"[00:01.50]Hello world\n" +
+				"[00:04.00]Sing on\n" +
+				"[00:05.50]\n" +
+				"[01:00.00]Again\n" +
+				"[01:01.00]\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(RenderLRC(testLyrics(), test.metadata, test.enhanced)); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderLRCEmpty(t *testing.T) {
+	want := "[offset:+0]\n[re:karaoke_generator]\n"
+	if got := string(RenderLRC(&LyricsJSON{}, LyricsMetadata{}, true)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
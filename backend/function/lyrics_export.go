@@ -0,0 +1,196 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FinalLyricsFile is the aligned lyrics with pitch notes in the final result directory
+const FinalLyricsFile = "timestamp_with_notes.json"
+
+// LyricsMetadata describes the song in the headers of the exported lyrics
+type LyricsMetadata struct {
+	Title  string
+	Artist string
+	// Length of the song in seconds
+	Length float64
+	// OffsetMs shifts the lyrics in formats that carry an offset, positive meaning earlier
+	OffsetMs int
+}
+
+// LyricsExporter renders the aligned lyrics of a session in a file format players understand
+type LyricsExporter struct {
+	// Format names the export in the download URL, e.g. "lrc"
+	Format string
+	// Filename of the export in the final result directory
+	Filename    string
+	ContentType string
+	Render      func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error)
+}
+
+// LyricsExportOptions are the settings of the formats that have any
+type LyricsExportOptions struct {
+	ASS ASSOptions
+}
+
+// lyricsExporters are written into every session package, in this order
+var lyricsExporters = []LyricsExporter{
+	{
+		Format:      "lrc",
+		Filename:    "lyrics.lrc",
+		ContentType: "text/plain; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderLRC(lyrics, metadata, false), nil
+		},
+	},
+	{
+		Format:      "elrc",
+		Filename:    "lyrics_enhanced.lrc",
+		ContentType: "text/plain; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderLRC(lyrics, metadata, true), nil
+		},
+	},
+	{
+		Format:      "ass",
+		Filename:    "lyrics.ass",
+		ContentType: "text/x-ssa; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderASS(lyrics, metadata, options.ASS)
+		},
+	},
+	{
+		Format:      "srt",
+		Filename:    "lyrics.srt",
+		ContentType: "application/x-subrip; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderSRT(lyrics, metadata), nil
+		},
+	},
+	{
+		Format:      "vtt",
+		Filename:    "lyrics.vtt",
+		ContentType: "text/vtt; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderWebVTT(lyrics, metadata, false), nil
+		},
+	},
+	{
+		Format:      "vtt-words",
+		Filename:    "lyrics_words.vtt",
+		ContentType: "text/vtt; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderWebVTT(lyrics, metadata, true), nil
+		},
+	},
+	{
+		Format:      "ultrastar",
+		Filename:    "ultrastar.txt",
+		ContentType: "text/plain; charset=utf-8",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderUltraStar(lyrics, metadata), nil
+		},
+	},
+	{
+		Format:      "midi",
+		Filename:    "melody.mid",
+		ContentType: "audio/midi",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderMIDI(lyrics, metadata, false), nil
+		},
+	},
+	{
+		Format:      "kar",
+		Filename:    "karaoke.kar",
+		ContentType: "audio/midi",
+		Render: func(lyrics *LyricsJSON, metadata LyricsMetadata, options LyricsExportOptions) ([]byte, error) {
+			return RenderMIDI(lyrics, metadata, true), nil
+		},
+	},
+}
+
+// LyricsExporterFor returns the exporter of a format
+func LyricsExporterFor(format string) (LyricsExporter, bool) {
+	for _, exporter := range lyricsExporters {
+		if exporter.Format == format {
+			return exporter, true
+		}
+	}
+	return LyricsExporter{}, false
+}
+
+// LyricsFormats lists the formats the lyrics can be exported to
+func LyricsFormats() []string {
+	formats := make([]string, 0, len(lyricsExporters))
+	for _, exporter := range lyricsExporters {
+		formats = append(formats, exporter.Format)
+	}
+	return formats
+}
+
+// LoadSessionLyrics reads the final aligned lyrics of a session workspace
+func LoadSessionLyrics(ws Workspace) (*LyricsJSON, error) {
+	return loadLyrics(filepath.Join(ws.FinalResultDir(), FinalLyricsFile))
+}
+
+func loadLyrics(path string) (*LyricsJSON, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lyrics LyricsJSON
+	if err := json.Unmarshal(data, &lyrics); err != nil {
+		return nil, fmt.Errorf("error parsing lyrics JSON: %w", err)
+	}
+	return &lyrics, nil
+}
+
+// SessionLyricsMetadata builds the metadata of a session's exports from what was uploaded.
+// The title falls back to the uploaded file name and the length to the end of the last line.
+func SessionLyricsMetadata(ws Workspace, lyrics *LyricsJSON) LyricsMetadata {
+	var metadata LyricsMetadata
+	if upload, err := LoadUploadMetadata(ws); err == nil {
+		metadata.Title = upload.Title
+		metadata.Artist = upload.Artist
+		if metadata.Title == "" {
+			metadata.Title = strings.TrimSuffix(upload.OriginalFilename, filepath.Ext(upload.OriginalFilename))
+		}
+	}
+	if checkpoint, err := LoadCheckpoint(ws); err == nil {
+		metadata.Length = checkpoint.AudioSeconds
+	}
+	if metadata.Length == 0 && len(lyrics.Segments) > 0 {
+		metadata.Length = lyrics.Segments[len(lyrics.Segments)-1].End
+	}
+	return metadata
+}
+
+// exportLyrics writes every lyrics export into the final result directory, so they are part
+// of the downloaded package
+func exportLyrics(ctx context.Context, config Config) error {
+	finalDir := config.Workspace.FinalResultDir()
+	lyrics, err := loadLyrics(filepath.Join(finalDir, FinalLyricsFile))
+	if err != nil {
+		return fmt.Errorf("error reading aligned lyrics: %w", err)
+	}
+	metadata := SessionLyricsMetadata(config.Workspace, lyrics)
+	options := LyricsExportOptions{ASS: config.ASS}
+
+	for _, exporter := range lyricsExporters {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := exporter.Render(lyrics, metadata, options)
+		if err != nil {
+			return fmt.Errorf("error exporting %s: %w", exporter.Format, err)
+		}
+		if err := os.WriteFile(filepath.Join(finalDir, exporter.Filename), data, 0644); err != nil {
+			return fmt.Errorf("error writing %s: %w", exporter.Filename, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// midiTicksPerQuarter and midiTempo (µs per quarter note, 120 BPM) give 960 ticks per second
+	midiTicksPerQuarter = 480
+	midiTempo           = 500000
+	// midiProgram is General MIDI "Voice Oohs", a sung melody on every synth
+	midiProgram  = 53
+	midiVelocity = 100
+)
+
+// MIDI meta event types
+const (
+	midiMetaText          = 0x01
+	midiMetaTrackName     = 0x03
+	midiMetaLyric         = 0x05
+	midiMetaEndOfTrack    = 0x2F
+	midiMetaTempo         = 0x51
+	midiMetaTimeSignature = 0x58
+)
+
+// midiEvent is an event at an absolute tick; order breaks ties so a note ends before the next
+// one starts and a lyric comes right before the note it is sung on
+type midiEvent struct {
+	tick  int
+	order int
+	data  []byte
+}
+
+const (
+	midiOrderNoteOff = iota
+	midiOrderMeta
+	midiOrderNoteOn
+)
+
+// midiTrack collects the events of one track
+type midiTrack struct {
+	events []midiEvent
+}
+
+func (t *midiTrack) meta(tick, kind int, data []byte) {
+	event := append([]byte{0xFF, byte(kind)}, midiVarLen(len(data))...)
+	t.events = append(t.events, midiEvent{tick: tick, order: midiOrderMeta, data: append(event, data...)})
+}
+
+func (t *midiTrack) note(start, end, note int) {
+	t.events = append(t.events,
+		midiEvent{tick: start, order: midiOrderNoteOn, data: []byte{0x90, byte(note), midiVelocity}},
+		midiEvent{tick: end, order: midiOrderNoteOff, data: []byte{0x80, byte(note), 0}},
+	)
+}
+
+// bytes encodes the track chunk, sorting the events and closing the track after the last one
+func (t *midiTrack) bytes() []byte {
+	sort.SliceStable(t.events, func(i, j int) bool {
+		if t.events[i].tick != t.events[j].tick {
+			return t.events[i].tick < t.events[j].tick
+		}
+		return t.events[i].order < t.events[j].order
+	})
+
+	var body []byte
+	last := 0
+	for _, event := range t.events {
+		body = append(body, midiVarLen(event.tick-last)...)
+		body = append(body, event.data...)
+		last = event.tick
+	}
+	body = append(body, 0x00, 0xFF, midiMetaEndOfTrack, 0x00)
+
+	chunk := append([]byte("MTrk"), binary.BigEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(chunk, body...)
+}
+
+// RenderMIDI renders the word notes as a Type-1 standard MIDI file: a conductor track with the
+// tempo, and a melody track with a note from the start to the end of every pitched word and a
+// lyric event carrying every word. The karaoke variant is a Soft Karaoke .kar file, which
+// carries the words as text events in a separate "Words" track instead.
+func RenderMIDI(lyrics *LyricsJSON, metadata LyricsMetadata, karaoke bool) []byte {
+	offset := float64(metadata.OffsetMs) / 1000
+	ticksPerSecond := float64(midiTicksPerQuarter) * 1e6 / midiTempo
+	tick := func(seconds float64) int {
+		return int(math.Round(math.Max(seconds-offset, 0) * ticksPerSecond))
+	}
+
+	conductor := &midiTrack{}
+	if karaoke {
+		conductor.meta(0, midiMetaText, []byte("@KMIDI KARAOKE FILE"))
+		conductor.meta(0, midiMetaText, []byte("@V0100"))
+	}
+	if title := singleLine(metadata.Title); title != "" {
+		conductor.meta(0, midiMetaTrackName, []byte(title))
+	}
+	conductor.meta(0, midiMetaTimeSignature, []byte{4, 2, 24, 8})
+	conductor.meta(0, midiMetaTempo, []byte{midiTempo >> 16, midiTempo >> 8 & 0xFF, midiTempo & 0xFF})
+
+	melody := &midiTrack{}
+	melody.meta(0, midiMetaTrackName, []byte("Melody"))
+	melody.events = append(melody.events, midiEvent{order: midiOrderMeta, data: []byte{0xC0, midiProgram}})
+
+	words := &midiTrack{}
+	if karaoke {
+		words.meta(0, midiMetaTrackName, []byte("Words"))
+		words.meta(0, midiMetaText, []byte("@LENGL"))
+		for _, header := range []string{metadata.Title, metadata.Artist} {
+			if header = singleLine(header); header != "" {
+				words.meta(0, midiMetaText, []byte("@T"+header))
+			}
+		}
+	}
+
+	// Notes of the same pitch must not overlap, or the earlier note-off cuts the later note
+	noteEnd := make(map[int]int)
+	for s, segment := range lyrics.Segments {
+		for i, word := range segment.Words {
+			start := tick(word.Start)
+			end := max(tick(word.End), start+1)
+			if i+1 < len(segment.Words) {
+				if next := tick(segment.Words[i+1].Start); next > start && end > next {
+					end = next
+				}
+			}
+
+			text := strings.NewReplacer("\n", " ", "\r", " ").Replace(word.Word)
+			if karaoke {
+				// Soft Karaoke starts a new line with "/" and a new paragraph with "\"
+				if i == 0 && s > 0 {
+					text = "/" + strings.TrimLeft(text, " ")
+				}
+				words.meta(start, midiMetaText, []byte(text))
+			} else {
+				// RP-026 ends a line of lyrics with a carriage return
+				if i == len(segment.Words)-1 {
+					text += "\r"
+				}
+				melody.meta(start, midiMetaLyric, []byte(text))
+			}
+
+			if note, ok := word.Pitch(); ok && start >= noteEnd[note] {
+				melody.note(start, end, note)
+				noteEnd[note] = end
+			}
+		}
+	}
+
+	tracks := []*midiTrack{conductor, melody}
+	if karaoke {
+		tracks = []*midiTrack{conductor, words, melody}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	header := binary.BigEndian.AppendUint32(nil, 6)
+	header = binary.BigEndian.AppendUint16(header, 1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(tracks)))
+	header = binary.BigEndian.AppendUint16(header, midiTicksPerQuarter)
+	buf.Write(header)
+	for _, track := range tracks {
+		buf.Write(track.bytes())
+	}
+	return buf.Bytes()
+}
+
+// midiVarLen encodes a MIDI variable-length quantity
+func midiVarLen(value int) []byte {
+	out := []byte{byte(value & 0x7F)}
+	for value >>= 7; value > 0; value >>= 7 {
+		out = append([]byte{byte(value&0x7F) | 0x80}, out...)
+	}
+	return out
+}
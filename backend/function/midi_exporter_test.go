@@ -0,0 +1,243 @@
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestMIDIVarLen(t *testing.T) {
+	tests := []struct {
+		value int
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{0x40, []byte{0x40}},
+		{0x7F, []byte{0x7F}},
+		{0x80, []byte{0x81, 0x00}},
+		{0x2000, []byte{0xC0, 0x00}},
+		{0x3FFF, []byte{0xFF, 0x7F}},
+		{0x4000, []byte{0x81, 0x80, 0x00}},
+		{0x1FFFFF, []byte{0xFF, 0xFF, 0x7F}},
+		{0x200000, []byte{0x81, 0x80, 0x80, 0x00}},
+		{0x0FFFFFFF, []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+	}
+	for _, test := range tests {
+		if got := midiVarLen(test.value); !bytes.Equal(got, test.want) {
+			t.Errorf("midiVarLen(%#x) = % x, want % x", test.value, got, test.want)
+		}
+	}
+}
+
+// testMIDIEvent is a parsed event; kind is "meta", "on", "off" or "program"
+type testMIDIEvent struct {
+	tick int
+	kind string
+	// meta is the meta event type
+	meta byte
+	data []byte
+}
+
+func (e testMIDIEvent) String() string {
+	if e.kind == "meta" {
+		return fmt.Sprintf("%d meta %#02x %q", e.tick, e.meta, e.data)
+	}
+	return fmt.Sprintf("%d %s % x", e.tick, e.kind, e.data)
+}
+
+// parseMIDI checks the chunk structure of a standard MIDI file and returns its events by track
+func parseMIDI(t *testing.T, data []byte) (format, division int, tracks [][]testMIDIEvent) {
+	t.Helper()
+	if len(data) < 14 || string(data[:4]) != "MThd" || binary.BigEndian.Uint32(data[4:8]) != 6 {
+		t.Fatalf("bad header chunk % x", data[:min(len(data), 14)])
+	}
+	format = int(binary.BigEndian.Uint16(data[8:10]))
+	count := int(binary.BigEndian.Uint16(data[10:12]))
+	division = int(binary.BigEndian.Uint16(data[12:14]))
+
+	rest := data[14:]
+	for len(rest) > 0 {
+		if len(rest) < 8 || string(rest[:4]) != "MTrk" {
+			t.Fatalf("track %d: bad chunk header", len(tracks))
+		}
+		size := int(binary.BigEndian.Uint32(rest[4:8]))
+		if len(rest) < 8+size {
+			t.Fatalf("track %d: chunk length %d runs past the end of the file", len(tracks), size)
+		}
+		tracks = append(tracks, parseMIDITrack(t, rest[8:8+size]))
+		rest = rest[8+size:]
+	}
+	if len(tracks) != count {
+		t.Fatalf("header announces %d tracks, file has %d", count, len(tracks))
+	}
+	return format, division, tracks
+}
+
+// parseMIDITrack reads the events of a track body, which must end with the end of track event
+func parseMIDITrack(t *testing.T, body []byte) []testMIDIEvent {
+	t.Helper()
+	varLen := func() int {
+		value := 0
+		for {
+			b := body[0]
+			body = body[1:]
+			value = value<<7 | int(b&0x7F)
+			if b&0x80 == 0 {
+				return value
+			}
+		}
+	}
+
+	var events []testMIDIEvent
+	tick := 0
+	for len(body) > 0 {
+		tick += varLen()
+		status := body[0]
+		body = body[1:]
+		event := testMIDIEvent{tick: tick}
+		switch status & 0xF0 {
+		case 0xF0:
+			event.kind, event.meta = "meta", body[0]
+			body = body[1:]
+			size := varLen()
+			event.data, body = body[:size], body[size:]
+		case 0x90, 0x80:
+			event.kind = map[byte]string{0x90: "on", 0x80: "off"}[status&0xF0]
+			event.data, body = body[:2], body[2:]
+		case 0xC0:
+			event.kind = "program"
+			event.data, body = body[:1], body[1:]
+		default:
+			t.Fatalf("unexpected status byte %#02x", status)
+		}
+		events = append(events, event)
+	}
+	if last := events[len(events)-1]; last.kind != "meta" || last.meta != midiMetaEndOfTrack || len(last.data) != 0 {
+		t.Fatalf("track ends with %v instead of the end of track event", last)
+	}
+	return events[:len(events)-1]
+}
+
+// filterMIDI keeps the events of a kind, and of a meta event type for meta events
+func filterMIDI(events []testMIDIEvent, kind string, meta byte) []string {
+	var kept []string
+	for _, event := range events {
+		if event.kind == kind && (kind != "meta" || event.meta == meta) {
+			kept = append(kept, event.String())
+		}
+	}
+	return kept
+}
+
+func TestRenderMIDI(t *testing.T) {
+	// 960 ticks per second: Hello at 1.5 s is tick 1440
+	notes := []string{
+		"1440 on 3c 64", "1920 off 3c 00",
+		"2160 on 3e 64", "3120 off 3e 00",
+		"3840 on 40 64", "4320 off 40 00",
+	}
+
+	t.Run("midi", func(t *testing.T) {
+		format, division, tracks := parseMIDI(t, RenderMIDI(testLyrics(), LyricsMetadata{Title: "Song"}, false))
+		if format != 1 || division != midiTicksPerQuarter || len(tracks) != 2 {
+			t.Fatalf("format %d, division %d, %d tracks; want format 1, division 480, 2 tracks", format, division, len(tracks))
+		}
+		conductor, melody := tracks[0], tracks[1]
+
+		if got := filterMIDI(conductor, "meta", midiMetaTrackName); !slices.Equal(got, []string{`0 meta 0x03 "Song"`}) {
+			t.Errorf("conductor track name %q", got)
+		}
+		// 500000 µs per quarter note, 120 BPM
+		if got := filterMIDI(conductor, "meta", midiMetaTempo); !slices.Equal(got, []string{`0 meta 0x51 "\a\xa1 "`}) {
+			t.Errorf("tempo %q", got)
+		}
+		if got := filterMIDI(conductor, "meta", midiMetaTimeSignature); !slices.Equal(got, []string{`0 meta 0x58 "\x04\x02\x18\b"`}) {
+			t.Errorf("time signature %q", got)
+		}
+		if got := filterMIDI(melody, "program", 0); !slices.Equal(got, []string{"0 program 35"}) {
+			t.Errorf("program changes %q", got)
+		}
+
+		var got []string
+		for _, event := range melody {
+			if event.kind == "on" || event.kind == "off" {
+				got = append(got, event.String())
+			}
+		}
+		if !slices.Equal(got, notes) {
+			t.Errorf("got notes %q, want %q", got, notes)
+		}
+
+		// Lyric events end every line with a carriage return, words without a pitch still have one
+		lyrics := []string{
+			`1440 meta 0x05 "Hello"`,
+			`2160 meta 0x05 " world\r"`,
+			`3840 meta 0x05 "Sing"`,
+			`4320 meta 0x05 " on\r"`,
+			`57596 meta 0x05 "Again\r"`,
+		}
+		if got := filterMIDI(melody, "meta", midiMetaLyric); !slices.Equal(got, lyrics) {
+			t.Errorf("got lyrics %q, want %q", got, lyrics)
+		}
+	})
+
+	t.Run("kar", func(t *testing.T) {
+		_, _, tracks := parseMIDI(t, RenderMIDI(testLyrics(), LyricsMetadata{Title: "Song", Artist: "Band"}, true))
+		if len(tracks) != 3 {
+			t.Fatalf("got %d tracks, want 3", len(tracks))
+		}
+		conductor, words, melody := tracks[0], tracks[1], tracks[2]
+
+		// Players recognize a Soft Karaoke file by its first text events
+		want := []string{`0 meta 0x01 "@KMIDI KARAOKE FILE"`, `0 meta 0x01 "@V0100"`}
+		if got := filterMIDI(conductor, "meta", midiMetaText); !slices.Equal(got, want) {
+			t.Errorf("conductor text events %q, want %q", got, want)
+		}
+
+		want = []string{
+			`0 meta 0x01 "@LENGL"`,
+			`0 meta 0x01 "@TSong"`,
+			`0 meta 0x01 "@TBand"`,
+			`1440 meta 0x01 "Hello"`,
+			`2160 meta 0x01 " world"`,
+			`3840 meta 0x01 "/Sing"`,
+			`4320 meta 0x01 " on"`,
+			`57596 meta 0x01 "/Again"`,
+		}
+		if got := filterMIDI(words, "meta", midiMetaText); !slices.Equal(got, want) {
+			t.Errorf("words track text events:\n%q\nwant:\n%q", got, want)
+		}
+		if got := filterMIDI(words, "meta", midiMetaTrackName); !slices.Equal(got, []string{`0 meta 0x03 "Words"`}) {
+			t.Errorf("words track name %q", got)
+		}
+		if got := filterMIDI(melody, "meta", midiMetaLyric); len(got) != 0 {
+			t.Errorf("karaoke melody track has lyric events %q", got)
+		}
+	})
+
+	t.Run("overlap", func(t *testing.T) {
+		lyrics := &LyricsJSON{Segments: []Segment{
+			{Words: []WordInfo{
+				{Word: "a", Start: 0, End: 1, Note: midiNote(60)},
+				// Starts before the previous word ends, which is cut short
+				{Word: " b", Start: 0.5, End: 1.5, Note: midiNote(62)},
+				// The same pitch as a note still sounding would be cut by its note off
+				{Word: " c", Start: 0.5, End: 2, Note: midiNote(62)},
+			}},
+		}}
+		_, _, tracks := parseMIDI(t, RenderMIDI(lyrics, LyricsMetadata{}, false))
+		var got []string
+		for _, event := range tracks[1] {
+			if event.kind == "on" || event.kind == "off" {
+				got = append(got, event.String())
+			}
+		}
+		// A note ends before the next one starts on the same tick
+		want := []string{"0 on 3c 64", "480 off 3c 00", "480 on 3e 64", "1440 off 3e 00"}
+		if !slices.Equal(got, want) {
+			t.Errorf("got notes %q, want %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"karaoke_generator/audio"
+)
+
+// MaxOutputProfiles bounds how many extra encodings a single job may request
+const MaxOutputProfiles = 8
+
+// OutputProfile is an extra encoding of the vocal and instrumental stems delivered with the
+// session, next to the default OGG files
+type OutputProfile struct {
+	// Name appears in the output file names, e.g. vocal_<name>.mp3; defaults to codec and bitrate
+	Name  string `json:"name,omitempty"`
+	Codec string `json:"codec"`
+	// BitrateKbps is ignored by lossless codecs; 0 picks the codec default
+	BitrateKbps int `json:"bitrate_kbps,omitempty"`
+	// SampleRate of the output; 0 keeps the rate of the separated stems
+	SampleRate int `json:"sample_rate,omitempty"`
+	// Channels of the output, 1 or 2; 0 keeps the channels of the separated stems
+	Channels int `json:"channels,omitempty"`
+}
+
+// outputCodec describes how a codec is encoded and what it accepts
+type outputCodec struct {
+	extension string
+	// ffmpeg encoder and muxer
+	encoder string
+	muxer   string
+	// Bitrate range and default in kbps; all zero for lossless codecs
+	minKbps, maxKbps, defaultKbps int
+	sampleRates                   []int
+}
+
+var outputCodecs = map[string]outputCodec{
+	"mp3": {
+		extension: "mp3", encoder: "libmp3lame", muxer: "mp3",
+		minKbps: 32, maxKbps: 320, defaultKbps: 192,
+		sampleRates: []int{32000, 44100, 48000},
+	},
+	"aac": {
+		extension: "m4a", encoder: "aac", muxer: "ipod",
+		minKbps: 32, maxKbps: 512, defaultKbps: 192,
+		sampleRates: []int{32000, 44100, 48000},
+	},
+	"opus": {
+		extension: "ogg", encoder: "libopus", muxer: "ogg",
+		minKbps: 6, maxKbps: 510, defaultKbps: 96,
+		sampleRates: []int{48000},
+	},
+	"flac": {
+		extension: "flac", encoder: "flac", muxer: "flac",
+		sampleRates: []int{32000, 44100, 48000, 88200, 96000},
+	},
+}
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// outputStems maps the separated stems to the names of their deliverables
+var outputStems = []struct{ stem, output string }{
+	{stem: "vocals", output: "vocal"},
+	{stem: "no_vocals", output: "no_vocals"},
+}
+
+// defaultOutputs are the deliverables every job produces, which no profile may overwrite
+var defaultOutputs = []string{"vocal_48k.ogg", "no_vocals_48k.ogg"}
+
+// ParseOutputProfiles decodes and validates the JSON list of output profiles sent with a request.
+// An empty string means no extra outputs.
+func ParseOutputProfiles(data string) ([]OutputProfile, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var profiles []OutputProfile
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("output profiles must be a JSON list: %w", err)
+	}
+	if len(profiles) > MaxOutputProfiles {
+		return nil, fmt.Errorf("at most %d output profiles are allowed, got %d", MaxOutputProfiles, len(profiles))
+	}
+
+	names := make(map[string]bool, len(profiles))
+	for i := range profiles {
+		profile := &profiles[i]
+		if err := profile.normalize(); err != nil {
+			return nil, fmt.Errorf("output profile %d: %w", i+1, err)
+		}
+		if names[profile.Name] {
+			return nil, fmt.Errorf("output profile %d: name %q is used twice", i+1, profile.Name)
+		}
+		names[profile.Name] = true
+		for _, stem := range outputStems {
+			if slices.Contains(defaultOutputs, profile.Filename(stem.output)) {
+				return nil, fmt.Errorf("output profile %d: name %q would overwrite the default %s", i+1, profile.Name, profile.Filename(stem.output))
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// normalize validates the profile and fills in the default bitrate and name
+func (p *OutputProfile) normalize() error {
+	codec, ok := outputCodecs[p.Codec]
+	if !ok {
+		return fmt.Errorf("unknown codec %q, expected mp3, aac, opus or flac", p.Codec)
+	}
+
+	if codec.maxKbps == 0 {
+		if p.BitrateKbps != 0 {
+			return fmt.Errorf("%s is lossless and takes no bitrate", p.Codec)
+		}
+	} else {
+		if p.BitrateKbps == 0 {
+			p.BitrateKbps = codec.defaultKbps
+		}
+		if p.BitrateKbps < codec.minKbps || p.BitrateKbps > codec.maxKbps {
+			return fmt.Errorf("%s bitrate must be between %d and %d kbps, got %d", p.Codec, codec.minKbps, codec.maxKbps, p.BitrateKbps)
+		}
+	}
+
+	if p.SampleRate != 0 && !slices.Contains(codec.sampleRates, p.SampleRate) {
+		return fmt.Errorf("%s can't be encoded at %d Hz, expected one of %v", p.Codec, p.SampleRate, codec.sampleRates)
+	}
+	if p.Channels != 0 && p.Channels != 1 && p.Channels != 2 {
+		return fmt.Errorf("channels must be 1 or 2, got %d", p.Channels)
+	}
+
+	if p.Name == "" {
+		p.Name = p.Codec
+		if p.BitrateKbps != 0 {
+			p.Name += "_" + strconv.Itoa(p.BitrateKbps) + "k"
+		}
+		if p.SampleRate != 0 {
+			p.Name += "_" + strconv.Itoa(p.SampleRate/1000) + "khz"
+		}
+		if p.Channels == 1 {
+			p.Name += "_mono"
+		}
+	}
+	if !profileNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("name %q must be 1 to 32 lowercase letters, digits, '_' or '-'", p.Name)
+	}
+	return nil
+}
+
+// Filename is the name of the deliverable of a stem ("vocal" or "no_vocals") for this profile
+func (p OutputProfile) Filename(output string) string {
+	return output + "_" + p.Name + "." + outputCodecs[p.Codec].extension
+}
+
+// encodeOutputProfiles encodes both stems with every requested profile into the final result
+// directory, so they are part of the downloaded package
+func encodeOutputProfiles(ctx context.Context, config Config) error {
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	finalDir := config.Workspace.FinalResultDir()
+	if err := os.MkdirAll(finalDir, 0755); err != nil {
+		return fmt.Errorf("error creating final result directory: %w", err)
+	}
+
+	for _, profile := range config.OutputProfiles {
+		for _, stem := range outputStems {
+			fmt.Printf("Encoding %s as %s...\n", stem.stem, profile.Name)
+			dst := filepath.Join(finalDir, profile.Filename(stem.output))
+			if err := encodeOutput(ctx, config, stemsDir, stem.stem, dst, profile); err != nil {
+				return fmt.Errorf("error encoding %s as %s: %w", stem.stem, profile.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeOutput encodes one separated stem. Profiles at 48kHz start from the 48kHz stem of the
+// resample step when it's still there, so the stem isn't resampled a second time. Opus is encoded
+// in process when the libopus binding is built in; every other case goes through ffmpeg.
+func encodeOutput(ctx context.Context, config Config, stemsDir, stem, dst string, profile OutputProfile) error {
+	src := filepath.Join(stemsDir, stem+".wav")
+	resampled := ""
+	if profile.Codec == "opus" || profile.SampleRate == 48000 {
+		resampled = resampledStem(config, stemsDir, stem)
+	}
+
+	if profile.Codec == "opus" && audio.OpusAvailable {
+		return encodeOpusOutput(ctx, config, src, resampled, dst, profile)
+	}
+
+	if resampled != "" {
+		src = resampled
+	}
+	codec := outputCodecs[profile.Codec]
+	args := []string{"-y", "-i", src, "-vn", "-c:a", codec.encoder}
+	if profile.BitrateKbps != 0 {
+		args = append(args, "-b:a", strconv.Itoa(profile.BitrateKbps)+"k")
+	}
+	if profile.SampleRate != 0 {
+		args = append(args, "-ar", strconv.Itoa(profile.SampleRate))
+	} else if profile.Codec == "opus" {
+		args = append(args, "-ar", "48000")
+	}
+	if profile.Channels != 0 {
+		args = append(args, "-ac", strconv.Itoa(profile.Channels))
+	}
+
+	// Written under a temporary name so a failed attempt never leaves a partial deliverable
+	tmpPath := dst + ".tmp"
+	args = append(args, "-f", codec.muxer, tmpPath)
+	defer os.Remove(tmpPath)
+	if err := runCommand(newCommand(ctx, config.Tools.FFmpegPath, args...)); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
+
+// resampledStem returns the 48kHz WAV the resample step made of stem, or "" if it's gone. The
+// alignment step moves the 48kHz vocals into the MFA corpus, under the name of the song.
+func resampledStem(config Config, stemsDir, stem string) string {
+	candidates := []string{filepath.Join(stemsDir, stem+"_48k.wav")}
+	if stem == "vocals" {
+		candidates = append(candidates, filepath.Join(config.Workspace.InputDir(), config.Filename+".wav"))
+	}
+	for _, path := range candidates {
+		// Sessions that kept the upload in the corpus may have it under the same name
+		if path == config.InputAudioFile {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// encodeOpusOutput encodes the stem with the in-process encoder, from resampled when the 48kHz
+// stem is available and otherwise from src resampled to 48kHz
+func encodeOpusOutput(ctx context.Context, config Config, src, resampled, dst string, profile OutputProfile) error {
+	if resampled == "" {
+		// Kept next to the stems so it never ends up in the downloaded package
+		resampled = strings.TrimSuffix(src, ".wav") + "_" + profile.Name + "_48k.wav"
+		defer os.Remove(resampled)
+		if err := audio.ResampleWAV(ctx, src, resampled, 48000, resampleQuality(config)); err != nil {
+			return err
+		}
+	}
+
+	// Opus takes at most two channels, and Demucs stems are stereo
+	channels := profile.Channels
+	if channels == 0 {
+		channels = 2
+	}
+	return audio.EncodeOggOpus(ctx, resampled, dst, audio.OpusOptions{Bitrate: profile.BitrateKbps * 1000, Channels: channels})
+}
+
+// noOutputProfiles skips the step for jobs that only want the default OGG stems
+func noOutputProfiles(config Config) bool {
+	return len(config.OutputProfiles) == 0
+}
@@ -0,0 +1,130 @@
+package function
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOutputProfiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []OutputProfile
+	}{
+		{"empty", "", nil},
+		{"empty list", "[]", []OutputProfile{}},
+		{
+			name: "defaults",
+			data: `[{"codec":"mp3"},{"codec":"flac"},{"codec":"opus","sample_rate":48000,"channels":1}]`,
+			want: []OutputProfile{
+				{Name: "mp3_192k", Codec: "mp3", BitrateKbps: 192},
+				{Name: "flac", Codec: "flac"},
+				{Name: "opus_96k_48khz_mono", Codec: "opus", BitrateKbps: 96, SampleRate: 48000, Channels: 1},
+			},
+		},
+		{
+			name: "explicit",
+			data: `[{"name":"hq","codec":"aac","bitrate_kbps":320,"sample_rate":44100,"channels":2}]`,
+			want: []OutputProfile{{Name: "hq", Codec: "aac", BitrateKbps: 320, SampleRate: 44100, Channels: 2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseOutputProfiles(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseOutputProfilesInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"not a list", `{"codec":"mp3"}`, "must be a JSON list"},
+		{"unknown field", `[{"codec":"mp3","bitrate":128}]`, "unknown field"},
+		{"unknown codec", `[{"codec":"wma"}]`, `output profile 1: unknown codec "wma"`},
+		{"bitrate too low", `[{"codec":"mp3","bitrate_kbps":16}]`, "mp3 bitrate must be between 32 and 320 kbps, got 16"},
+		{"bitrate too high", `[{"codec":"opus","bitrate_kbps":600}]`, "opus bitrate must be between 6 and 510 kbps"},
+		{"lossless bitrate", `[{"codec":"flac","bitrate_kbps":900}]`, "flac is lossless"},
+		{"sample rate", `[{"codec":"opus","sample_rate":44100}]`, "opus can't be encoded at 44100 Hz"},
+		{"channels", `[{"codec":"mp3","channels":6}]`, "channels must be 1 or 2, got 6"},
+		{"negative channels", `[{"codec":"mp3","channels":-1}]`, "channels must be 1 or 2"},
+		{"uppercase name", `[{"codec":"mp3","name":"HQ"}]`, `name "HQ" must be`},
+		{"path in name", `[{"codec":"mp3","name":"../hq"}]`, `name "../hq" must be`},
+		{"long name", `[{"codec":"mp3","name":"` + strings.Repeat("a", 33) + `"}]`, "must be 1 to 32"},
+		{"duplicate name", `[{"codec":"mp3"},{"codec":"aac","name":"mp3_192k"}]`, `output profile 2: name "mp3_192k" is used twice`},
+		{"duplicate default name", `[{"codec":"mp3"},{"codec":"mp3","bitrate_kbps":192}]`, "used twice"},
+		{"overwrites default", `[{"codec":"opus","name":"48k"}]`, "would overwrite the default vocal_48k.ogg"},
+		{"too many", "[" + strings.Repeat(`{"codec":"flac"},`, MaxOutputProfiles) + `{"codec":"flac"}]`, "at most 8 output profiles"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseOutputProfiles(test.data)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestOutputProfileFilename(t *testing.T) {
+	profile := OutputProfile{Name: "hq", Codec: "aac"}
+	if got := profile.Filename("vocal"); got != "vocal_hq.m4a" {
+		t.Errorf("got %q, want vocal_hq.m4a", got)
+	}
+}
+
+func TestResampledStem(t *testing.T) {
+	root := t.TempDir()
+	config := Config{Filename: "audio", Workspace: Workspace{Root: root}, InputAudioFile: filepath.Join(root, "upload", "audio.mp3")}
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	touch := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := resampledStem(config, stemsDir, "no_vocals"); got != "" {
+		t.Errorf("found %q before the resample step ran", got)
+	}
+
+	touch(filepath.Join(stemsDir, "no_vocals_48k.wav"))
+	touch(filepath.Join(stemsDir, "vocals_48k.wav"))
+	for _, stem := range []string{"vocals", "no_vocals"} {
+		if got, want := resampledStem(config, stemsDir, stem), filepath.Join(stemsDir, stem+"_48k.wav"); got != want {
+			t.Errorf("%s: got %q, want %q", stem, got, want)
+		}
+	}
+
+	// After the alignment the vocals are in the MFA corpus
+	corpus := filepath.Join(config.Workspace.InputDir(), "audio.wav")
+	if err := os.MkdirAll(config.Workspace.InputDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(stemsDir, "vocals_48k.wav"), corpus); err != nil {
+		t.Fatal(err)
+	}
+	if got := resampledStem(config, stemsDir, "vocals"); got != corpus {
+		t.Errorf("got %q, want %q", got, corpus)
+	}
+
+	// An upload kept in the corpus is not the 48kHz vocals
+	config.InputAudioFile = corpus
+	if got := resampledStem(config, stemsDir, "vocals"); got != "" {
+		t.Errorf("took the upload %q for the 48kHz vocals", got)
+	}
+}
@@ -0,0 +1,208 @@
+package function
+
+import (
+	"context"
+	"fmt"
+
+	"karaoke_generator/progress"
+)
+
+// ErrCodeStepFailed is reported for steps that don't define their own error code
+const ErrCodeStepFailed = "STEP_FAILED"
+
+// Step is one stage of the karaoke generation pipeline
+type Step interface {
+	// Name identifies the step in progress reports, step policies and errors
+	Name() string
+	// Weight is the share of the whole job this step represents, relative to the other steps
+	Weight() float64
+	// Run executes the step for the job described by config, inside config.Workspace
+	Run(ctx context.Context, config Config) error
+}
+
+// Skipper is implemented by steps that can decide not to run for a given job
+type Skipper interface {
+	Skip(config Config) bool
+}
+
+// ErrorCoder is implemented by steps that report a specific error code when they fail
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// funcStep adapts plain functions to the Step interface
+type funcStep struct {
+	name   string
+	weight float64
+	code   string
+	run    func(ctx context.Context, config Config) error
+	skip   func(config Config) bool
+}
+
+// NewStep creates a pipeline step from a function
+func NewStep(name string, weight float64, run func(ctx context.Context, config Config) error) Step {
+	return &funcStep{name: name, weight: weight, code: ErrCodeStepFailed, run: run}
+}
+
+func (s *funcStep) Name() string      { return s.name }
+func (s *funcStep) Weight() float64   { return s.weight }
+func (s *funcStep) ErrorCode() string { return s.code }
+
+func (s *funcStep) Run(ctx context.Context, config Config) error {
+	return s.run(ctx, config)
+}
+
+func (s *funcStep) Skip(config Config) bool {
+	return s.skip != nil && s.skip(config)
+}
+
+// Pipeline runs steps in order and derives the job progress from their weights
+type Pipeline struct {
+	steps []Step
+}
+
+// NewPipeline creates a pipeline running steps in the given order
+func NewPipeline(steps ...Step) *Pipeline {
+	return &Pipeline{steps: steps}
+}
+
+// DefaultPipeline is the full generation pipeline: stem cache lookup, separation,
+// 48kHz resampling, OGG encoding, stem caching, lyrics alignment, pitch analysis,
+// encoding of the requested output profiles, packaging of the results and export
+// of the lyrics to player formats
+func DefaultPipeline() *Pipeline {
+	return NewPipeline(
+		&funcStep{name: StepCacheLookup, weight: 1, code: ErrCodeStepFailed, run: bestEffort(StepCacheLookup, restoreCachedStems)},
+		&funcStep{name: StepSeparation, weight: 40, code: ErrCodeSeparation, run: runDemucs, skip: stemsPresent},
+		&funcStep{name: StepResample, weight: 5, code: ErrCodeResample, run: convertTo48kHz, skip: resampledPresent},
+		&funcStep{name: StepOggEncode, weight: 5, code: ErrCodeOggEncode, run: convertToOgg, skip: oggPresent},
+		&funcStep{name: StepCacheStore, weight: 1, code: ErrCodeStepFailed, run: bestEffort(StepCacheStore, storeCachedStems)},
+		&funcStep{name: StepAlignment, weight: 30, code: ErrCodeAlignment, run: generateTimestamps},
+		&funcStep{name: StepPitchAnalysis, weight: 15, code: ErrCodePitchAnalysis, run: analyzePitch},
+		&funcStep{name: StepOutputEncode, weight: 5, code: ErrCodeOutputEncode, run: encodeOutputProfiles, skip: noOutputProfiles},
+		&funcStep{name: StepArchive, weight: 5, code: ErrCodeArchive, run: archiveAllAssests},
+		&funcStep{name: StepLyricsExport, weight: 1, code: ErrCodeLyricsExport, run: exportLyrics},
+	)
+}
+
+// Steps returns the steps of the pipeline in execution order
+func (p *Pipeline) Steps() []Step {
+	return append([]Step(nil), p.steps...)
+}
+
+// Run executes every step that is not skipped, under its step policy,
+// reporting progress proportionally to the step weights. Whether a step is
+// skipped is decided right before it would run, so it can see earlier results.
+// Each completed or skipped step is recorded in the workspace checkpoint manifest,
+// and a rerun of the same session restarts from the first incomplete step.
+func (p *Pipeline) Run(ctx context.Context, config Config) error {
+	checkpoint, err := loadOrCreateCheckpoint(ctx, config)
+	if err != nil {
+		// A job cancelled while its input was hashed or probed is not a workspace error
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return stepFailed("workspace", ErrCodeWorkspace, err)
+	}
+	config.AudioHash = checkpoint.AudioHash
+	config.AudioSeconds = checkpoint.AudioSeconds
+	// A resumed job keeps the output profiles of its original request
+	if len(config.OutputProfiles) == 0 {
+		config.OutputProfiles = checkpoint.OutputProfiles
+	}
+
+	active := p.steps
+	var totalWeight float64
+	for _, step := range active {
+		totalWeight += step.Weight()
+	}
+
+	// Steps completed by a previous run are reused up to the first incomplete one
+	var doneWeight float64
+	resumeAt := 0
+	for resumeAt < len(active) && checkpoint.IsCompleted(active[resumeAt].Name()) {
+		doneWeight += active[resumeAt].Weight()
+		resumeAt++
+	}
+	if resumeAt > 0 {
+		var rerun []string
+		for _, step := range active[resumeAt:] {
+			rerun = append(rerun, step.Name())
+		}
+		checkpoint.forget(rerun...)
+		if resumeAt < len(active) {
+			progress.AddHistory(config.SessionID, active[resumeAt].Name(),
+				fmt.Sprintf("resuming from checkpoint, %d completed steps reused", resumeAt))
+		}
+	}
+
+	progress.PlanSteps(config.SessionID, plannedSteps(active[resumeAt:], config), config.AudioSeconds)
+
+	for i, step := range active[resumeAt:] {
+		// Don't start a new step for a job that was cancelled meanwhile
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if skipper, ok := step.(Skipper); ok && skipper.Skip(config) {
+			progress.StepSkipped(config.SessionID, step.Name(), "outputs already present")
+			// A skipped step counts as completed, so a resume doesn't stop at it and rerun the rest
+			if err := checkpoint.markCompleted(config.Workspace, step.Name()); err != nil {
+				return stepFailed(step.Name(), ErrCodeWorkspace, err)
+			}
+			doneWeight += step.Weight()
+			continue
+		}
+
+		percentage := percentOf(doneWeight, totalWeight)
+		progress.UpdateProgress(config.SessionID, percentage, fmt.Sprintf("%s processing", step.Name()), step.Name())
+
+		code := ErrCodeStepFailed
+		if coder, ok := step.(ErrorCoder); ok {
+			code = coder.ErrorCode()
+		}
+		progress.StepStarted(config.SessionID, step.Name())
+		err := runStep(ctx, config.stepPolicy(step.Name()), config.SessionID, step.Name(), code, func(ctx context.Context) error {
+			return step.Run(ctx, config)
+		})
+		progress.StepFinished(config.SessionID, step.Name(), err)
+		if err != nil {
+			return err
+		}
+
+		if err := checkpoint.markCompleted(config.Workspace, step.Name()); err != nil {
+			return stepFailed(step.Name(), ErrCodeWorkspace, err)
+		}
+
+		// A step can make later ones skippable, e.g. the stem cache lookup
+		progress.ReplanSteps(config.SessionID, plannedSteps(active[resumeAt+i+1:], config))
+
+		doneWeight += step.Weight()
+		percentage = percentOf(doneWeight, totalWeight)
+		progress.UpdateProgress(config.SessionID, percentage, fmt.Sprintf("%s completed", step.Name()), step.Name())
+	}
+
+	return nil
+}
+
+// plannedSteps lists the steps that are expected to run, leaving out the ones that would be
+// skipped now. A skipped step never records a duration, so keeping it in the plan would leave
+// the learned time left unknown for the whole job.
+func plannedSteps(steps []Step, config Config) []string {
+	var planned []string
+	for _, step := range steps {
+		if skipper, ok := step.(Skipper); ok && skipper.Skip(config) {
+			continue
+		}
+		planned = append(planned, step.Name())
+	}
+	return planned
+}
+
+// percentOf converts done/total into a percentage, treating an empty pipeline as finished
+func percentOf(done, total float64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return round(done/total*100, 1)
+}
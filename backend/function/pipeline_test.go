@@ -0,0 +1,248 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"karaoke_generator/progress"
+)
+
+// pipelineConfig returns the config of a job running in a fresh workspace
+func pipelineConfig(t *testing.T, sessionID string) Config {
+	t.Helper()
+	root := t.TempDir()
+	audioPath := filepath.Join(root, "song.wav")
+	if err := os.WriteFile(audioPath, []byte("RIFF song"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { progress.ClearProgress(sessionID) })
+	return Config{
+		SessionID:      sessionID,
+		InputAudioFile: audioPath,
+		Filename:       "song",
+		Workspace:      Workspace{Root: root},
+	}
+}
+
+// recorder is a set of fake steps that log the steps that ran and the job
+// percentage reported when each of them started
+type recorder struct {
+	ran         []string
+	percentages []float64
+}
+
+func (r *recorder) step(name string, weight float64) *funcStep {
+	return &funcStep{name: name, weight: weight, code: ErrCodeStepFailed, run: func(ctx context.Context, config Config) error {
+		r.ran = append(r.ran, name)
+		r.percentages = append(r.percentages, progress.GetProgress(config.SessionID).Percentage)
+		return nil
+	}}
+}
+
+// timelineStatuses lists the steps of the session timeline with their status
+func timelineStatuses(sessionID string) []string {
+	var statuses []string
+	for _, timing := range progress.GetTimeline(sessionID) {
+		statuses = append(statuses, timing.Step+" "+timing.Status)
+	}
+	return statuses
+}
+
+func TestPipelineWeightedProgress(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-weights")
+	r := &recorder{}
+	pipeline := NewPipeline(r.step("a", 1), r.step("b", 3), r.step("c", 4))
+
+	if err := pipeline.Run(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %v, want %v", r.ran, want)
+	}
+	if want := []float64{0, 12.5, 50}; !reflect.DeepEqual(r.percentages, want) {
+		t.Errorf("percentages %v, want %v", r.percentages, want)
+	}
+	if got := progress.GetProgress(config.SessionID).Percentage; got != 100 {
+		t.Errorf("final percentage %v, want 100", got)
+	}
+}
+
+func TestPipelineSkipper(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-skipper")
+	// Uploaded stems make the separation unnecessary
+	writeStems(t, config)
+
+	r := &recorder{}
+	separation := &funcStep{name: StepSeparation, weight: 4, code: ErrCodeSeparation, skip: stemsPresent, run: func(ctx context.Context, config Config) error {
+		return errors.New("separation ran although the stems were uploaded")
+	}}
+	pipeline := NewPipeline(r.step("upload", 1), separation, r.step("alignment", 5))
+
+	if err := pipeline.Run(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"upload", "alignment"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %v, want %v", r.ran, want)
+	}
+	// The skipped step still counts towards the progress
+	if want := []float64{0, 50}; !reflect.DeepEqual(r.percentages, want) {
+		t.Errorf("percentages %v, want %v", r.percentages, want)
+	}
+	want := []string{"upload completed", StepSeparation + " skipped", "alignment completed"}
+	if got := timelineStatuses(config.SessionID); !reflect.DeepEqual(got, want) {
+		t.Errorf("timeline %v, want %v", got, want)
+	}
+}
+
+func TestPipelineStepError(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-error")
+	r := &recorder{}
+	failing := &funcStep{name: StepAlignment, weight: 1, code: ErrCodeAlignment, run: func(ctx context.Context, config Config) error {
+		return errors.New("no TextGrid written")
+	}}
+	pipeline := NewPipeline(r.step("a", 1), failing, r.step("c", 1))
+
+	err := pipeline.Run(context.Background(), config)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != StepAlignment || stepErr.Code != ErrCodeAlignment {
+		t.Fatalf("got %v, want an %s StepError", err, ErrCodeAlignment)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %v, want %v", r.ran, want)
+	}
+}
+
+func TestPipelineCancelled(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-cancel")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &recorder{}
+	cancelling := NewStep("cancel", 1, func(ctx context.Context, config Config) error {
+		cancel()
+		return nil
+	})
+	err := NewPipeline(cancelling, r.step("b", 1)).Run(ctx, config)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if len(r.ran) != 0 {
+		t.Errorf("ran %v after the job was cancelled", r.ran)
+	}
+}
+
+// completedSteps returns the steps recorded in the checkpoint manifest of the workspace
+func completedSteps(t *testing.T, ws Workspace) []string {
+	t.Helper()
+	checkpoint, err := LoadCheckpoint(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	for _, step := range checkpoint.CompletedSteps {
+		steps = append(steps, step.Name)
+	}
+	return steps
+}
+
+func TestPipelineResume(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-resume")
+	r := &recorder{}
+	failures := 1
+	flaky := &funcStep{name: "b", weight: 2, code: ErrCodeAlignment, run: func(ctx context.Context, config Config) error {
+		r.ran = append(r.ran, "b")
+		r.percentages = append(r.percentages, progress.GetProgress(config.SessionID).Percentage)
+		if failures > 0 {
+			failures--
+			return errors.New("alignment failed")
+		}
+		return nil
+	}}
+	skipped := &funcStep{name: "skipped", weight: 1, code: ErrCodeStepFailed, skip: func(Config) bool { return true }}
+	pipeline := NewPipeline(r.step("a", 1), skipped, flaky, r.step("c", 4))
+
+	if err := pipeline.Run(context.Background(), config); err == nil {
+		t.Fatal("the failing step didn't fail the job")
+	}
+	// The skipped step is checkpointed, so a resume doesn't stop at it
+	if want := []string{"a", "skipped"}; !reflect.DeepEqual(completedSteps(t, config.Workspace), want) {
+		t.Errorf("checkpointed %v, want %v", completedSteps(t, config.Workspace), want)
+	}
+	first, err := LoadCheckpoint(config.Workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.ran, r.percentages = nil, nil
+	if err := pipeline.Run(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("resumed run ran %v, want %v", r.ran, want)
+	}
+	// Reused steps count as done
+	if want := []float64{25, 50}; !reflect.DeepEqual(r.percentages, want) {
+		t.Errorf("percentages %v, want %v", r.percentages, want)
+	}
+	if want := []string{"a", "skipped", "b", "c"}; !reflect.DeepEqual(completedSteps(t, config.Workspace), want) {
+		t.Errorf("checkpointed %v, want %v", completedSteps(t, config.Workspace), want)
+	}
+
+	// The resumed job keeps the stem cache key taken when the job started
+	second, err := LoadCheckpoint(config.Workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.AudioHash == "" || second.AudioHash != first.AudioHash {
+		t.Errorf("audio hash %q, want %q", second.AudioHash, first.AudioHash)
+	}
+}
+
+func TestPipelineResumeFirstIncomplete(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-resume-gap")
+	checkpoint, err := loadOrCreateCheckpoint(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c completed in a run where b had been skipped, b has to run now
+	for _, step := range []string{"a", "c"} {
+		if err := checkpoint.markCompleted(config.Workspace, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &recorder{}
+	pipeline := NewPipeline(r.step("a", 1), r.step("b", 1), r.step("c", 1))
+	if err := pipeline.Run(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	// Everything after the first incomplete step runs again
+	if want := []string{"b", "c"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %v, want %v", r.ran, want)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(completedSteps(t, config.Workspace), want) {
+		t.Errorf("checkpointed %v, want %v", completedSteps(t, config.Workspace), want)
+	}
+}
+
+func TestPipelineCancelledBeforeCheckpoint(t *testing.T) {
+	config := pipelineConfig(t, "pipeline-cancel-checkpoint")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewPipeline(NewStep("a", 1, func(ctx context.Context, config Config) error { return nil })).Run(ctx, config)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	var stepErr *StepError
+	if errors.As(err, &stepErr) {
+		t.Errorf("a cancelled job was reported as a %s error", stepErr.Code)
+	}
+	if _, err := os.Stat(config.Workspace.CheckpointPath()); !os.IsNotExist(err) {
+		t.Errorf("a checkpoint was written for a cancelled job: %v", err)
+	}
+}
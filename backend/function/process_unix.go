@@ -0,0 +1,21 @@
+//go:build !windows
+
+package function
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// configureProcessGroup starts the tool in its own process group so cancelling the job
+// also kills the children it spawns (conda run, bash -c, python workers)
+func configureProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		if cmd.Process == nil {
+			return nil
+		}
+		// A negative pid signals every process in the group
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package function
+
+import "os/exec"
+
+// configureProcessGroup keeps the default behaviour on Windows, where cancelling
+// the context kills the tool process itself
+func configureProcessGroup(cmd *exec.Cmd) {}
@@ -2,11 +2,14 @@ package function
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"karaoke_generator/audio"
 	"karaoke_generator/progress"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -16,9 +19,63 @@ type Config struct {
 	OutputDir      string
 	Filename       string
 	SessionID      string
-	language       int
+	Workspace      Workspace
+	Tools          Tools
+	// Ogg controls the Opus encoding of the OGG stems
+	Ogg audio.OpusOptions
+	// Resample is the filter quality used to bring the stems to 48 kHz
+	Resample audio.ResampleQuality
+	// OutputProfiles are the extra encodings of the stems requested with the job
+	OutputProfiles []OutputProfile
+	// StepPolicies are the timeouts and retries of the steps, keyed by step name
+	StepPolicies map[string]StepPolicy
+	// Cache locates and bounds the stem cache
+	Cache StemCacheOptions
+	// ASS controls the look of the ASS lyrics export
+	ASS ASSOptions
+	// AudioHash is the SHA-256 of the uploaded audio, used as the stem cache key
+	AudioHash string
+	// AudioSeconds is the duration of the uploaded audio, used to estimate the time left
+	AudioSeconds float64
+	language     int
 }
 
+// JobOptions are the settings a job runs with: the server-wide tools, storage and encoding
+// settings, plus the output profiles of the request
+type JobOptions struct {
+	Tools Tools
+	// WorkspaceDir is the directory under which every session gets its own workspace
+	WorkspaceDir string
+	// Ogg controls the Opus encoding of the OGG stems
+	Ogg audio.OpusOptions
+	// Resample is the filter quality used to bring the stems to 48 kHz
+	Resample audio.ResampleQuality
+	// OutputProfiles are the extra encodings of the stems delivered with the session
+	OutputProfiles []OutputProfile
+	// StepPolicies are the timeouts and retries of the steps; steps missing from it use their default policy
+	StepPolicies map[string]StepPolicy
+	// Cache locates and bounds the stem cache
+	Cache StemCacheOptions
+	// ASS controls the look of the ASS lyrics export
+	ASS ASSOptions
+}
+
+// DefaultJobOptions returns the settings used when the configuration doesn't override them
+func DefaultJobOptions() JobOptions {
+	return JobOptions{
+		Tools:        DefaultTools(),
+		WorkspaceDir: DefaultWorkspaceDir,
+		Ogg:          DefaultOggOptions,
+		Resample:     audio.ResampleHigh,
+		StepPolicies: DefaultStepPolicies(),
+		Cache:        DefaultStemCacheOptions,
+		ASS:          DefaultASSOptions,
+	}
+}
+
+// DefaultOggOptions are 48 kbps mono, enough for the sing-along stems
+var DefaultOggOptions = audio.OpusOptions{Bitrate: 48000, Channels: 1}
+
 type Pair[T any] struct {
 	dictionary T
 	acoustic   T
@@ -29,279 +86,265 @@ var dic = map[int]Pair[string]{
 	2: {dictionary: "english_us_mfa", acoustic: "english_mfa"},
 }
 
+// MFAModels returns the MFA dictionary and acoustic model used to align a language
+func MFAModels(language int) (dictionary, acoustic string, ok bool) {
+	models, ok := dic[language]
+	return models.dictionary, models.acoustic, ok
+}
+
+// Languages returns the supported language codes in ascending order
+func Languages() []int {
+	languages := make([]int, 0, len(dic))
+	for language := range dic {
+		languages = append(languages, language)
+	}
+	sort.Ints(languages)
+	return languages
+}
+
 // Sử dụng file và lyrics từ người dùng
-func GenerateKaraokeFromUpload(audioPath string, lyricsContent string, sessionID string, language int) error {
+func GenerateKaraokeFromUpload(ctx context.Context, options JobOptions, audioPath string, lyricsContent string, sessionID string, language int) error {
+	// Every session works inside its own workspace so concurrent jobs never share files
+	ws, err := NewWorkspace(options.WorkspaceDir, sessionID)
+	if err != nil {
+		return stepFailed("workspace", ErrCodeWorkspace, err)
+	}
+
 	// Tạo config với đường dẫn file từ người dùng
 	config := Config{
-		InputLyricsSrc: "./function/input/vocals_48k.lab",
+		InputLyricsSrc: lyricsContent,
 		InputAudioFile: audioPath,
-		OutputDir:      "./function/output",
+		OutputDir:      ws.OutputDir(),
 		SessionID:      sessionID,
+		Workspace:      ws,
+		Tools:          options.Tools,
+		Ogg:            options.Ogg,
+		Resample:       options.Resample,
+		OutputProfiles: options.OutputProfiles,
+		StepPolicies:   options.StepPolicies,
+		Cache:          options.Cache,
+		ASS:            options.ASS,
 		language:       language,
 	}
 
 	// Extract filename without extension
 	config.Filename = strings.TrimSuffix(filepath.Base(config.InputAudioFile), filepath.Ext(config.InputAudioFile))
 
-	// Create output directory if it doesn't exist
-	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-		return fmt.Errorf("Error creating output directory: %v", err)
-	}
-
 	// Execute the karaoke generation pipeline
-	if err := generateKaraokeReal(config); err != nil {
-		return fmt.Errorf("Error: %v", err)
+	if err := generateKaraokeReal(ctx, config); err != nil {
+		return fmt.Errorf("Error: %w", err)
 	}
 
 	return nil
 }
 
 // GenerateKaraoke creates a karaoke track from an audio file
-func generateKaraokeReal(config Config) error {
-	// Step 1: Run Demucs to separate vocals and music
-	progress.UpdateProgress(config.SessionID, 10, "Demucs processing", "Demucs processing")
-	if err := runDemucs(config); err != nil {
-
-		return fmt.Errorf("demucs processing failed: %w", err)
-	}
-	progress.UpdateProgress(config.SessionID, 20, "Demucs processing completed", "Demucs processing completed")
-
-	// Step 2: Convert WAV files to 48kHz
-	if err := convertTo48kHz(config); err != nil {
-		return fmt.Errorf("48kHz conversion failed: %w", err)
+func generateKaraokeReal(ctx context.Context, config Config) error {
+	if err := DefaultPipeline().Run(ctx, config); err != nil {
+		return err
 	}
 
-	//progress.UpdateProgress(config.SessionID, 30, "48kHz conversion completed", "48kHz conversion completed")
-
-	// Step 3: Convert WAV files to OGG format
-	if err := convertToOgg(config); err != nil {
-		return fmt.Errorf("OGG conversion failed: %w", err)
-	}
-
-	progress.UpdateProgress(config.SessionID, 40, "OGG conversion completed", "OGG conversion completed")
-
-	// // Step 4: Move OGG files to output directory
-	// if err := moveOggFiles(config); err != nil {
-	// 	return fmt.Errorf("moving OGG files failed: %w", err)aa
-	// }
+	progress.UpdateProgress(config.SessionID, 100, "Final files generated", "Final files generated")
+	return nil
+}
 
-	progress.UpdateProgress(config.SessionID, 50, "OGG files moved to output directory", "OGG files moved to output directory")
+// stemsPresent reports whether the separated stems are already in the workspace,
+// e.g. because they were uploaded, so Demucs doesn't need to run
+func stemsPresent(config Config) bool {
+	return filesPresent(config.Workspace.StemsDir(config.Filename), "vocals.wav", "no_vocals.wav")
+}
 
-	// Step 5: Generate timestamp file
-	if err := generateTimestamps(config); err != nil {
-		fmt.Println("ERROR timestamp generation failed: %w", err)
-		return fmt.Errorf("timestamp generation failed: %w", err)
-	}
+// resampledPresent reports whether the 48kHz stems already exist, e.g. restored from the stem cache
+func resampledPresent(config Config) bool {
+	return filesPresent(config.Workspace.StemsDir(config.Filename), "vocals_48k.wav", "no_vocals_48k.wav")
+}
 
-	progress.UpdateProgress(config.SessionID, 60, "Timestamp file generated", "Timestamp file generated")
+// oggPresent reports whether the OGG stems already exist, e.g. restored from the stem cache
+func oggPresent(config Config) bool {
+	return filesPresent(config.Workspace.StemsDir(config.Filename), "vocals_48k_48k.ogg", "no_vocals_48k_48k.ogg")
+}
 
-	if err := archiveAllAssests(config); err != nil {
-		return fmt.Errorf("archive all assets failed: %w", err)
+// filesPresent reports whether every named file exists in dir
+func filesPresent(dir string, names ...string) bool {
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
 	}
-
-	progress.UpdateProgress(config.SessionID, 100, "Final files generated", "Final files generated")
-	return nil
+	return true
 }
 
-func archiveAllAssests(config Config) error {
+func archiveAllAssests(ctx context.Context, config Config) error {
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	finalDir := config.Workspace.FinalResultDir()
+	oggVocal := filepath.Join(stemsDir, "vocals_48k_48k.ogg")
+	oggNoVocal := filepath.Join(stemsDir, "no_vocals_48k_48k.ogg")
+	timestampOutput := filepath.Join(config.Workspace.TimestampDir(), "output_with_notes.json")
 
-	ogg_vocal := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "vocals_48k_48k.ogg")
-	ogg_no_vocal := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "no_vocals_48k_48k.ogg")
-	timestamp_output := filepath.Join("./function/timestamp_output/output_with_notes.json")
-	fmt.Println(ogg_vocal)
-	fmt.Println(ogg_no_vocal)
-	fmt.Println(timestamp_output)
+	if err := os.MkdirAll(finalDir, 0755); err != nil {
+		return fmt.Errorf("error creating final result directory: %w", err)
+	}
 
-	if err := os.Rename(ogg_vocal, "./function/final_result/vocal_48k.ogg"); err != nil {
-		fmt.Println("error moving vocals OGG: %w", err)
+	if err := moveResult(oggVocal, filepath.Join(finalDir, "vocal_48k.ogg")); err != nil {
 		return fmt.Errorf("error moving vocals OGG: %w", err)
 	}
 
-	if err := os.Rename(ogg_no_vocal, "./function/final_result/no_vocals_48k.ogg"); err != nil {
-		fmt.Println("error moving no vocals OGG: %w", err)
+	if err := moveResult(oggNoVocal, filepath.Join(finalDir, "no_vocals_48k.ogg")); err != nil {
 		return fmt.Errorf("error moving no vocals OGG: %w", err)
 	}
 
-	if err := os.Rename(timestamp_output, "./function/final_result/timestamp_with_notes.json"); err != nil {
-		fmt.Println("error moving timestamp output: %w", err)
+	if err := moveResult(timestampOutput, filepath.Join(finalDir, FinalLyricsFile)); err != nil {
 		return fmt.Errorf("error moving timestamp output: %w", err)
 	}
 
 	return nil
 }
 
-func runDemucs(config Config) error {
+// moveResult moves a file into the final result directory. A file already moved
+// by an earlier, interrupted run of the archive step is left in place.
+func moveResult(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		if _, dstErr := os.Stat(dst); dstErr == nil {
+			return nil
+		}
+	}
+	return os.Rename(src, dst)
+}
+
+func runDemucs(ctx context.Context, config Config) error {
 	fmt.Println("Running demucs on:", config.InputAudioFile)
 	fmt.Println("Output will be saved to:", config.OutputDir)
 
-	cmd := exec.Command("bash", "-c", fmt.Sprintf(
-		"/Users/mac/miniconda3/bin/conda run -n demucs_env demucs --two-stems=vocals --out=\"%s\" \"%s\"",
-		config.OutputDir, config.InputAudioFile))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd, err := config.Tools.condaCommand(ctx, config.Tools.DemucsEnv, "demucs", "--two-stems=vocals", "--out="+config.OutputDir, config.InputAudioFile)
+	if err != nil {
+		return fmt.Errorf("demucs processing failed: %w", err)
+	}
 
-	return cmd.Run()
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("demucs processing failed: %w", err)
+	}
+	return nil
 }
 
-func convertTo48kHz(config Config) error {
-	// Set file paths
-	vocalsFile := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "vocals.wav")
-	vocals48k := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "vocals_48k.wav")
-	noVocalsFile := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "no_vocals.wav")
-	noVocals48k := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "no_vocals_48k.wav")
-
-	// Convert vocals WAV from 44.1kHz to 48kHz
-	fmt.Println("Converting vocals from 44.1kHz to 48kHz...")
-	cmd := exec.Command("ffmpeg", "-i", vocalsFile, "-ar", "48000", vocals48k)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error converting vocals to 48kHz: %w", err)
+func convertTo48kHz(ctx context.Context, config Config) error {
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	quality := resampleQuality(config)
+
+	// Opus only takes 48 kHz, Demucs writes the stems at the input rate (usually 44.1 kHz)
+	for _, stem := range []string{"vocals", "no_vocals"} {
+		fmt.Printf("Resampling %s to 48kHz...\n", stem)
+		wavPath := filepath.Join(stemsDir, stem+".wav")
+		outPath := filepath.Join(stemsDir, stem+"_48k.wav")
+		if err := audio.ResampleWAV(ctx, wavPath, outPath, 48000, quality); err != nil {
+			return fmt.Errorf("error converting %s to 48kHz: %w", stem, err)
+		}
 	}
+	return nil
+}
 
-	// Convert no_vocals WAV from 44.1kHz to 48kHz
-	fmt.Println("Converting no_vocals from 44.1kHz to 48kHz...")
-	cmd = exec.Command("ffmpeg", "-i", noVocalsFile, "-ar", "48000", noVocals48k)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+// resampleQuality is the filter quality of the job, high unless configured otherwise
+func resampleQuality(config Config) audio.ResampleQuality {
+	if config.Resample == "" {
+		return audio.ResampleHigh
+	}
+	return config.Resample
 }
 
-func convertToOgg(config Config) error {
+func convertToOgg(ctx context.Context, config Config) error {
+	stemsDir := config.Workspace.StemsDir(config.Filename)
 
-	// Convert vocals 48k WAV to OGG
-	fmt.Println("Converting vocals to OGG format...")
-	cmd := exec.Command("./function/ogg/wav2ogg", "-i", filepath.Join(config.OutputDir, "htdemucs", config.Filename, "no_vocals_48k.wav"), "-b", "48k", "-m")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error converting vocals to OGG: %w", err)
+	for _, stem := range []string{"no_vocals", "vocals"} {
+		fmt.Printf("Converting %s to OGG format...\n", stem)
+		wavPath := filepath.Join(stemsDir, stem+"_48k.wav")
+		oggPath := filepath.Join(stemsDir, stem+"_48k_48k.ogg")
+		if err := encodeOgg(ctx, config, wavPath, oggPath); err != nil {
+			return fmt.Errorf("error converting %s to OGG: %w", stem, err)
+		}
 	}
+	return nil
+}
 
-	// Convert no_vocals 48k WAV to OGG
-	fmt.Println("Converting no_vocals to OGG format...")
-	cmd = exec.Command("./function/ogg/wav2ogg", "-i", filepath.Join(config.OutputDir, "htdemucs", config.Filename, "vocals_48k.wav"), "-b", "48k", "-m")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// encodeOgg encodes a WAV stem to Ogg/Opus in process when the binary was built with the
+// libopus binding, and with ffmpeg's libopus encoder otherwise
+func encodeOgg(ctx context.Context, config Config, wavPath, oggPath string) error {
+	if audio.OpusAvailable {
+		return audio.EncodeOggOpus(ctx, wavPath, oggPath, config.Ogg)
+	}
+	if err := config.Ogg.Validate(); err != nil {
+		return err
+	}
 
-	return cmd.Run()
+	// Written under a temporary name so a failed attempt never leaves a partial stem
+	tmpPath := oggPath + ".tmp"
+	defer os.Remove(tmpPath)
+	cmd := newCommand(ctx, config.Tools.FFmpegPath, "-y", "-i", wavPath, "-vn",
+		"-c:a", "libopus", "-b:a", strconv.Itoa(config.Ogg.Bitrate),
+		"-ac", strconv.Itoa(config.Ogg.Channels), "-ar", "48000", "-f", "ogg", tmpPath)
+	if err := runCommand(cmd); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, oggPath)
 }
 
-func generateTimestamps(config Config) error {
+func generateTimestamps(ctx context.Context, config Config) error {
 	// Change to MFA directory
 	fmt.Println("Generating timestamp file...")
-	fmt.Println(config.Filename)
 
-	// Check if input file exists
-	vocalsSrc := filepath.Join(config.OutputDir, "htdemucs", config.Filename, "vocals_48k.wav")
-	if _, err := os.Stat(vocalsSrc); os.IsNotExist(err) {
-		return fmt.Errorf("vocals file not found at %s: %w", vocalsSrc, err)
-	}
+	inputDir := config.Workspace.InputDir()
+	timestampDir := config.Workspace.TimestampDir()
+	vocalsSrc := filepath.Join(config.Workspace.StemsDir(config.Filename), "vocals_48k.wav")
 
 	// Move files to input_files directory
-	vocalsDest := filepath.Join("./function/input", fmt.Sprintf("%s.wav", config.Filename))
+	vocalsDest := filepath.Join(inputDir, fmt.Sprintf("%s.wav", config.Filename))
 
 	// Create input directory if it doesn't exist
-	if err := os.MkdirAll("./function/input", 0755); err != nil {
+	if err := os.MkdirAll(inputDir, 0755); err != nil {
 		return fmt.Errorf("error creating input directory: %w", err)
 	}
 
-	// If destination file already exists, remove it
-	if _, err := os.Stat(vocalsDest); err == nil {
-		if err := os.Remove(vocalsDest); err != nil {
-			return fmt.Errorf("error removing existing destination file: %w", err)
+	// Check if input file exists. A retried attempt finds it already moved to the input directory.
+	if _, err := os.Stat(vocalsSrc); err == nil {
+		// If destination file already exists, remove it
+		if _, err := os.Stat(vocalsDest); err == nil {
+			if err := os.Remove(vocalsDest); err != nil {
+				return fmt.Errorf("error removing existing destination file: %w", err)
+			}
 		}
-	}
-
-	if err := os.Rename(vocalsSrc, vocalsDest); err != nil {
-		return fmt.Errorf("error moving vocals input_files: %w", err)
-	}
 
-	// Check if MP3 file exists before attempting to remove it
-	mp3Path := filepath.Join("./function/input", fmt.Sprintf("%s.mp3", config.Filename))
-	if _, err := os.Stat(mp3Path); err == nil {
-		if err := os.Remove(mp3Path); err != nil {
-			return fmt.Errorf("error deleting vocals input_files: %w", err)
+		if err := os.Rename(vocalsSrc, vocalsDest); err != nil {
+			return fmt.Errorf("error moving vocals input_files: %w", err)
 		}
+	} else if _, destErr := os.Stat(vocalsDest); destErr != nil {
+		return fmt.Errorf("vocals file not found at %s: %w", vocalsSrc, err)
 	}
 
-	// Dynamically determine conda path instead of hardcoding
-	condaBasePath := "/home/user/miniconda3"
-	// Check common locations for conda
-	condaPaths := []string{
-		"/home/user/miniconda3/bin/conda",
-		"/Users/mac/miniconda3/bin/conda", // MacOS path
-		"/usr/local/miniconda3/bin/conda",
-		os.ExpandEnv("$HOME/miniconda3/bin/conda"),
-	}
-
-	var condaPath string
-	for _, path := range condaPaths {
-		if _, err := os.Stat(path); err == nil {
-			condaPath = path
-			condaBasePath = filepath.Dir(filepath.Dir(path))
-			break
+	// Sessions created before uploads got their own directory keep the upload in the corpus,
+	// where MFA would take it for a second recording
+	if filepath.Dir(config.InputAudioFile) == filepath.Clean(inputDir) {
+		if err := os.Remove(config.InputAudioFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing the upload from the MFA corpus: %w", err)
 		}
 	}
 
-	if condaPath == "" {
-		return fmt.Errorf("conda executable not found in common locations")
+	condaPath, err := config.Tools.FindConda()
+	if err != nil {
+		return err
 	}
 	fmt.Println("Using conda at:", condaPath)
 
 	// Check if mfa environment exists
-	cmd := exec.Command(condaPath, "env", "list")
+	cmd := newCommand(ctx, condaPath, "env", "list")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to list conda environments: %w", err)
 	}
-	if !strings.Contains(out.String(), "mfa") {
-		return fmt.Errorf("conda environment 'mfa' not found, please create it first")
-	}
-
-	// Check if mandarin_mfa dictionary and acoustic model exist
-	checkCmd := fmt.Sprintf(
-		"source %q/etc/profile.d/conda.sh && conda activate mfa && mfa models list dictionary",
-		condaBasePath,
-	)
-	cmd = exec.Command("bash", "-c", checkCmd)
-	var checkOut, checkErr bytes.Buffer
-	cmd.Stdout = &checkOut
-	cmd.Stderr = &checkErr
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("PATH=%s/bin:%s", condaBasePath, os.Getenv("PATH")),
-		fmt.Sprintf("HOME=%s", os.Getenv("HOME")),
-	)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to check MFA models: %w\nStderr: %s", err, checkErr.String())
-	}
-	//mandarin_mfa
-	//mandarin_mfa
-	// If mandarin_mfa is not found, download it
-	if !strings.Contains(checkOut.String(), "mandarin_mfa") {
-		fmt.Println("mandarin_mfa not found, downloading models...")
-		downloadCmd := fmt.Sprintf(
-			"source %q/etc/profile.d/conda.sh && conda activate mfa && mfa model download dictionary mandarin_mfa && mfa model download acoustic mandarin_mfa",
-			condaBasePath,
-		)
-		cmd = exec.Command("bash", "-c", downloadCmd)
-		var dlOut, dlErr bytes.Buffer
-		cmd.Stdout = &dlOut
-		cmd.Stderr = &dlErr
-		cmd.Env = append(os.Environ(),
-			fmt.Sprintf("PATH=%s/bin:%s", condaBasePath, os.Getenv("PATH")),
-			fmt.Sprintf("HOME=%s", os.Getenv("HOME")),
-		)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to download mandarin_mfa models: %w\nStdout: %s\nStderr: %s", err, dlOut.String(), dlErr.String())
-		}
-		fmt.Println("mandarin_mfa models downloaded successfully")
+	if !strings.Contains(out.String(), config.Tools.MFAEnv) {
+		return fmt.Errorf("conda environment '%s' not found, please create it first", config.Tools.MFAEnv)
 	}
 
 	// Check if input directory has files
-	entries, err := os.ReadDir("./function/input")
+	entries, err := os.ReadDir(inputDir)
 	if err != nil {
 		return fmt.Errorf("error reading input directory: %w", err)
 	}
@@ -310,50 +353,40 @@ func generateTimestamps(config Config) error {
 	}
 
 	// Create output directory if it doesn't exist
-	if err := os.MkdirAll("./function/output", 0755); err != nil {
+	if err := os.MkdirAll(timestampDir, 0755); err != nil {
 		return fmt.Errorf("error creating output directory: %w", err)
 	}
-	fmt.Printf(
-		"source %q/etc/profile.d/conda.sh && conda activate mfa && mfa models list dictionary && mfa align ./function/input %s %s ./function/timestamp_output --beam 100 --retry_beam 400 --clean\n",
-		condaBasePath,
-		dic[config.language].dictionary,
-		dic[config.language].acoustic,
-	)
 
-	// Prepare the MFA command with debug output
-	mfaCmd := fmt.Sprintf(
-		"source %q/etc/profile.d/conda.sh && conda activate mfa && mfa models list dictionary && mfa align ./function/input %s %s ./function/timestamp_output --beam 100 --retry_beam 400 --clean",
-		condaBasePath,
+	// Prepare the MFA command; every path is its own argument so no shell ever parses it
+	mfaArgs := []string{
+		"align", inputDir,
 		dic[config.language].dictionary,
 		dic[config.language].acoustic,
-	)
-
-	// Execute the command in a bash shell
-	cmd = exec.Command("bash", "-c", mfaCmd)
+		timestampDir,
+		"--temporary_directory", config.Workspace.MFATempDir(),
+		"--beam", "100",
+		"--retry_beam", "400",
+		"--clean",
+	}
+	fmt.Println("mfa", strings.Join(mfaArgs, " "))
 
-	// Set environment to include conda bin directory and HOME
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		homeDir = "/home/user"
+	cmd, err = config.Tools.condaCommand(ctx, config.Tools.MFAEnv, "mfa", mfaArgs...)
+	if err != nil {
+		return err
 	}
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("PATH=%s/bin:%s", condaBasePath, os.Getenv("PATH")),
-		fmt.Sprintf("HOME=%s", homeDir),
-	)
 
-	// Capture both stdout and stderr for better debugging
-	var stdout, stderr bytes.Buffer
+	// Capture stdout for debugging, stderr is streamed and its tail kept for error reports
+	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
 
 	// Run the command
-	err = cmd.Run()
+	err = runCommand(cmd)
 	if err != nil {
-		return fmt.Errorf("failed to run MFA align: %w\nStdout: %s\nStderr: %s", err, stdout.String(), stderr.String())
+		return fmt.Errorf("failed to run MFA align: %w\nStdout: %s", err, stdout.String())
 	}
 
 	// Verify output files were created
-	outputFiles, err := os.ReadDir("./function/output")
+	outputFiles, err := os.ReadDir(timestampDir)
 	if err != nil {
 		return fmt.Errorf("error reading output directory: %w", err)
 	}
@@ -365,26 +398,30 @@ func generateTimestamps(config Config) error {
 	fmt.Println("Output:", stdout.String())
 
 	if err := TextGridToJSON(
-		filepath.Join("./function/timestamp_output", fmt.Sprintf("%s.TextGrid", config.Filename)),
-		filepath.Join("./function/input", fmt.Sprintf("%s.lab", config.Filename)),
-		filepath.Join("./function/timestamp_output", "output.json"),
+		filepath.Join(timestampDir, fmt.Sprintf("%s.TextGrid", config.Filename)),
+		filepath.Join(inputDir, fmt.Sprintf("%s.lab", config.Filename)),
+		filepath.Join(timestampDir, "output.json"),
 	); err != nil {
 		return fmt.Errorf("error converting TextGrid to JSON: %w", err)
 	}
 
-	pythonScriptSrc := filepath.Join("./function/vocal_pitch_analyzer.py")
+	return nil
+}
 
-	cmd = exec.Command("bash", "-c", fmt.Sprintf(
-		"python %s %s %s --output %s --log %s --quiet",
-		pythonScriptSrc,
-		filepath.Join("./function/timestamp_output", "output.json"),
-		vocalsDest,
-		filepath.Join("./function/timestamp_output", "output_with_notes.json"),
-		filepath.Join("./function/timestamp_output", "pitch_analysis_log.json")))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// analyzePitch detects the MIDI note of every aligned word from the 48kHz vocals
+func analyzePitch(ctx context.Context, config Config) error {
+	timestampDir := config.Workspace.TimestampDir()
+	vocalsWav := filepath.Join(config.Workspace.InputDir(), fmt.Sprintf("%s.wav", config.Filename))
 
-	if err := cmd.Run(); err != nil {
+	cmd := newCommand(ctx, config.Tools.PythonPath,
+		config.Tools.PitchAnalyzerScript,
+		filepath.Join(timestampDir, "output.json"),
+		vocalsWav,
+		"--output", filepath.Join(timestampDir, "output_with_notes.json"),
+		"--log", filepath.Join(timestampDir, "pitch_analysis_log.json"),
+		"--quiet")
+
+	if err := runCommand(cmd); err != nil {
 		return fmt.Errorf("error running vocal_pitch_analyzer.py: %w", err)
 	}
 
@@ -0,0 +1,310 @@
+package function
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"karaoke_generator/progress"
+)
+
+// StemCacheOptions locates and bounds the stem cache
+type StemCacheOptions struct {
+	// Dir is where separated stems are cached, one directory per audio content hash
+	Dir string
+	// MaxBytes bounds the total size of the cache; least recently used entries are evicted first.
+	// Zero disables the cache.
+	MaxBytes int64
+}
+
+// DefaultStemCacheOptions keep up to 10 GiB of stems
+var DefaultStemCacheOptions = StemCacheOptions{Dir: "./function/cache", MaxBytes: 10 << 30}
+
+// cachedStemFile is a file of a stems directory worth keeping, and the directory of the cache
+// entry it is kept in
+type cachedStemFile struct {
+	name string
+	dir  string
+}
+
+// cachedStemFiles are the Demucs stems and their derivatives. The stems only depend on the audio
+// and sit at the root of the entry, while the derivatives are kept in a directory named after
+// the resample quality and Opus options they were made with, so a configuration change never
+// restores stale files.
+func cachedStemFiles(config Config) []cachedStemFile {
+	resampled := "resample_" + string(resampleQuality(config))
+	encoded := fmt.Sprintf("%s_opus_%d_%d", resampled, config.Ogg.Bitrate, config.Ogg.Channels)
+	return []cachedStemFile{
+		{name: "vocals.wav"},
+		{name: "no_vocals.wav"},
+		{name: "vocals_48k.wav", dir: resampled},
+		{name: "no_vocals_48k.wav", dir: resampled},
+		{name: "vocals_48k_48k.ogg", dir: encoded},
+		{name: "no_vocals_48k_48k.ogg", dir: encoded},
+	}
+}
+
+// stemCacheMutex guards the cache entries for renames, evictions and the pins; it is never held
+// while stems are copied
+var stemCacheMutex sync.Mutex
+
+// stemCachePins counts the restores reading each entry, keyed by entry path, which eviction
+// must not delete
+var stemCachePins = make(map[string]int)
+
+// hashFile returns the hex SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// restoreCachedStems copies every cached file of the song into the workspace stems
+// directory, so the separation, resampling and encoding steps can be skipped.
+// Nothing is restored unless both Demucs stems are cached.
+func restoreCachedStems(ctx context.Context, config Config) error {
+	if config.AudioHash == "" || config.Cache.MaxBytes <= 0 {
+		return nil
+	}
+
+	entryDir := filepath.Join(config.Cache.Dir, config.AudioHash)
+	stemCacheMutex.Lock()
+	for _, name := range []string{"vocals.wav", "no_vocals.wav"} {
+		if _, err := os.Stat(filepath.Join(entryDir, name)); err != nil {
+			stemCacheMutex.Unlock()
+			progress.AddHistory(config.SessionID, StepCacheLookup, "stem cache miss")
+			return nil
+		}
+	}
+	// Touching the entry marks it as recently used for the LRU eviction, and pinning it keeps
+	// it from being evicted while it is copied outside the lock
+	now := time.Now()
+	os.Chtimes(entryDir, now, now)
+	stemCachePins[entryDir]++
+	stemCacheMutex.Unlock()
+	defer unpinStemCacheEntry(entryDir)
+
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	if err := os.MkdirAll(stemsDir, 0755); err != nil {
+		return fmt.Errorf("error creating stems directory: %w", err)
+	}
+
+	var restored []string
+	for _, file := range cachedStemFiles(config) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src := filepath.Join(entryDir, file.dir, file.name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		// Copy then rename so the skip checks never see a partially restored file
+		dst := filepath.Join(stemsDir, file.name)
+		if err := copyFile(src, dst+".tmp"); err != nil {
+			os.Remove(dst + ".tmp")
+			return fmt.Errorf("error restoring %s from stem cache: %w", file.name, err)
+		}
+		if err := os.Rename(dst+".tmp", dst); err != nil {
+			return fmt.Errorf("error restoring %s from stem cache: %w", file.name, err)
+		}
+		restored = append(restored, file.name)
+	}
+
+	progress.ReportCacheHit(config.SessionID, StepCacheLookup,
+		fmt.Sprintf("Stem cache hit: reusing %d cached files", len(restored)))
+	return nil
+}
+
+// unpinStemCacheEntry releases an entry pinned by restoreCachedStems
+func unpinStemCacheEntry(entryDir string) {
+	stemCacheMutex.Lock()
+	defer stemCacheMutex.Unlock()
+	if stemCachePins[entryDir]--; stemCachePins[entryDir] <= 0 {
+		delete(stemCachePins, entryDir)
+	}
+}
+
+// storeCachedStems adds the stems and derivatives present in the workspace to the cache
+// entry of the song, then evicts old entries until the cache fits its MaxBytes.
+// The files are copied to staging files in the cache directory without holding the lock,
+// and only renamed into the entry under it.
+func storeCachedStems(ctx context.Context, config Config) error {
+	if config.AudioHash == "" || config.Cache.MaxBytes <= 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(config.Cache.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating stem cache: %w", err)
+	}
+
+	type stagedFile struct {
+		name string
+		tmp  string
+		dst  string
+	}
+	var staged []stagedFile
+	// Staging files that were not renamed into the entry are removed
+	defer func() {
+		for _, file := range staged {
+			os.Remove(file.tmp)
+		}
+	}()
+
+	entryDir := filepath.Join(config.Cache.Dir, config.AudioHash)
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	for _, file := range cachedStemFiles(config) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src := filepath.Join(stemsDir, file.name)
+		dst := filepath.Join(entryDir, file.dir, file.name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		// Staging files are plain files, which eviction never takes for an entry
+		tmp, err := os.CreateTemp(config.Cache.Dir, ".staging-*")
+		if err != nil {
+			return fmt.Errorf("error caching %s: %w", file.name, err)
+		}
+		tmp.Close()
+		staged = append(staged, stagedFile{name: file.name, tmp: tmp.Name(), dst: dst})
+		if err := copyFile(src, tmp.Name()); err != nil {
+			return fmt.Errorf("error caching %s: %w", file.name, err)
+		}
+	}
+
+	stemCacheMutex.Lock()
+	defer stemCacheMutex.Unlock()
+
+	for _, file := range staged {
+		if _, err := os.Stat(file.dst); err == nil {
+			// Another job cached the same file meanwhile
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file.dst), 0755); err != nil {
+			return fmt.Errorf("error creating stem cache entry: %w", err)
+		}
+		if err := os.Rename(file.tmp, file.dst); err != nil {
+			return fmt.Errorf("error caching %s: %w", file.name, err)
+		}
+	}
+
+	now := time.Now()
+	os.Chtimes(entryDir, now, now)
+
+	return evictStemCache(config.Cache)
+}
+
+// evictStemCache deletes the least recently used entries until the cache is at most MaxBytes,
+// leaving pinned entries alone; must be called with stemCacheMutex held
+func evictStemCache(cache StemCacheOptions) error {
+	entries, err := os.ReadDir(cache.Dir)
+	if err != nil {
+		return fmt.Errorf("error reading stem cache: %w", err)
+	}
+
+	type cacheEntry struct {
+		path   string
+		size   int64
+		usedAt time.Time
+	}
+
+	var all []cacheEntry
+	var total int64
+	for _, entry := range entries {
+		path := filepath.Join(cache.Dir, entry.Name())
+		if !entry.IsDir() || stemCachePins[path] > 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size := directorySize(path)
+		all = append(all, cacheEntry{path: path, size: size, usedAt: info.ModTime()})
+		total += size
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].usedAt.Before(all[j].usedAt)
+	})
+
+	for _, entry := range all {
+		if total <= cache.MaxBytes {
+			break
+		}
+		if err := os.RemoveAll(entry.path); err != nil {
+			return fmt.Errorf("error evicting stem cache entry: %w", err)
+		}
+		fmt.Printf("Evicted stem cache entry %s (%d bytes)\n", filepath.Base(entry.path), entry.size)
+		total -= entry.size
+	}
+
+	return nil
+}
+
+// bestEffort adapts an optional step, such as caching, so that its failure, including running
+// past its step timeout, is only logged in the session history instead of failing the whole job
+func bestEffort(name string, run func(ctx context.Context, config Config) error) func(ctx context.Context, config Config) error {
+	return func(ctx context.Context, config Config) error {
+		if err := run(ctx, config); err != nil {
+			// A cancelled job must still stop
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return err
+			}
+			progress.AddHistory(config.SessionID, name, fmt.Sprintf("ignored error: %v", err))
+		}
+		return nil
+	}
+}
+
+// directorySize returns the total size of the regular files below dir
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// copyFile copies src to dst, replacing dst if it exists
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,335 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"karaoke_generator/audio"
+)
+
+// stemCacheConfig returns a job config whose workspace and stem cache live in a temp dir
+func stemCacheConfig(t *testing.T, root string) Config {
+	t.Helper()
+	return Config{
+		SessionID: "stem-cache-" + filepath.Base(root),
+		Workspace: Workspace{Root: filepath.Join(root, "workspace")},
+		Filename:  "song",
+		AudioHash: "0123abcd",
+		Cache:     StemCacheOptions{Dir: filepath.Join(root, "cache"), MaxBytes: 1 << 20},
+		Ogg:       DefaultOggOptions,
+		Resample:  audio.ResampleHigh,
+	}
+}
+
+// writeStems fills the workspace stems directory with every cached file, each holding its name
+func writeStems(t *testing.T, config Config) {
+	t.Helper()
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	if err := os.MkdirAll(stemsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range cachedStemFiles(config) {
+		if err := os.WriteFile(filepath.Join(stemsDir, file.name), []byte(file.name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// restoredStems returns the files of the workspace stems directory
+func restoredStems(t *testing.T, config Config) map[string]bool {
+	t.Helper()
+	entries, err := os.ReadDir(config.Workspace.StemsDir(config.Filename))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		files[entry.Name()] = true
+	}
+	return files
+}
+
+func TestStemCacheMiss(t *testing.T) {
+	config := stemCacheConfig(t, t.TempDir())
+	if err := restoreCachedStems(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if files := restoredStems(t, config); len(files) != 0 {
+		t.Errorf("a miss restored %v", files)
+	}
+
+	// Derivatives alone are no hit: the separation would still have to run
+	entryDir := filepath.Join(config.Cache.Dir, config.AudioHash)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, "vocals.wav"), []byte("vocals"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreCachedStems(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if files := restoredStems(t, config); len(files) != 0 {
+		t.Errorf("an entry without no_vocals.wav restored %v", files)
+	}
+}
+
+func TestStemCacheHit(t *testing.T) {
+	root := t.TempDir()
+	stored := stemCacheConfig(t, root)
+	writeStems(t, stored)
+	if err := storeCachedStems(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another session uploading the same audio
+	config := stored
+	config.Workspace = Workspace{Root: filepath.Join(root, "other")}
+	if err := restoreCachedStems(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	stemsDir := config.Workspace.StemsDir(config.Filename)
+	for _, file := range cachedStemFiles(config) {
+		content, err := os.ReadFile(filepath.Join(stemsDir, file.name))
+		if err != nil {
+			t.Errorf("%s was not restored: %v", file.name, err)
+		} else if string(content) != file.name {
+			t.Errorf("%s was restored as %q", file.name, content)
+		}
+	}
+	if files := restoredStems(t, config); len(files) != len(cachedStemFiles(config)) {
+		t.Errorf("restored %v, want only the cached files", files)
+	}
+	if len(stemCachePins) != 0 {
+		t.Errorf("entries are still pinned after the restore: %v", stemCachePins)
+	}
+}
+
+func TestStemCacheDerivativeKeys(t *testing.T) {
+	root := t.TempDir()
+	stored := stemCacheConfig(t, root)
+	writeStems(t, stored)
+	if err := storeCachedStems(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	stems := []string{"vocals.wav", "no_vocals.wav"}
+	resampled := []string{"vocals_48k.wav", "no_vocals_48k.wav"}
+	encoded := []string{"vocals_48k_48k.ogg", "no_vocals_48k_48k.ogg"}
+	tests := []struct {
+		name     string
+		resample audio.ResampleQuality
+		ogg      audio.OpusOptions
+		want     [][]string
+	}{
+		{"same", audio.ResampleHigh, DefaultOggOptions, [][]string{stems, resampled, encoded}},
+		{"bitrate", audio.ResampleHigh, audio.OpusOptions{Bitrate: 96000, Channels: 1}, [][]string{stems, resampled}},
+		{"channels", audio.ResampleHigh, audio.OpusOptions{Bitrate: 48000, Channels: 2}, [][]string{stems, resampled}},
+		// The Opus files were encoded from the resampled stems, so they depend on the quality too
+		{"quality", audio.ResampleLow, DefaultOggOptions, [][]string{stems}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := stored
+			config.Workspace = Workspace{Root: filepath.Join(root, test.name)}
+			config.Resample = test.resample
+			config.Ogg = test.ogg
+			if err := restoreCachedStems(context.Background(), config); err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[string]bool)
+			for _, names := range test.want {
+				for _, name := range names {
+					want[name] = true
+				}
+			}
+			got := restoredStems(t, config)
+			if len(got) != len(want) {
+				t.Errorf("restored %v, want %v", got, want)
+			}
+			for name := range want {
+				if !got[name] {
+					t.Errorf("%s was not restored", name)
+				}
+			}
+		})
+	}
+
+	// Storing with other options adds their derivatives next to the first ones
+	config := stored
+	config.Ogg = audio.OpusOptions{Bitrate: 96000, Channels: 2}
+	writeStems(t, config)
+	if err := storeCachedStems(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	entryDir := filepath.Join(config.Cache.Dir, config.AudioHash)
+	for _, dir := range []string{"resample_high_opus_48000_1", "resample_high_opus_96000_2"} {
+		if _, err := os.Stat(filepath.Join(entryDir, dir, "vocals_48k_48k.ogg")); err != nil {
+			t.Errorf("missing derivative: %v", err)
+		}
+	}
+}
+
+func TestStemCacheDisabled(t *testing.T) {
+	config := stemCacheConfig(t, t.TempDir())
+	config.Cache.MaxBytes = 0
+	writeStems(t, config)
+	if err := storeCachedStems(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(config.Cache.Dir); !os.IsNotExist(err) {
+		t.Errorf("a disabled cache was written: %v", err)
+	}
+}
+
+// makeCacheEntry creates an entry of size bytes last used at usedAt
+func makeCacheEntry(t *testing.T, dir, name string, size int, usedAt time.Time) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Join(path, "resample_high"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Half at the root and half in a derivative directory, which counts too
+	if err := os.WriteFile(filepath.Join(path, "vocals.wav"), bytes.Repeat([]byte{1}, size/2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "resample_high", "vocals_48k.wav"), bytes.Repeat([]byte{1}, size-size/2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, usedAt, usedAt); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEvictStemCache(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		maxBytes int64
+		pinned   string
+		kept     []string
+		evicted  []string
+	}{
+		{"fits", 400, "", []string{"old", "mid", "new"}, nil},
+		{"oldest_first", 250, "", []string{"mid", "new"}, []string{"old"}},
+		{"until_fits", 150, "", []string{"new"}, []string{"old", "mid"}},
+		// A pinned entry is being restored and survives, whatever its age
+		{"pinned", 150, "old", []string{"old", "new"}, []string{"mid"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			paths := map[string]string{
+				"old": makeCacheEntry(t, dir, "old", 100, now.Add(-3*time.Hour)),
+				"new": makeCacheEntry(t, dir, "new", 100, now.Add(-1*time.Hour)),
+				"mid": makeCacheEntry(t, dir, "mid", 100, now.Add(-2*time.Hour)),
+			}
+			// A staging file of a store in progress is no entry
+			staging := filepath.Join(dir, ".staging-1")
+			if err := os.WriteFile(staging, bytes.Repeat([]byte{1}, 1000), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			stemCacheMutex.Lock()
+			if test.pinned != "" {
+				stemCachePins[paths[test.pinned]]++
+			}
+			err := evictStemCache(StemCacheOptions{Dir: dir, MaxBytes: test.maxBytes})
+			delete(stemCachePins, paths[test.pinned])
+			stemCacheMutex.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range test.kept {
+				if _, err := os.Stat(paths[name]); err != nil {
+					t.Errorf("%s was evicted", name)
+				}
+			}
+			for _, name := range test.evicted {
+				if _, err := os.Stat(paths[name]); !os.IsNotExist(err) {
+					t.Errorf("%s was kept", name)
+				}
+			}
+			if _, err := os.Stat(staging); err != nil {
+				t.Errorf("the staging file was removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestStemCacheRestoreMarksUse(t *testing.T) {
+	root := t.TempDir()
+	config := stemCacheConfig(t, root)
+	config.Cache.MaxBytes = 250
+	old := makeCacheEntry(t, config.Cache.Dir, "old", 100, time.Now().Add(-2*time.Hour))
+	makeCacheEntry(t, config.Cache.Dir, config.AudioHash, 100, time.Now().Add(-3*time.Hour))
+	if err := os.WriteFile(filepath.Join(config.Cache.Dir, config.AudioHash, "no_vocals.wav"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring the oldest entry makes it the most recently used one
+	if err := restoreCachedStems(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if !restoredStems(t, config)["no_vocals.wav"] {
+		t.Fatal("the entry was not restored")
+	}
+
+	// A third entry pushes the cache over its limit, which evicts "old" rather than the restored one
+	other := config
+	other.AudioHash = "4567cdef"
+	other.Workspace = Workspace{Root: filepath.Join(root, "other")}
+	stemsDir := other.Workspace.StemsDir(other.Filename)
+	if err := os.MkdirAll(stemsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"vocals.wav", "no_vocals.wav"} {
+		if err := os.WriteFile(filepath.Join(stemsDir, name), bytes.Repeat([]byte{1}, 40), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storeCachedStems(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("the least recently used entry was kept: %v", err)
+	}
+	for _, hash := range []string{config.AudioHash, other.AudioHash} {
+		if _, err := os.Stat(filepath.Join(config.Cache.Dir, hash)); err != nil {
+			t.Errorf("entry %s was evicted: %v", hash, err)
+		}
+	}
+}
+
+func TestBestEffortTimeout(t *testing.T) {
+	hang := bestEffort(StepCacheStore, func(ctx context.Context, config Config) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	policy := defaultStepPolicies[StepCacheStore]
+	policy.Timeout = 10 * time.Millisecond
+
+	// A cache copy that runs past its timeout is given up, the job goes on
+	err := runStep(context.Background(), policy, "best-effort-timeout", StepCacheStore, ErrCodeStepFailed, func(ctx context.Context) error {
+		return hang(ctx, Config{SessionID: "best-effort-timeout"})
+	})
+	if err != nil {
+		t.Errorf("timed out cache step failed the job: %v", err)
+	}
+
+	// A cancelled job still stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = runStep(ctx, policy, "best-effort-cancel", StepCacheStore, ErrCodeStepFailed, func(ctx context.Context) error {
+		return hang(ctx, Config{SessionID: "best-effort-cancel"})
+	})
+	if err == nil {
+		t.Error("cancelled cache step returned no error")
+	}
+}
@@ -0,0 +1,72 @@
+package function
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error codes reported to the client when a pipeline step fails
+const (
+	ErrCodeWorkspace     = "WORKSPACE_ERROR"
+	ErrCodeSeparation    = "SEPARATION_FAILED"
+	ErrCodeResample      = "RESAMPLE_FAILED"
+	ErrCodeOggEncode     = "OGG_ENCODE_FAILED"
+	ErrCodeAlignment     = "ALIGNMENT_FAILED"
+	ErrCodePitchAnalysis = "PITCH_ANALYSIS_FAILED"
+	ErrCodeOutputEncode  = "OUTPUT_ENCODE_FAILED"
+	ErrCodeArchive       = "ARCHIVE_FAILED"
+	ErrCodeLyricsExport  = "LYRICS_EXPORT_FAILED"
+	ErrCodeTimeout       = "STEP_TIMEOUT"
+)
+
+// Names of the pipeline steps, used in progress reports and error details
+const (
+	StepCacheLookup   = "stem_cache_lookup"
+	StepSeparation    = "separation"
+	StepResample      = "resample"
+	StepOggEncode     = "ogg_encode"
+	StepAlignment     = "alignment"
+	StepPitchAnalysis = "pitch_analysis"
+	StepCacheStore    = "stem_cache_store"
+	StepOutputEncode  = "output_profiles"
+	StepArchive       = "archive"
+	StepLyricsExport  = "lyrics_export"
+)
+
+// StepError describes which pipeline step failed and why
+type StepError struct {
+	Step       string
+	Code       string
+	StderrTail string
+	Err        error
+	// Attempt is the attempt that failed, out of Attempts allowed by the step policy
+	Attempt  int
+	Attempts int
+}
+
+func (e *StepError) Error() string {
+	if e.Attempts > 0 {
+		return fmt.Sprintf("%s failed on attempt %d/%d: %v", e.Step, e.Attempt, e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// stepFailed wraps err into a StepError, keeping the stderr tail of a failed tool.
+// An error that already carries a StepError returns that StepError.
+func stepFailed(step, code string, err error) *StepError {
+	var stepErr *StepError
+	if errors.As(err, &stepErr) {
+		return stepErr
+	}
+
+	stepErr = &StepError{Step: step, Code: code, Err: err}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		stepErr.StderrTail = cmdErr.StderrTail
+	}
+	return stepErr
+}
@@ -0,0 +1,104 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"karaoke_generator/progress"
+)
+
+// StepPolicy controls how long a pipeline step may run and how often it is retried
+type StepPolicy struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// defaultStepPolicies holds the policy of every pipeline step, keyed by step name
+var defaultStepPolicies = map[string]StepPolicy{
+	// Copying the stems in or out of the cache is best effort: a hung copy must not hold the
+	// worker, and the job can always fall back to separating the song again
+	StepCacheLookup:   {Timeout: 5 * time.Minute, Retries: 0},
+	StepSeparation:    {Timeout: 30 * time.Minute, Retries: 1},
+	StepResample:      {Timeout: 5 * time.Minute, Retries: 1},
+	StepOggEncode:     {Timeout: 5 * time.Minute, Retries: 1},
+	StepCacheStore:    {Timeout: 5 * time.Minute, Retries: 0},
+	StepAlignment:     {Timeout: 30 * time.Minute, Retries: 1},
+	StepPitchAnalysis: {Timeout: 10 * time.Minute, Retries: 1},
+	StepOutputEncode:  {Timeout: 10 * time.Minute, Retries: 1},
+	StepArchive:       {Timeout: time.Minute, Retries: 0},
+	StepLyricsExport:  {Timeout: time.Minute, Retries: 0},
+}
+
+// DefaultStepPolicies returns a copy of the policy of every pipeline step, keyed by step name
+func DefaultStepPolicies() map[string]StepPolicy {
+	policies := make(map[string]StepPolicy, len(defaultStepPolicies))
+	for name, policy := range defaultStepPolicies {
+		policies[name] = policy
+	}
+	return policies
+}
+
+// stepPolicy returns the policy a job runs a step with, falling back to the default
+// policy of steps the job options don't set
+func (c Config) stepPolicy(step string) StepPolicy {
+	if policy, ok := c.StepPolicies[step]; ok {
+		return policy
+	}
+	return defaultStepPolicies[step]
+}
+
+// retryable reports whether a failed attempt may succeed when run again: only timeouts
+// and external tools exiting with a non-zero status are. Anything else, like a missing
+// input file or a tool that can't be started, fails the same way every time.
+func retryable(err error, timedOut bool) bool {
+	if timedOut {
+		return true
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
+
+// runStep runs a pipeline step under the timeout of policy, retrying attempts that failed
+// with a retryable error as allowed by it. Every retry is logged into the session history
+// and the returned StepError names the attempt that failed last.
+func runStep(ctx context.Context, policy StepPolicy, sessionID, step, code string, run func(ctx context.Context) error) error {
+	attempts := policy.Retries + 1
+
+	var stepErr *StepError
+	for attempt := 1; attempt <= attempts; attempt++ {
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if policy.Timeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		}
+		err := run(stepCtx)
+		timedOut := errors.Is(stepCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if timedOut {
+			err = fmt.Errorf("timed out after %s: %w", policy.Timeout, err)
+		}
+		stepErr = stepFailed(step, code, err)
+		if timedOut {
+			stepErr.Code = ErrCodeTimeout
+		}
+		stepErr.Attempt = attempt
+		stepErr.Attempts = attempts
+
+		// A cancelled job must stop right away
+		if ctx.Err() != nil || !retryable(err, timedOut) {
+			return stepErr
+		}
+
+		if attempt < attempts {
+			progress.AddHistory(sessionID, step, fmt.Sprintf("attempt %d/%d failed, retrying: %v", attempt, attempts, err))
+		}
+	}
+
+	return stepErr
+}
@@ -0,0 +1,153 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// toolExit returns the error of an external tool exiting with a non-zero status
+func toolExit(t *testing.T) error {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", "echo broken >&2; exit 3")
+	cmd.Stderr = io.Discard
+	err := runCommand(cmd)
+	if err == nil {
+		t.Fatal("sh exited with status 0")
+	}
+	return err
+}
+
+func TestRunStepRetries(t *testing.T) {
+	exitErr := toolExit(t)
+	policy := StepPolicy{Timeout: time.Minute, Retries: 2}
+
+	tests := []struct {
+		name      string
+		run       func(ctx context.Context, attempt int) error
+		calls     int
+		code      string
+		succeeded bool
+	}{
+		{
+			name:  "permanent error",
+			run:   func(ctx context.Context, attempt int) error { return errors.New("input file missing") },
+			calls: 1,
+			code:  ErrCodeSeparation,
+		},
+		{
+			name: "tool not started",
+			run: func(ctx context.Context, attempt int) error {
+				return runCommand(exec.Command("/nonexistent/separate"))
+			},
+			calls: 1,
+			code:  ErrCodeSeparation,
+		},
+		{
+			name:  "tool exit",
+			run:   func(ctx context.Context, attempt int) error { return exitErr },
+			calls: 3,
+			code:  ErrCodeSeparation,
+		},
+		{
+			name: "tool exit then success",
+			run: func(ctx context.Context, attempt int) error {
+				if attempt == 1 {
+					return exitErr
+				}
+				return nil
+			},
+			calls:     2,
+			succeeded: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := runStep(context.Background(), policy, "run-step-retries", StepSeparation, ErrCodeSeparation, func(ctx context.Context) error {
+				calls++
+				return test.run(ctx, calls)
+			})
+			if calls != test.calls {
+				t.Errorf("ran %d attempts, want %d", calls, test.calls)
+			}
+			if test.succeeded {
+				if err != nil {
+					t.Errorf("step failed: %v", err)
+				}
+				return
+			}
+
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("got %v, want a StepError", err)
+			}
+			if stepErr.Step != StepSeparation || stepErr.Code != test.code {
+				t.Errorf("step %q code %q, want %q %q", stepErr.Step, stepErr.Code, StepSeparation, test.code)
+			}
+			if stepErr.Attempt != test.calls || stepErr.Attempts != 3 {
+				t.Errorf("attempt %d/%d, want %d/3", stepErr.Attempt, stepErr.Attempts, test.calls)
+			}
+		})
+	}
+}
+
+func TestRunStepStderrTail(t *testing.T) {
+	exitErr := toolExit(t)
+	err := runStep(context.Background(), StepPolicy{}, "run-step-stderr", StepResample, ErrCodeResample, func(ctx context.Context) error {
+		return exitErr
+	})
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.StderrTail != "broken" {
+		t.Errorf("got %#v, want the stderr tail of the tool", err)
+	}
+}
+
+func TestRunStepTimeout(t *testing.T) {
+	policy := StepPolicy{Timeout: 10 * time.Millisecond, Retries: 1}
+	calls := 0
+	err := runStep(context.Background(), policy, "run-step-timeout", StepAlignment, ErrCodeAlignment, func(ctx context.Context) error {
+		calls++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// A timed out attempt is retried, the last one reports the timeout
+	if calls != 2 {
+		t.Errorf("ran %d attempts, want 2", calls)
+	}
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		t.Fatalf("got %v, want a StepError", err)
+	}
+	if stepErr.Code != ErrCodeTimeout || stepErr.Step != StepAlignment {
+		t.Errorf("step %q code %q, want %q %q", stepErr.Step, stepErr.Code, StepAlignment, ErrCodeTimeout)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("%v doesn't wrap the deadline", err)
+	}
+}
+
+func TestRunStepParentCancel(t *testing.T) {
+	exitErr := toolExit(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	err := runStep(ctx, StepPolicy{Timeout: time.Minute, Retries: 3}, "run-step-cancel", StepSeparation, ErrCodeSeparation, func(ctx context.Context) error {
+		calls++
+		// The job is cancelled while the tool runs, the tool then dies with a non-zero exit
+		cancel()
+		return exitErr
+	})
+	if calls != 1 {
+		t.Errorf("ran %d attempts after the job was cancelled, want 1", calls)
+	}
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Code != ErrCodeSeparation {
+		t.Errorf("got %v, want a %s StepError", err, ErrCodeSeparation)
+	}
+}
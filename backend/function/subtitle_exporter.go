@@ -0,0 +1,87 @@
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// RenderSRT renders lyrics as SubRip subtitles, one cue per segment
+func RenderSRT(lyrics *LyricsJSON, metadata LyricsMetadata) []byte {
+	var buf bytes.Buffer
+	offset := float64(metadata.OffsetMs) / 1000
+	for i, segment := range lyrics.Segments {
+		start, end := cueTimes(segment, offset)
+		fmt.Fprintf(&buf, "%d\n%s --> %s\n%s\n\n", i+1,
+			subtitleTime(start, ","), subtitleTime(end, ","), singleLine(segment.Text))
+	}
+	return buf.Bytes()
+}
+
+// RenderWebVTT renders lyrics as WebVTT, one cue per segment. With words, every word after the
+// first is preceded by an inline <hh:mm:ss.ttt> timestamp, so a page can highlight the sung
+// words with the ::cue(:past) and ::cue(:future) selectors.
+func RenderWebVTT(lyrics *LyricsJSON, metadata LyricsMetadata, words bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT")
+	if title := singleLine(metadata.Title); title != "" && !strings.Contains(title, "-->") {
+		buf.WriteString(" - " + title)
+	}
+	buf.WriteString("\n\n")
+
+	offset := float64(metadata.OffsetMs) / 1000
+	for i, segment := range lyrics.Segments {
+		start, end := cueTimes(segment, offset)
+		fmt.Fprintf(&buf, "%d\n%s --> %s\n", i+1, subtitleTime(start, "."), subtitleTime(end, "."))
+		if words && len(segment.Words) > 0 {
+			buf.WriteString(vttKaraoke(segment, start, end, offset))
+		} else {
+			buf.WriteString(vttText(segment.Text))
+		}
+		buf.WriteString("\n\n")
+	}
+	return buf.Bytes()
+}
+
+// vttKaraoke writes the words of a cue with a timestamp tag before each word that starts after
+// the cue does. WebVTT requires the tags to increase strictly and to fall inside the cue.
+func vttKaraoke(segment Segment, start, end, offset float64) string {
+	var text strings.Builder
+	last := millis(start)
+	for _, word := range segment.Words {
+		at := millis(word.Start - offset)
+		if at > last && at < millis(end) {
+			text.WriteString("<" + subtitleTime(float64(at)/1000, ".") + ">")
+			last = at
+		}
+		text.WriteString(vttText(word.Word))
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// cueTimes returns the shifted start and end of a segment, never before zero nor reversed
+func cueTimes(segment Segment, offset float64) (float64, float64) {
+	start := math.Max(segment.Start-offset, 0)
+	return start, math.Max(segment.End-offset, start)
+}
+
+// subtitleTime formats seconds as hh:mm:ss followed by sep and milliseconds
+func subtitleTime(seconds float64, sep string) string {
+	ms := millis(seconds)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+func millis(seconds float64) int {
+	return int(math.Round(math.Max(seconds, 0) * 1000))
+}
+
+// singleLine keeps a cue on one line; an empty line would end the cue
+func singleLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// vttText escapes the characters WebVTT reads as markup
+func vttText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\n", " ", "\r", " ").Replace(text)
+}
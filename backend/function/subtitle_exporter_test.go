@@ -0,0 +1,125 @@
+package function
+
+import "testing"
+
+func TestSubtitleTime(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		sep     string
+		want    string
+	}{
+		{0, ",", "00:00:00,000"},
+		{-1, ".", "00:00:00.000"},
+		{1.5, ",", "00:00:01,500"},
+		{59.9994, ".", "00:00:59.999"},
+		{59.9996, ",", "00:01:00,000"},
+		{3599.9996, ".", "01:00:00.000"},
+		{45296.789, ",", "12:34:56,789"},
+	}
+	for _, test := range tests {
+		if got := subtitleTime(test.seconds, test.sep); got != test.want {
+			t.Errorf("subtitleTime(%v, %q) = %q, want %q", test.seconds, test.sep, got, test.want)
+		}
+	}
+}
+
+func TestRenderSRT(t *testing.T) {
+	tests := []struct {
+		name     string
+		lyrics   *LyricsJSON
+		metadata LyricsMetadata
+		want     string
+	}{
+		{
+			name:   "cues",
+			lyrics: testLyrics(),
+			want: "1\n00:00:01,500 --> 00:00:03,250\nHello world\n\n" +
+				"2\n00:00:04,000 --> 00:00:05,500\nSing on\n\n" +
+				"3\n00:00:59,996 --> 00:01:01,004\nAgain\n\n",
+		},
+		{
+			name:     "offset",
+			lyrics:   testLyrics(),
+			metadata: LyricsMetadata{OffsetMs: 2000},
+			// A cue shifted before zero starts at zero
+			want: "1\n00:00:00,000 --> 00:00:01,250\nHello world\n\n" +
+				"2\n00:00:02,000 --> 00:00:03,500\nSing on\n\n" +
+				"3\n00:00:57,996 --> 00:00:59,004\nAgain\n\n",
+		},
+		{
+			name: "blank_lines",
+			lyrics: &LyricsJSON{Segments: []Segment{
+				{Start: 1, End: 2, Text: "two\n\nlines "},
+			}},
+			// An empty line would end the cue early
+			want: "1\n00:00:01,000 --> 00:00:02,000\ntwo lines\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(RenderSRT(test.lyrics, test.metadata)); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderWebVTT(t *testing.T) {
+	tests := []struct {
+		name     string
+		lyrics   *LyricsJSON
+		metadata LyricsMetadata
+		words    bool
+		want     string
+	}{
+		{
+			name:     "cues",
+			lyrics:   testLyrics(),
+			metadata: LyricsMetadata{Title: "Song"},
+			want: "WEBVTT - Song\n\n" +
+				"1\n00:00:01.500 --> 00:00:03.250\nHello world\n\n" +
+				"2\n00:00:04.000 --> 00:00:05.500\nSing on\n\n" +
+				"3\n00:00:59.996 --> 00:01:01.004\nAgain\n\n",
+		},
+		{
+			name:   "words",
+			lyrics: testLyrics(),
+			words:  true,
+			// The first word starts with the cue and needs no timestamp
+			want: "WEBVTT\n\n" +
+				"1\n00:00:01.500 --> 00:00:03.250\nHello<00:00:02.250> world\n\n" +
+				"2\n00:00:04.000 --> 00:00:05.500\nSing<00:00:04.500> on\n\n" +
+				"3\n00:00:59.996 --> 00:01:01.004\nAgain\n\n",
+		},
+		{
+			name: "word_order",
+			lyrics: &LyricsJSON{Segments: []Segment{
+				{Start: 1, End: 3, Text: "a b c d", Words: []WordInfo{
+					{Word: "a", Start: 1, End: 1.5},
+					{Word: " b", Start: 1.5, End: 2},
+					// Timestamps must increase strictly and stay inside the cue
+					{Word: " c", Start: 1.4, End: 2},
+					{Word: " d", Start: 3, End: 3.5},
+				}},
+			}},
+			words: true,
+			want:  "WEBVTT\n\n1\n00:00:01.000 --> 00:00:03.000\na<00:00:01.500> b c d\n\n",
+		},
+		{
+			name: "escaping",
+			lyrics: &LyricsJSON{Segments: []Segment{
+				{Start: 0, End: 1, Text: "<rock> & roll"},
+			}},
+			// A title containing the cue arrow would be read as a cue
+			metadata: LyricsMetadata{Title: "a --> b"},
+			want:     "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.000\n&lt;rock&gt; &amp; roll\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(RenderWebVTT(test.lyrics, test.metadata, test.words)); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -25,6 +25,16 @@ type WordInfo struct {
 	Word  string  `json:"word"`
 	Start float64 `json:"start"`
 	End   float64 `json:"end"`
+	// Note is the MIDI note sung on the word, added by the pitch analysis; -1 when no pitch was found
+	Note *int `json:"note,omitempty"`
+}
+
+// Pitch returns the MIDI note of the word, false when the pitch analysis found none
+func (w WordInfo) Pitch() (int, bool) {
+	if w.Note == nil || *w.Note < 0 || *w.Note > 127 {
+		return 0, false
+	}
+	return *w.Note, true
 }
 
 // Segment represents a line of text with timing information
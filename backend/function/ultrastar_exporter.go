@@ -0,0 +1,103 @@
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// ultraStarBPM sets the beat grid: UltraStar beats are a quarter of a BPM beat, so 300 BPM
+	// quantizes timings to 50 ms
+	ultraStarBPM = 300
+	// ultraStarGoldenBeats is the length from which a held, pitched note becomes a golden note
+	ultraStarGoldenBeats = 30
+	// ultraStarMiddleC is the MIDI note of pitch 0 in UltraStar files
+	ultraStarMiddleC = 60
+)
+
+// UltraStarFiles are the audio files an UltraStar song folder made from the session package
+// points to: the instrumental to sing over and the vocals players can mix in
+var UltraStarFiles = struct{ Instrumental, Vocals string }{
+	Instrumental: "no_vocals_48k.ogg",
+	Vocals:       "vocal_48k.ogg",
+}
+
+// RenderUltraStar renders lyrics with their pitch notes as an UltraStar Deluxe song. Word times
+// are quantized to the beat grid after #GAP, each segment becomes a line closed by a "-" line
+// break, long notes are golden (*) and words without a detected pitch are freestyle (F).
+func RenderUltraStar(lyrics *LyricsJSON, metadata LyricsMetadata) []byte {
+	var buf bytes.Buffer
+	title, artist := singleLine(metadata.Title), singleLine(metadata.Artist)
+	if title == "" {
+		title = "Unknown"
+	}
+	if artist == "" {
+		artist = "Unknown"
+	}
+
+	offset := float64(metadata.OffsetMs) / 1000
+	gap := 0.0
+	for _, segment := range lyrics.Segments {
+		if len(segment.Words) > 0 {
+			gap = math.Max(segment.Words[0].Start-offset, 0)
+			break
+		}
+	}
+	beatSeconds := 60.0 / (ultraStarBPM * 4)
+	beat := func(seconds float64) int {
+		return int(math.Round((seconds - offset - gap) / beatSeconds))
+	}
+
+	fmt.Fprintf(&buf, "#TITLE:%s\n#ARTIST:%s\n", title, artist)
+	buf.WriteString("#ENCODING:UTF8\n")
+	fmt.Fprintf(&buf, "#MP3:%s\n#VOCALS:%s\n#INSTRUMENTAL:%s\n",
+		UltraStarFiles.Instrumental, UltraStarFiles.Vocals, UltraStarFiles.Instrumental)
+	fmt.Fprintf(&buf, "#BPM:%d\n#GAP:%d\n", ultraStarBPM, int(math.Round(gap*1000)))
+
+	// Notes never overlap: each starts at or after the end of the previous one
+	cursor := 0
+	pitch := 0
+	lines := 0
+	for _, segment := range lyrics.Segments {
+		if len(segment.Words) == 0 {
+			continue
+		}
+		if lines > 0 {
+			fmt.Fprintf(&buf, "- %d\n", cursor)
+		}
+		lines++
+
+		for i, word := range segment.Words {
+			start := max(beat(word.Start), cursor)
+			end := max(beat(word.End), start+1)
+			// Leave room for the next word rather than overlapping it
+			if i+1 < len(segment.Words) {
+				if next := beat(segment.Words[i+1].Start); next > start && end > next {
+					end = next
+				}
+			}
+
+			kind := ":"
+			if note, ok := word.Pitch(); ok {
+				pitch = note - ultraStarMiddleC
+				if end-start >= ultraStarGoldenBeats {
+					kind = "*"
+				}
+			} else {
+				// Freestyle notes aren't scored; the previous pitch keeps them in place on screen
+				kind = "F"
+			}
+
+			text := strings.NewReplacer("\n", " ", "\r", " ").Replace(word.Word)
+			if text == "" {
+				text = "~"
+			}
+			fmt.Fprintf(&buf, "%s %d %d %d %s\n", kind, start, end-start, pitch, text)
+			cursor = end
+		}
+	}
+	buf.WriteString("E\n")
+	return buf.Bytes()
+}
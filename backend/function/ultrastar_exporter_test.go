@@ -0,0 +1,79 @@
+package function
+
+import "testing"
+
+func TestRenderUltraStar(t *testing.T) {
+	const header = "#ENCODING:UTF8\n" +
+		"#MP3:no_vocals_48k.ogg\n" +
+		"#VOCALS:vocal_48k.ogg\n" +
+		"#INSTRUMENTAL:no_vocals_48k.ogg\n" +
+		"#BPM:300\n"
+
+	tests := []struct {
+		name     string
+		lyrics   *LyricsJSON
+		metadata LyricsMetadata
+		want     string
+	}{
+		{
+			name:     "song",
+			lyrics:   testLyrics(),
+			metadata: LyricsMetadata{Title: "Song", Artist: "Band"},
+			// Beats are 50 ms after the 1.5 s gap; words without a pitch are freestyle and keep
+			// the previous pitch
+			want: "#TITLE:Song\n#ARTIST:Band\n" + header + "#GAP:1500\n" +
+				": 0 10 0 Hello\n" +
+				": 15 20 2  world\n" +
+				"- 35\n" +
+				": 50 10 4 Sing\n" +
+				"F 60 20 4  on\n" +
+				"- 80\n" +
+				"F 1170 20 4 Again\n" +
+				"E\n",
+		},
+		{
+			name:   "offset",
+			lyrics: testLyrics(),
+			// The offset moves the gap, the beats stay relative to the first word
+			metadata: LyricsMetadata{OffsetMs: 500},
+			want: "#TITLE:Unknown\n#ARTIST:Unknown\n" + header + "#GAP:1000\n" +
+				": 0 10 0 Hello\n" +
+				": 15 20 2  world\n" +
+				"- 35\n" +
+				": 50 10 4 Sing\n" +
+				"F 60 20 4  on\n" +
+				"- 80\n" +
+				"F 1170 20 4 Again\n" +
+				"E\n",
+		},
+		{
+			name: "quantization",
+			lyrics: &LyricsJSON{Segments: []Segment{
+				// A line without words is left out
+				{Start: 0.5, End: 1, Text: "..."},
+				{Start: 2.01, End: 6, Words: []WordInfo{
+					// Held for 40 beats, a golden note
+					{Word: "long", Start: 2.01, End: 4.02, Note: midiNote(67)},
+					// Starts on the beat the previous word ends on and is cut short by the next
+					{Word: " a", Start: 4.01, End: 4.3, Note: midiNote(55)},
+					{Word: " b", Start: 4.2, End: 4.21, Note: midiNote(55)},
+					// An empty word still needs a syllable
+					{Word: "", Start: 5, End: 6, Note: midiNote(128)},
+				}},
+			}},
+			want: "#TITLE:Unknown\n#ARTIST:Unknown\n" + header + "#GAP:2010\n" +
+				"* 0 40 7 long\n" +
+				": 40 4 -5  a\n" +
+				": 44 1 -5  b\n" +
+				"F 60 20 -5 ~\n" +
+				"E\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(RenderUltraStar(test.lyrics, test.metadata)); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
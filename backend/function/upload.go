@@ -0,0 +1,90 @@
+package function
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadFile is the name of the upload metadata file inside a session workspace
+const uploadFile = "upload.json"
+
+// StoredAudioBase is the name, without extension, every uploaded song is stored under.
+// Client file names never reach the disk or a command line; they are only kept as metadata.
+const StoredAudioBase = "audio"
+
+// UploadMetadata describes an uploaded file: the name the client sent and the name it is stored under
+type UploadMetadata struct {
+	OriginalFilename string    `json:"original_filename"`
+	StoredFilename   string    `json:"stored_filename"`
+	Size             int64     `json:"size"`
+	UploadedAt       time.Time `json:"uploaded_at"`
+	// Title and Artist are optional song details written into the lyrics exports
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+}
+
+// NewSessionID returns a unique, filesystem-safe session ID made of the current time and random bytes
+func NewSessionID() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("error generating session ID: %w", err)
+	}
+	return fmt.Sprintf("%d_%s", time.Now().Unix(), hex.EncodeToString(random)), nil
+}
+
+// StoredFilename returns the server-side name for an upload called original: base followed by
+// the original extension, kept only when it is short and alphanumeric
+func StoredFilename(base, original string) string {
+	return base + SafeExtension(original)
+}
+
+// SafeExtension returns the lowercased extension of name, or "" if it isn't made of 1 to 8 ASCII letters and digits
+func SafeExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(filepath.Base(name)))
+	if len(ext) < 2 || len(ext) > 9 {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// UploadPath is the location of the upload metadata of the workspace
+func (w Workspace) UploadPath() string {
+	return filepath.Join(w.Root, uploadFile)
+}
+
+// SaveUploadMetadata records what the client uploaded to a session workspace
+func SaveUploadMetadata(ws Workspace, metadata UploadMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding upload metadata: %w", err)
+	}
+	if err := os.WriteFile(ws.UploadPath(), data, 0644); err != nil {
+		return fmt.Errorf("error writing upload metadata: %w", err)
+	}
+	return nil
+}
+
+// LoadUploadMetadata reads the upload metadata of a session workspace
+func LoadUploadMetadata(ws Workspace) (*UploadMetadata, error) {
+	data, err := os.ReadFile(ws.UploadPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata UploadMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("error parsing upload metadata: %w", err)
+	}
+	return &metadata, nil
+}
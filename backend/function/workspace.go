@@ -0,0 +1,97 @@
+package function
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// DefaultWorkspaceDir is the directory under which every session gets its own workspace
+// when the configuration doesn't set one
+const DefaultWorkspaceDir = "./function/sessions"
+
+// Workspace is the isolated directory tree used by a single karaoke generation job.
+// Every pipeline step reads and writes inside Root so concurrent jobs never share files.
+type Workspace struct {
+	Root string
+}
+
+// ErrInvalidSessionID is returned for session IDs that NewSessionID can't have generated
+var ErrInvalidSessionID = errors.New("invalid session ID")
+
+// sessionIDPattern matches the IDs returned by NewSessionID: Unix seconds, "_" and 8 random bytes in hex
+var sessionIDPattern = regexp.MustCompile(`^[0-9]+_[0-9a-f]{16}$`)
+
+// ValidSessionID reports whether id has the format of the IDs returned by NewSessionID,
+// so it can safely name a directory or file
+func ValidSessionID(id string) bool {
+	return sessionIDPattern.MatchString(id)
+}
+
+// SessionWorkspace returns the workspace assigned to a session under baseDir without touching the disk
+func SessionWorkspace(baseDir, sessionID string) (Workspace, error) {
+	if !ValidSessionID(sessionID) {
+		return Workspace{}, fmt.Errorf("%w %q", ErrInvalidSessionID, sessionID)
+	}
+	return Workspace{Root: filepath.Join(baseDir, sessionID)}, nil
+}
+
+// NewWorkspace creates the directory layout of a session workspace under baseDir
+func NewWorkspace(baseDir, sessionID string) (Workspace, error) {
+	ws, err := SessionWorkspace(baseDir, sessionID)
+	if err != nil {
+		return ws, err
+	}
+	for _, dir := range []string{ws.UploadDir(), ws.InputDir(), ws.OutputDir(), ws.TimestampDir(), ws.FinalResultDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return ws, fmt.Errorf("error creating workspace directory %s: %w", dir, err)
+		}
+	}
+	return ws, nil
+}
+
+// RemoveWorkspace deletes everything stored in a session workspace under baseDir
+func RemoveWorkspace(baseDir, sessionID string) error {
+	ws, err := SessionWorkspace(baseDir, sessionID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(ws.Root)
+}
+
+// UploadDir holds the uploaded audio, kept out of the MFA corpus whatever its format
+func (w Workspace) UploadDir() string {
+	return filepath.Join(w.Root, "upload")
+}
+
+// InputDir is the MFA corpus: the .lab lyrics and the 48kHz vocals
+func (w Workspace) InputDir() string {
+	return filepath.Join(w.Root, "input")
+}
+
+// OutputDir is the Demucs output root
+func (w Workspace) OutputDir() string {
+	return filepath.Join(w.Root, "output")
+}
+
+// StemsDir is where Demucs writes the separated stems of a song
+func (w Workspace) StemsDir(filename string) string {
+	return filepath.Join(w.OutputDir(), "htdemucs", filename)
+}
+
+// TimestampDir holds the MFA TextGrids and the intermediate timestamp JSON files
+func (w Workspace) TimestampDir() string {
+	return filepath.Join(w.Root, "timestamp_output")
+}
+
+// FinalResultDir holds the deliverables that are zipped for download
+func (w Workspace) FinalResultDir() string {
+	return filepath.Join(w.Root, "final_result")
+}
+
+// MFATempDir is the MFA temporary directory, kept per session so parallel alignments don't collide
+func (w Workspace) MFATempDir() string {
+	return filepath.Join(w.Root, "mfa_tmp")
+}
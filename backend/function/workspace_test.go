@@ -0,0 +1,76 @@
+package function
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionWorkspace(t *testing.T) {
+	id, err := NewSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir()
+
+	ws, err := SessionWorkspace(base, id)
+	if err != nil {
+		t.Fatalf("NewSessionID returned an ID SessionWorkspace rejects: %v", err)
+	}
+	if want := filepath.Join(base, id); ws.Root != want {
+		t.Errorf("root %q, want %q", ws.Root, want)
+	}
+
+	// Anything else could name the base directory, its parent or another session's files
+	for _, id := range []string{
+		"",
+		".",
+		"..",
+		"../1700000000_0123456789abcdef",
+		"1700000000_0123456789abcdef/..",
+		"1700000000_0123456789abcdef/input",
+		`1700000000_0123456789abcdef\..`,
+		"1700000000_0123456789ABCDEF",
+		"1700000000_0123456789abcde",
+		"1700000000_song.mp3",
+		"_0123456789abcdef",
+	} {
+		if _, err := SessionWorkspace(base, id); !errors.Is(err, ErrInvalidSessionID) {
+			t.Errorf("SessionWorkspace(%q) = %v, want ErrInvalidSessionID", id, err)
+		}
+	}
+}
+
+func TestNewAndRemoveWorkspace(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "sessions")
+	id := "1700000000_0123456789abcdef"
+
+	ws, err := NewWorkspace(base, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{ws.UploadDir(), ws.InputDir(), ws.OutputDir(), ws.TimestampDir(), ws.FinalResultDir()} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("%s was not created: %v", dir, err)
+		}
+	}
+
+	if err := RemoveWorkspace(base, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ws.Root); !os.IsNotExist(err) {
+		t.Errorf("workspace still exists: %v", err)
+	}
+
+	// ".." must neither create nor delete anything outside the base directory
+	if _, err := NewWorkspace(base, ".."); !errors.Is(err, ErrInvalidSessionID) {
+		t.Errorf("NewWorkspace(..) = %v, want ErrInvalidSessionID", err)
+	}
+	if err := RemoveWorkspace(base, ".."); !errors.Is(err, ErrInvalidSessionID) {
+		t.Errorf("RemoveWorkspace(..) = %v, want ErrInvalidSessionID", err)
+	}
+	if _, err := os.Stat(base); err != nil {
+		t.Errorf("base directory was removed: %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"karaoke_generator/audio"
+	"karaoke_generator/function"
+)
+
+// Status is the state of a single probe or of the whole toolchain
+type Status string
+
+const (
+	// StatusOK means the dependency is present and answered its version probe
+	StatusOK Status = "ok"
+	// StatusMissing means the dependency could not be found
+	StatusMissing Status = "missing"
+	// StatusError means the dependency is present but unusable
+	StatusError Status = "error"
+	// StatusDegraded means some jobs can run but not all, e.g. a language lacks its MFA models
+	StatusDegraded Status = "degraded"
+)
+
+// probeTimeout bounds every external command run by a probe; conda run is slow to start
+const probeTimeout = 30 * time.Second
+
+// Check is the result of probing one dependency
+type Check struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// LanguageCheck tells whether jobs in a language can be aligned
+type LanguageCheck struct {
+	Language   int      `json:"language"`
+	Dictionary string   `json:"dictionary"`
+	Acoustic   string   `json:"acoustic"`
+	Ready      bool     `json:"ready"`
+	Missing    []string `json:"missing,omitempty"`
+}
+
+// Report is the outcome of probing the whole toolchain
+type Report struct {
+	Status    Status          `json:"status"`
+	CheckedAt time.Time       `json:"checked_at"`
+	Checks    []Check         `json:"checks"`
+	Languages []LanguageCheck `json:"languages"`
+}
+
+// Ready reports whether every dependency answered its probe
+func (r *Report) Ready() bool {
+	return r.Status == StatusOK
+}
+
+// Failed returns the checks of the dependencies that are missing or unusable
+func (r *Report) Failed() []Check {
+	var failed []Check
+	for _, check := range r.Checks {
+		if check.Status != StatusOK {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// LanguageReady reports whether the MFA models of a language are installed
+func (r *Report) LanguageReady(language int) (LanguageCheck, bool) {
+	for _, check := range r.Languages {
+		if check.Language == language {
+			return check, check.Ready
+		}
+	}
+	return LanguageCheck{Language: language}, false
+}
+
+// runner resolves and runs the commands of the probes; tests replace the real tools with a fake
+type runner interface {
+	// lookPath resolves a tool like exec.LookPath
+	lookPath(file string) (string, error)
+	// output runs a command and returns what it printed on stdout and stderr, even when it fails
+	output(ctx context.Context, name string, args ...string) (string, error)
+}
+
+// execRunner runs the real tools
+type execRunner struct{}
+
+func (execRunner) lookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+func (execRunner) output(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+// Checker probes the external tools the pipeline depends on
+type Checker struct {
+	tools  function.Tools
+	runner runner
+
+	// Serializes probes, which run without holding mutex
+	probing sync.Mutex
+
+	// Guards last, modelsAt and refreshing
+	mutex sync.Mutex
+	last  *Report
+	// modelsAt is when the MFA models were last listed, by a full probe or LanguageReady
+	modelsAt time.Time
+	// refreshing is set while ToolsReady or LanguageReady probes in the background
+	refreshing bool
+}
+
+// NewChecker creates a checker for the configured tools
+func NewChecker(tools function.Tools) *Checker {
+	return &Checker{tools: tools, runner: execRunner{}}
+}
+
+// Last returns the latest report, nil before the first probe
+func (c *Checker) Last() *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last
+}
+
+// Report returns the latest report if it is younger than maxAge, otherwise probes again.
+// Concurrent callers share a single probe.
+func (c *Checker) Report(ctx context.Context, maxAge time.Duration) *Report {
+	if report := c.fresh(maxAge); report != nil {
+		return report
+	}
+
+	c.probing.Lock()
+	defer c.probing.Unlock()
+	// Another caller may have probed while this one waited
+	if report := c.fresh(maxAge); report != nil {
+		return report
+	}
+
+	report := c.run(ctx)
+	c.mutex.Lock()
+	c.last = report
+	c.modelsAt = report.CheckedAt
+	c.mutex.Unlock()
+	return report
+}
+
+// fresh returns the latest report if it is younger than maxAge, nil otherwise
+func (c *Checker) fresh(maxAge time.Duration) *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.last != nil && time.Since(c.last.CheckedAt) < maxAge {
+		return c.last
+	}
+	return nil
+}
+
+// run probes every dependency; must be called with probing held
+func (c *Checker) run(ctx context.Context) *Report {
+	report := &Report{CheckedAt: time.Now()}
+
+	report.Checks = append(report.Checks,
+		c.probeTool(ctx, "ffmpeg", c.tools.FFmpegPath, "-version"),
+		c.probeTool(ctx, "ffprobe", c.tools.FFprobePath, "-version"),
+		c.probeTool(ctx, "python", c.tools.PythonPath, "--version"),
+		probeFile("pitch_analyzer", c.tools.PitchAnalyzerScript),
+		c.probeOggEncoder(ctx),
+	)
+
+	conda, err := c.tools.FindConda()
+	if err != nil {
+		report.Checks = append(report.Checks,
+			Check{Name: "conda", Status: StatusMissing, Path: c.tools.CondaPath, Detail: err.Error()},
+			Check{Name: "demucs", Status: StatusMissing, Detail: "conda is not available"},
+			Check{Name: "mfa", Status: StatusMissing, Detail: "conda is not available"},
+		)
+		report.Languages = c.probeLanguages(nil)
+		report.Status = overallStatus(report)
+		return report
+	}
+
+	report.Checks = append(report.Checks,
+		c.probeTool(ctx, "conda", conda, "--version"),
+		c.probeTool(ctx, "demucs", conda, "run", "-n", c.tools.DemucsEnv, "--no-capture-output",
+			"python", "-c", "import demucs; print(demucs.__version__)"),
+	)
+
+	mfa := c.probeTool(ctx, "mfa", conda, "run", "-n", c.tools.MFAEnv, "--no-capture-output", "mfa", "version")
+	report.Checks = append(report.Checks, mfa)
+
+	var installed map[string]map[string]bool
+	if mfa.Status == StatusOK {
+		var failed []Check
+		installed, failed = c.listModels(ctx, conda)
+		report.Checks = append(report.Checks, failed...)
+	}
+	report.Languages = c.probeLanguages(installed)
+	report.Status = overallStatus(report)
+	return report
+}
+
+// ToolsReady reports whether every tool answered its probe in the latest report, and the checks
+// that failed. When that report is older than maxAge the tools are probed again in the background,
+// so a tool installed or removed while the server runs is noticed while no request waits for conda.
+func (c *Checker) ToolsReady(ctx context.Context, maxAge time.Duration) ([]Check, bool) {
+	c.mutex.Lock()
+	last := c.last
+	stale := last != nil && !c.refreshing && time.Since(last.CheckedAt) >= maxAge
+	if stale {
+		c.refreshing = true
+	}
+	c.mutex.Unlock()
+
+	if last == nil {
+		last = c.Report(ctx, maxAge)
+	} else if stale {
+		go c.refreshReport(maxAge)
+	}
+	failed := last.Failed()
+	return failed, len(failed) == 0
+}
+
+// refreshReport probes every dependency again for ToolsReady
+func (c *Checker) refreshReport(maxAge time.Duration) {
+	c.Report(context.Background(), maxAge)
+	c.mutex.Lock()
+	c.refreshing = false
+	c.mutex.Unlock()
+}
+
+// LanguageReady reports whether the MFA models of a language are installed, from the latest
+// listing. When that listing is older than maxAge the models are listed again in the background,
+// without probing the other tools, so jobs are accepted or rejected on what is installed now
+// rather than at startup while no request waits for conda.
+func (c *Checker) LanguageReady(ctx context.Context, language int, maxAge time.Duration) (LanguageCheck, bool) {
+	c.mutex.Lock()
+	last := c.last
+	stale := last != nil && !c.refreshing && time.Since(c.modelsAt) >= maxAge
+	if stale {
+		c.refreshing = true
+	}
+	c.mutex.Unlock()
+
+	if last == nil {
+		last = c.Report(ctx, maxAge)
+	} else if stale {
+		go c.refreshLanguages()
+	}
+	return last.LanguageReady(language)
+}
+
+// refreshLanguages replaces the latest report with a copy whose MFA models are listed again
+func (c *Checker) refreshLanguages() {
+	c.probing.Lock()
+	defer c.probing.Unlock()
+
+	c.mutex.Lock()
+	last := c.last
+	c.mutex.Unlock()
+
+	report := c.listLanguages(context.Background(), last)
+	c.mutex.Lock()
+	c.last = report
+	c.modelsAt = time.Now()
+	c.refreshing = false
+	c.mutex.Unlock()
+}
+
+// listLanguages returns a copy of last with the MFA models listed again; must be called with
+// probing held
+func (c *Checker) listLanguages(ctx context.Context, last *Report) *Report {
+	report := *last
+	report.Checks = nil
+	mfaReady := false
+	for _, check := range last.Checks {
+		if strings.HasPrefix(check.Name, "mfa_") && strings.HasSuffix(check.Name, "_models") {
+			continue
+		}
+		if check.Name == "mfa" && check.Status == StatusOK {
+			mfaReady = true
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	var installed map[string]map[string]bool
+	if conda, err := c.tools.FindConda(); err == nil && mfaReady {
+		var failed []Check
+		installed, failed = c.listModels(ctx, conda)
+		report.Checks = append(report.Checks, failed...)
+	}
+	report.Languages = c.probeLanguages(installed)
+	report.Status = overallStatus(&report)
+	return &report
+}
+
+// listModels returns the names of the installed MFA models of each kind, from
+// `mfa models list <kind>`, and a failed check for every listing that could not be read
+func (c *Checker) listModels(ctx context.Context, conda string) (map[string]map[string]bool, []Check) {
+	installed := make(map[string]map[string]bool)
+	var failed []Check
+	for _, kind := range []string{"dictionary", "acoustic"} {
+		out, err := c.output(ctx, conda, "run", "-n", c.tools.MFAEnv, "--no-capture-output", "mfa", "models", "list", kind)
+		if err != nil {
+			failed = append(failed, Check{Name: "mfa_" + kind + "_models", Status: StatusError, Detail: err.Error()})
+			continue
+		}
+		installed[kind] = modelNames(out)
+	}
+	return installed, failed
+}
+
+// modelNames splits a model listing into names, whether MFA prints a Python list or a table
+func modelNames(listing string) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.FieldsFunc(listing, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.", r))
+	}) {
+		names[name] = true
+	}
+	return names
+}
+
+// probeLanguages checks that the dictionary of every language appears in the dictionary listing
+// and its acoustic model in the acoustic listing; a dictionary and an acoustic model often share
+// a name, so each must be found in its own listing
+func (c *Checker) probeLanguages(installed map[string]map[string]bool) []LanguageCheck {
+	var checks []LanguageCheck
+	for _, language := range function.Languages() {
+		dictionary, acoustic, _ := function.MFAModels(language)
+		check := LanguageCheck{Language: language, Dictionary: dictionary, Acoustic: acoustic}
+		if !installed["dictionary"][dictionary] {
+			check.Missing = append(check.Missing, "dictionary "+dictionary)
+		}
+		if !installed["acoustic"][acoustic] {
+			check.Missing = append(check.Missing, "acoustic model "+acoustic)
+		}
+		check.Ready = len(check.Missing) == 0
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// probeTool runs a tool's version command and reports the first line it prints
+func (c *Checker) probeTool(ctx context.Context, name, path string, args ...string) Check {
+	check := Check{Name: name, Path: path}
+	resolved, err := c.runner.lookPath(path)
+	if err != nil {
+		check.Status = StatusMissing
+		check.Detail = err.Error()
+		return check
+	}
+	check.Path = resolved
+
+	out, err := c.output(ctx, resolved, args...)
+	if err != nil {
+		check.Status = StatusError
+		check.Detail = err.Error()
+		return check
+	}
+	check.Status = StatusOK
+	check.Version = firstLine(out)
+	return check
+}
+
+// output runs a command under probeTimeout and returns its combined output
+func (c *Checker) output(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	out, err := c.runner.output(ctx, name, args...)
+	if err != nil {
+		if tail := lastLine(out); tail != "" {
+			return "", fmt.Errorf("%w: %s", err, tail)
+		}
+		return "", err
+	}
+	return out, nil
+}
+
+// probeOggEncoder reports the in-process Opus encoder, or when the server was built without the
+// libopus binding, whether ffmpeg was built with its libopus encoder
+func (c *Checker) probeOggEncoder(ctx context.Context) Check {
+	if audio.OpusAvailable {
+		return Check{Name: "ogg_encoder", Status: StatusOK, Version: audio.OpusVersion(), Detail: "in-process Opus encoder"}
+	}
+
+	check := Check{Name: "ogg_encoder", Path: c.tools.FFmpegPath}
+	resolved, err := c.runner.lookPath(c.tools.FFmpegPath)
+	if err != nil {
+		check.Status = StatusMissing
+		check.Detail = "ffmpeg is not available: " + err.Error()
+		return check
+	}
+	check.Path = resolved
+	out, err := c.output(ctx, resolved, "-hide_banner", "-encoders")
+	if err != nil {
+		check.Status = StatusError
+		check.Detail = err.Error()
+		return check
+	}
+	if !hasEncoder(out, "libopus") {
+		check.Status = StatusMissing
+		check.Detail = "ffmpeg was built without libopus"
+		return check
+	}
+	check.Status = StatusOK
+	check.Detail = "ffmpeg libopus encoder"
+	return check
+}
+
+// hasEncoder reports whether `ffmpeg -encoders` lists an encoder, e.g. " A....D libopus  ..."
+func hasEncoder(listing, name string) bool {
+	for _, line := range strings.Split(listing, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// probeFile checks that a file the pipeline reads exists
+func probeFile(name, path string) Check {
+	check := Check{Name: name, Path: path}
+	if _, err := os.Stat(path); err != nil {
+		check.Status = StatusMissing
+		check.Detail = err.Error()
+		return check
+	}
+	check.Status = StatusOK
+	return check
+}
+
+// overallStatus is ok when every check passed and every language is ready, degraded when only
+// some languages are ready, and error otherwise
+func overallStatus(report *Report) Status {
+	for _, check := range report.Checks {
+		if check.Status != StatusOK {
+			return StatusError
+		}
+	}
+	ready := 0
+	for _, language := range report.Languages {
+		if language.Ready {
+			ready++
+		}
+	}
+	switch {
+	case ready == len(report.Languages):
+		return StatusOK
+	case ready > 0:
+		return StatusDegraded
+	default:
+		return StatusError
+	}
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return strings.TrimSpace(s[i+1:])
+	}
+	return s
+}
@@ -0,0 +1,314 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"karaoke_generator/audio"
+	"karaoke_generator/function"
+)
+
+// fakeRunner answers probes from a table of commands, keyed by the base name of the tool
+// followed by its arguments
+type fakeRunner struct {
+	mutex   sync.Mutex
+	tools   map[string]string
+	outputs map[string]fakeOutput
+	calls   []string
+}
+
+type fakeOutput struct {
+	out string
+	err error
+}
+
+func (r *fakeRunner) lookPath(file string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if path, ok := r.tools[file]; ok {
+		return path, nil
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func (r *fakeRunner) output(ctx context.Context, name string, args ...string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := strings.Join(append([]string{filepath.Base(name)}, args...), " ")
+	r.calls = append(r.calls, key)
+	if output, ok := r.outputs[key]; ok {
+		return output.out, output.err
+	}
+	return "", errors.New("unexpected command " + key)
+}
+
+func (r *fakeRunner) set(key, out string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.outputs[key] = fakeOutput{out: out, err: err}
+}
+
+func (r *fakeRunner) count(key string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for _, call := range r.calls {
+		if call == key {
+			n++
+		}
+	}
+	return n
+}
+
+const (
+	dictionaryList = "conda run -n mfa --no-capture-output mfa models list dictionary"
+	acousticList   = "conda run -n mfa --no-capture-output mfa models list acoustic"
+)
+
+// newTestChecker returns a checker whose tools all answer their probes and whose MFA has
+// every model of every language installed
+func newTestChecker(t *testing.T) (*Checker, *fakeRunner) {
+	t.Helper()
+	dir := t.TempDir()
+	// conda is looked up by function.Tools, on the disk
+	conda := filepath.Join(dir, "conda")
+	if err := os.WriteFile(conda, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "vocal_pitch_analyzer.py")
+	if err := os.WriteFile(script, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &fakeRunner{
+		tools: map[string]string{
+			"ffmpeg":  "/usr/bin/ffmpeg",
+			"ffprobe": "/usr/bin/ffprobe",
+			"python":  "/usr/bin/python",
+			conda:     conda,
+		},
+		outputs: map[string]fakeOutput{
+			"ffmpeg -version":                                  {out: "ffmpeg version 6.1\nbuilt with gcc"},
+			"ffprobe -version":                                 {out: "ffprobe version 6.1\n"},
+			"python --version":                                 {out: "Python 3.11.4\n"},
+			"ffmpeg -hide_banner -encoders":                    {out: " A....D aac  AAC\n A....D libopus  libopus Opus\n"},
+			"conda --version":                                  {out: "conda 24.1.2\n"},
+			"conda run -n mfa --no-capture-output mfa version": {out: "3.0.7\n"},
+			"conda run -n demucs_env --no-capture-output python -c import demucs; print(demucs.__version__)": {out: "4.0.1\n"},
+			dictionaryList: {out: "['english_us_mfa', 'vietnamese_mfa']\n"},
+			acousticList:   {out: "['english_mfa', 'vietnamese_mfa']\n"},
+		},
+	}
+
+	tools := function.DefaultTools()
+	tools.CondaPath = conda
+	tools.PitchAnalyzerScript = script
+	checker := NewChecker(tools)
+	checker.runner = runner
+	return checker, runner
+}
+
+// waitFor polls until done reports true
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReport(t *testing.T) {
+	checker, _ := newTestChecker(t)
+	report := checker.Report(context.Background(), time.Minute)
+
+	if report.Status != StatusOK || !report.Ready() {
+		t.Errorf("status %s, failed checks %+v", report.Status, report.Failed())
+	}
+	versions := make(map[string]string)
+	for _, check := range report.Checks {
+		versions[check.Name] = check.Version
+	}
+	for name, want := range map[string]string{"ffmpeg": "ffmpeg version 6.1", "python": "Python 3.11.4", "demucs": "4.0.1", "mfa": "3.0.7"} {
+		if versions[name] != want {
+			t.Errorf("%s version %q, want %q", name, versions[name], want)
+		}
+	}
+	for _, language := range report.Languages {
+		if !language.Ready {
+			t.Errorf("language %d not ready: %v", language.Language, language.Missing)
+		}
+	}
+
+	// A fresh report is reused
+	if again := checker.Report(context.Background(), time.Minute); again != report {
+		t.Error("a fresh report was probed again")
+	}
+}
+
+func TestReportFailures(t *testing.T) {
+	checker, runner := newTestChecker(t)
+	delete(runner.tools, "ffprobe")
+	runner.set("python --version", "Traceback\nModuleNotFoundError: encodings", errors.New("exit status 1"))
+	runner.set("ffmpeg -hide_banner -encoders", " A....D aac  AAC\n", nil)
+
+	report := checker.Report(context.Background(), time.Minute)
+	if report.Status != StatusError {
+		t.Errorf("status %s, want %s", report.Status, StatusError)
+	}
+	failed := make(map[string]Check)
+	for _, check := range report.Failed() {
+		failed[check.Name] = check
+	}
+	if check := failed["ffprobe"]; check.Status != StatusMissing {
+		t.Errorf("ffprobe %+v, want missing", check)
+	}
+	// The last line of the output says why the tool failed
+	if check := failed["python"]; check.Status != StatusError || check.Detail != "exit status 1: ModuleNotFoundError: encodings" {
+		t.Errorf("python %+v", check)
+	}
+	if check, ok := failed["ogg_encoder"]; audio.OpusAvailable == ok {
+		t.Errorf("ogg_encoder %+v with the in-process encoder built in: %v", check, audio.OpusAvailable)
+	}
+	if len(failed) != 3 && !audio.OpusAvailable {
+		t.Errorf("failed checks %+v, want ffprobe, python and ogg_encoder", report.Failed())
+	}
+}
+
+func TestModelNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing string
+		want    []string
+	}{
+		{"python list", "['english_mfa', 'vietnamese_mfa']\n", []string{"english_mfa", "vietnamese_mfa"}},
+		{
+			name: "table",
+			listing: "┏━━━━━━━━━━━━━━━━┓\n┃ Name           ┃\n┡━━━━━━━━━━━━━━━━┩\n" +
+				"│ english_us_mfa │\n│ vietnamese_mfa │\n│ english-v2.0.0 │\n└────────────────┘\n",
+			want: []string{"Name", "english_us_mfa", "vietnamese_mfa", "english-v2.0.0"},
+		},
+		{"empty", "[]\n", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := make(map[string]bool)
+			for _, name := range test.want {
+				want[name] = true
+			}
+			if got := modelNames(test.listing); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestProbeLanguagesPerKind(t *testing.T) {
+	checker, runner := newTestChecker(t)
+	// vietnamese_mfa is installed as a dictionary only, english_mfa is listed among the
+	// dictionaries although it is the acoustic model
+	runner.set(dictionaryList, "['english_us_mfa', 'vietnamese_mfa', 'english_mfa']\n", nil)
+	runner.set(acousticList, "['english_mfa']\n", nil)
+
+	report := checker.Report(context.Background(), time.Minute)
+	if report.Status != StatusDegraded {
+		t.Errorf("status %s, want %s", report.Status, StatusDegraded)
+	}
+	if check, ready := report.LanguageReady(2); !ready {
+		t.Errorf("english not ready: %+v", check)
+	}
+	check, ready := report.LanguageReady(1)
+	if ready || !reflect.DeepEqual(check.Missing, []string{"acoustic model vietnamese_mfa"}) {
+		t.Errorf("vietnamese %+v, want only its acoustic model missing", check)
+	}
+	if _, ready := report.LanguageReady(99); ready {
+		t.Error("an unsupported language is ready")
+	}
+}
+
+func TestListModelsFailure(t *testing.T) {
+	checker, runner := newTestChecker(t)
+	runner.set(acousticList, "PretrainedModelNotFoundError: acoustic\n", errors.New("exit status 1"))
+
+	report := checker.Report(context.Background(), time.Minute)
+	var failed []string
+	for _, check := range report.Failed() {
+		failed = append(failed, check.Name+" "+string(check.Status))
+	}
+	if want := []string{"mfa_acoustic_models error"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed checks %v, want %v", failed, want)
+	}
+	for _, language := range report.Languages {
+		if language.Ready {
+			t.Errorf("language %d ready without an acoustic model listing", language.Language)
+		}
+	}
+}
+
+func TestToolsReady(t *testing.T) {
+	checker, runner := newTestChecker(t)
+	runner.set("ffmpeg -version", "", errors.New("exit status 127"))
+
+	// The first call probes right away
+	failed, ready := checker.ToolsReady(context.Background(), time.Minute)
+	if ready || len(failed) != 1 || failed[0].Name != "ffmpeg" {
+		t.Fatalf("ready %v, failed %+v, want ffmpeg failed", ready, failed)
+	}
+
+	// A fresh report is reused, even if the tool was fixed meanwhile
+	runner.set("ffmpeg -version", "ffmpeg version 6.1\n", nil)
+	if _, ready := checker.ToolsReady(context.Background(), time.Minute); ready {
+		t.Error("a fresh report was probed again")
+	}
+	if n := runner.count("ffmpeg -version"); n != 1 {
+		t.Errorf("ffmpeg probed %d times, want 1", n)
+	}
+
+	// A stale report answers right away and is probed again in the background
+	if _, ready := checker.ToolsReady(context.Background(), 0); ready {
+		t.Error("a stale report waited for the probe")
+	}
+	waitFor(t, "the background probe", func() bool {
+		_, ready := checker.ToolsReady(context.Background(), time.Minute)
+		return ready
+	})
+}
+
+func TestLanguageReady(t *testing.T) {
+	checker, runner := newTestChecker(t)
+	runner.set(acousticList, "['english_mfa']\n", nil)
+
+	if _, ready := checker.LanguageReady(context.Background(), 1, time.Minute); ready {
+		t.Error("vietnamese ready without its acoustic model")
+	}
+	if _, ready := checker.LanguageReady(context.Background(), 2, time.Minute); !ready {
+		t.Error("english not ready")
+	}
+
+	// A stale listing lists the models again in the background, without probing the other tools
+	runner.set(acousticList, "['english_mfa', 'vietnamese_mfa']\n", nil)
+	checker.LanguageReady(context.Background(), 1, 0)
+	waitFor(t, "the background listing", func() bool {
+		_, ready := checker.LanguageReady(context.Background(), 1, time.Minute)
+		return ready
+	})
+	if n := runner.count("ffmpeg -version"); n != 1 {
+		t.Errorf("ffmpeg probed %d times, want 1", n)
+	}
+	if n := runner.count(acousticList); n != 2 {
+		t.Errorf("acoustic models listed %d times, want 2", n)
+	}
+	if status := checker.Last().Status; status != StatusOK {
+		t.Errorf("status %s after every model was installed, want %s", status, StatusOK)
+	}
+}
@@ -0,0 +1,257 @@
+package janitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"karaoke_generator/function"
+	"karaoke_generator/progress"
+	"karaoke_generator/queue"
+)
+
+// Config holds how long each kind of artifact is kept
+type Config struct {
+	// Interval between two cleanup passes
+	Interval time.Duration
+	// CompletedTTL is how long a completed session (progress, workspace, download zip) is kept
+	CompletedTTL time.Duration
+	// FailedTTL is how long a failed, cancelled or interrupted session is kept, so it can still be resumed
+	FailedTTL time.Duration
+	// UploadTTL is how long files in UploadDir are kept
+	UploadTTL time.Duration
+	// TempTTL is how long download zips in TempDir are kept; empty zips are always removed
+	TempTTL time.Duration
+
+	UploadDir string
+	TempDir   string
+	// WorkspaceDir is the directory the session workspaces are created in
+	WorkspaceDir string
+}
+
+// Report describes what one cleanup pass reclaimed
+type Report struct {
+	StartedAt         time.Time `json:"started_at"`
+	FinishedAt        time.Time `json:"finished_at"`
+	SessionsEvicted   []string  `json:"sessions_evicted"`
+	WorkspacesRemoved int       `json:"workspaces_removed"`
+	UploadsRemoved    int       `json:"uploads_removed"`
+	TempFilesRemoved  int       `json:"temp_files_removed"`
+	BytesReclaimed    int64     `json:"bytes_reclaimed"`
+	Errors            []string  `json:"errors,omitempty"`
+}
+
+// Janitor periodically evicts expired sessions and deletes their artifacts
+type Janitor struct {
+	config   Config
+	jobQueue *queue.JobQueue
+
+	// Serializes cleanup passes and guards last
+	mutex sync.Mutex
+	last  *Report
+}
+
+// New creates a janitor; jobQueue is used to never touch sessions that are still queued or running
+func New(config Config, jobQueue *queue.JobQueue) *Janitor {
+	return &Janitor{config: config, jobQueue: jobQueue}
+}
+
+// Start runs a cleanup pass right away and then every Interval
+func (j *Janitor) Start() {
+	if j.config.Interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			j.RunOnce()
+			time.Sleep(j.config.Interval)
+		}
+	}()
+}
+
+// LastReport returns the report of the latest cleanup pass, nil before the first one
+func (j *Janitor) LastReport() *Report {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.last
+}
+
+// RunOnce performs a cleanup pass and returns what it reclaimed
+func (j *Janitor) RunOnce() Report {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	report := Report{StartedAt: time.Now()}
+	now := report.StartedAt
+
+	known := make(map[string]bool)
+	for _, msg := range progress.ListProgress() {
+		known[msg.SessionID] = true
+		if !progress.IsTerminal(msg.Status) || j.isActive(msg.SessionID) {
+			continue
+		}
+
+		ttl := j.config.FailedTTL
+		if msg.Status == progress.StatusComplete {
+			ttl = j.config.CompletedTTL
+		}
+		if ttl <= 0 || now.Sub(time.Unix(msg.Timestamp, 0)) < ttl {
+			continue
+		}
+
+		j.evictSession(msg.SessionID, &report)
+	}
+
+	// Workspaces without any progress entry, e.g. left over by a store that was reset
+	j.removeOrphanWorkspaces(known, now, &report)
+
+	if j.config.UploadTTL > 0 {
+		report.UploadsRemoved += j.removeOldFiles(j.config.UploadDir, j.config.UploadTTL, false, now, &report)
+	}
+	if j.config.TempTTL > 0 {
+		report.TempFilesRemoved += j.removeOldFiles(j.config.TempDir, j.config.TempTTL, true, now, &report)
+	}
+
+	report.FinishedAt = time.Now()
+	j.last = &report
+
+	fmt.Printf("[JANITOR] evicted %d sessions, removed %d workspaces, %d uploads, %d temp files, reclaimed %d bytes\n",
+		len(report.SessionsEvicted), report.WorkspacesRemoved, report.UploadsRemoved, report.TempFilesRemoved, report.BytesReclaimed)
+	for _, err := range report.Errors {
+		fmt.Println("[JANITOR] error:", err)
+	}
+	return report
+}
+
+// evictSession deletes the workspace, download zip and progress of a session
+func (j *Janitor) evictSession(sessionID string, report *Report) {
+	// A session ID that NewSessionID can't have generated never got any files, only its progress is cleared
+	if ws, err := function.SessionWorkspace(j.config.WorkspaceDir, sessionID); err == nil {
+		if size, err := removePath(ws.Root); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return
+		} else if size >= 0 {
+			report.WorkspacesRemoved++
+			report.BytesReclaimed += size
+		}
+
+		zipPath := filepath.Join(j.config.TempDir, fmt.Sprintf("%s_karaoke.zip", sessionID))
+		if size, err := removePath(zipPath); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else if size >= 0 {
+			report.TempFilesRemoved++
+			report.BytesReclaimed += size
+		}
+	}
+
+	progress.ClearProgress(sessionID)
+	if j.jobQueue != nil {
+		j.jobQueue.Forget(sessionID)
+	}
+	report.SessionsEvicted = append(report.SessionsEvicted, sessionID)
+}
+
+// removeOrphanWorkspaces deletes workspaces that no session refers to once they are older than the completed TTL
+func (j *Janitor) removeOrphanWorkspaces(known map[string]bool, now time.Time, report *Report) {
+	if j.config.CompletedTTL <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(j.config.WorkspaceDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		sessionID := entry.Name()
+		if !entry.IsDir() || known[sessionID] || j.isActive(sessionID) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < j.config.CompletedTTL {
+			continue
+		}
+		size, err := removePath(filepath.Join(j.config.WorkspaceDir, sessionID))
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.WorkspacesRemoved++
+		report.BytesReclaimed += size
+	}
+}
+
+// emptyZipGrace keeps an empty zip alive for a while since it may still be being written
+const emptyZipGrace = time.Minute
+
+// removeOldFiles deletes the regular files of dir older than ttl (and empty .zip files when
+// removeEmptyZips is set) and returns how many were removed
+func (j *Janitor) removeOldFiles(dir string, ttl time.Duration, removeEmptyZips bool, now time.Time, report *Report) int {
+	if dir == "" {
+		return 0
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		return 0
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		age := now.Sub(info.ModTime())
+		emptyZip := removeEmptyZips && info.Size() == 0 && strings.HasSuffix(entry.Name(), ".zip") && age > emptyZipGrace
+		if !emptyZip && age < ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		removed++
+		report.BytesReclaimed += info.Size()
+	}
+	return removed
+}
+
+// isActive reports whether the session still has a queued or running job
+func (j *Janitor) isActive(sessionID string) bool {
+	if j.jobQueue == nil {
+		return false
+	}
+	job, ok := j.jobQueue.Get(sessionID)
+	return ok && (job.State == queue.JobQueued || job.State == queue.JobRunning)
+}
+
+// removePath deletes a file or directory tree and returns the bytes it held, or -1 if it didn't exist
+func removePath(path string) (int64, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return -1, nil
+	}
+
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	if err := os.RemoveAll(path); err != nil {
+		return 0, fmt.Errorf("error removing %s: %w", path, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,238 @@
+package janitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"karaoke_generator/progress"
+	"karaoke_generator/queue"
+)
+
+// janitorTree is a temp tree with the directories the janitor cleans
+type janitorTree struct {
+	config Config
+	store  *progress.MemoryStore
+	now    time.Time
+}
+
+func newJanitorTree(t *testing.T) *janitorTree {
+	t.Helper()
+	root := t.TempDir()
+	tree := &janitorTree{
+		config: Config{
+			CompletedTTL: time.Hour,
+			FailedTTL:    24 * time.Hour,
+			UploadTTL:    time.Hour,
+			TempTTL:      time.Hour,
+			UploadDir:    filepath.Join(root, "uploads"),
+			TempDir:      filepath.Join(root, "temp"),
+			WorkspaceDir: filepath.Join(root, "sessions"),
+		},
+		store: progress.NewMemoryStore(),
+		now:   time.Now(),
+	}
+	progress.SetStore(tree.store)
+	t.Cleanup(func() { progress.SetStore(progress.NewMemoryStore()) })
+	return tree
+}
+
+// file writes size bytes into path and backdates it by age
+func (tree *janitorTree) file(t *testing.T, path string, size int, age time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree.backdate(t, path, age)
+}
+
+func (tree *janitorTree) backdate(t *testing.T, path string, age time.Duration) {
+	t.Helper()
+	mtime := tree.now.Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// session stores the progress of a session last updated age ago, with a workspace
+// holding a 100 byte file and a 10 byte download zip
+func (tree *janitorTree) session(t *testing.T, id, status string, age time.Duration) {
+	t.Helper()
+	tree.file(t, filepath.Join(tree.config.WorkspaceDir, id, "final_result", "song.ogg"), 100, age)
+	tree.file(t, filepath.Join(tree.config.TempDir, id+"_karaoke.zip"), 10, 0)
+	msg := &progress.ProgressMessage{SessionID: id, Status: status, Timestamp: tree.now.Add(-age).Unix()}
+	if err := tree.store.Save(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRunOnceSessionTTL(t *testing.T) {
+	tree := newJanitorTree(t)
+	const (
+		oldComplete   = "1700000000_00000000000000a1"
+		newComplete   = "1700000000_00000000000000a2"
+		oldFailed     = "1700000000_00000000000000b1"
+		recentFailed  = "1700000000_00000000000000b2"
+		oldProcessing = "1700000000_00000000000000c1"
+		resumed       = "1700000000_00000000000000c2"
+		legacy        = "1700000000_song.mp3"
+	)
+	tree.session(t, oldComplete, progress.StatusComplete, 2*time.Hour)
+	tree.session(t, newComplete, progress.StatusComplete, 10*time.Minute)
+	tree.session(t, oldFailed, progress.StatusFailed, 48*time.Hour)
+	// A failed session is kept longer than a completed one so it can still be resumed
+	tree.session(t, recentFailed, progress.StatusFailed, 2*time.Hour)
+	// A running job never finished, whatever its age
+	tree.session(t, oldProcessing, progress.StatusProcessing, 48*time.Hour)
+	// A failed session that was resumed and waits in the queue
+	tree.session(t, resumed, progress.StatusFailed, 48*time.Hour)
+	// A session ID from before NewSessionID only has its progress cleared
+	if err := tree.store.Save(&progress.ProgressMessage{SessionID: legacy, Status: progress.StatusComplete, Timestamp: tree.now.Add(-48 * time.Hour).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+
+	jobQueue := queue.NewJobQueue(1, 10)
+	if _, err := jobQueue.Enqueue(resumed, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	report := New(tree.config, jobQueue).RunOnce()
+
+	evicted := append([]string(nil), report.SessionsEvicted...)
+	sort.Strings(evicted)
+	if want := []string{oldComplete, oldFailed, legacy}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+	for id, kept := range map[string]bool{
+		oldComplete: false, newComplete: true, oldFailed: false, recentFailed: true, oldProcessing: true, resumed: true,
+	} {
+		if got := exists(filepath.Join(tree.config.WorkspaceDir, id)); got != kept {
+			t.Errorf("workspace of %s exists: %v, want %v", id, got, kept)
+		}
+		if got := exists(filepath.Join(tree.config.TempDir, id+"_karaoke.zip")); got != kept {
+			t.Errorf("zip of %s exists: %v, want %v", id, got, kept)
+		}
+		if got := progress.GetProgress(id) != nil; got != kept {
+			t.Errorf("progress of %s exists: %v, want %v", id, got, kept)
+		}
+	}
+	if progress.GetProgress(legacy) != nil {
+		t.Errorf("progress of %s was kept", legacy)
+	}
+
+	if report.WorkspacesRemoved != 2 || report.TempFilesRemoved != 2 || report.UploadsRemoved != 0 {
+		t.Errorf("removed %d workspaces, %d temp files, %d uploads, want 2, 2 and 0",
+			report.WorkspacesRemoved, report.TempFilesRemoved, report.UploadsRemoved)
+	}
+	if report.BytesReclaimed != 2*(100+10) {
+		t.Errorf("reclaimed %d bytes, want %d", report.BytesReclaimed, 2*(100+10))
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("errors: %v", report.Errors)
+	}
+}
+
+func TestRunOnceOrphanWorkspaces(t *testing.T) {
+	tree := newJanitorTree(t)
+	const (
+		known     = "1700000000_00000000000000d1"
+		oldOrphan = "1700000000_00000000000000d2"
+		newOrphan = "1700000000_00000000000000d3"
+		running   = "1700000000_00000000000000d4"
+	)
+	tree.session(t, known, progress.StatusProcessing, 2*time.Hour)
+	for _, id := range []string{oldOrphan, running} {
+		dir := filepath.Join(tree.config.WorkspaceDir, id)
+		tree.file(t, filepath.Join(dir, "output", "vocals.wav"), 300, 2*time.Hour)
+		tree.file(t, filepath.Join(dir, "checkpoint.json"), 20, 2*time.Hour)
+		tree.backdate(t, dir, 2*time.Hour)
+	}
+	tree.file(t, filepath.Join(tree.config.WorkspaceDir, newOrphan, "checkpoint.json"), 20, 0)
+	// A stray file in the workspace directory is not a workspace
+	tree.file(t, filepath.Join(tree.config.WorkspaceDir, "notes.txt"), 5, 2*time.Hour)
+
+	// A job whose progress was lost, e.g. with a store that was reset, but which still runs
+	jobQueue := queue.NewJobQueue(1, 10)
+	if _, err := jobQueue.Enqueue(running, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	progress.ClearProgress(running)
+
+	report := New(tree.config, jobQueue).RunOnce()
+
+	for name, kept := range map[string]bool{known: true, oldOrphan: false, newOrphan: true, running: true, "notes.txt": true} {
+		if got := exists(filepath.Join(tree.config.WorkspaceDir, name)); got != kept {
+			t.Errorf("%s exists: %v, want %v", name, got, kept)
+		}
+	}
+	if report.WorkspacesRemoved != 1 || report.BytesReclaimed != 320 {
+		t.Errorf("removed %d workspaces reclaiming %d bytes, want 1 and 320", report.WorkspacesRemoved, report.BytesReclaimed)
+	}
+	if len(report.SessionsEvicted) != 0 {
+		t.Errorf("evicted %v", report.SessionsEvicted)
+	}
+}
+
+func TestRunOnceUploadsAndTemp(t *testing.T) {
+	tree := newJanitorTree(t)
+	upload := tree.config.UploadDir
+	temp := tree.config.TempDir
+	tree.file(t, filepath.Join(upload, "old.mp3"), 1000, 2*time.Hour)
+	tree.file(t, filepath.Join(upload, "new.mp3"), 1000, time.Minute)
+	tree.file(t, filepath.Join(temp, "old_karaoke.zip"), 50, 2*time.Hour)
+	tree.file(t, filepath.Join(temp, "new_karaoke.zip"), 50, time.Minute)
+	// An empty zip is a failed download packaging, removed once it can't be being written anymore
+	tree.file(t, filepath.Join(temp, "empty_karaoke.zip"), 0, 2*time.Minute)
+	tree.file(t, filepath.Join(temp, "writing_karaoke.zip"), 0, 0)
+
+	report := New(tree.config, nil).RunOnce()
+
+	for _, path := range []string{"old.mp3", "new.mp3"} {
+		if got, want := exists(filepath.Join(upload, path)), path == "new.mp3"; got != want {
+			t.Errorf("%s exists: %v, want %v", path, got, want)
+		}
+	}
+	for path, kept := range map[string]bool{
+		"old_karaoke.zip": false, "new_karaoke.zip": true, "empty_karaoke.zip": false, "writing_karaoke.zip": true,
+	} {
+		if got := exists(filepath.Join(temp, path)); got != kept {
+			t.Errorf("%s exists: %v, want %v", path, got, kept)
+		}
+	}
+	if report.UploadsRemoved != 1 || report.TempFilesRemoved != 2 || report.BytesReclaimed != 1050 {
+		t.Errorf("removed %d uploads and %d temp files reclaiming %d bytes, want 1, 2 and 1050",
+			report.UploadsRemoved, report.TempFilesRemoved, report.BytesReclaimed)
+	}
+
+	// A TTL of 0 keeps everything
+	tree.config.UploadTTL = 0
+	tree.config.TempTTL = 0
+	tree.file(t, filepath.Join(upload, "old.mp3"), 1000, 2*time.Hour)
+	if report := New(tree.config, nil).RunOnce(); report.UploadsRemoved != 0 || report.TempFilesRemoved != 0 {
+		t.Errorf("removed %d uploads and %d temp files with cleanup disabled", report.UploadsRemoved, report.TempFilesRemoved)
+	}
+}
+
+func TestLastReport(t *testing.T) {
+	tree := newJanitorTree(t)
+	j := New(tree.config, nil)
+	if j.LastReport() != nil {
+		t.Error("report before the first pass")
+	}
+	report := j.RunOnce()
+	if last := j.LastReport(); last == nil || !last.StartedAt.Equal(report.StartedAt) || last.FinishedAt.Before(last.StartedAt) {
+		t.Errorf("last report %+v, want %+v", last, report)
+	}
+}
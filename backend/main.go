@@ -2,20 +2,31 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/kataras/iris/v12"
 
 	// Import local package cần sử dụng đường dẫn tương đối từ module root
 
+	"karaoke_generator/audio"
+	"karaoke_generator/config"
 	"karaoke_generator/function"
+	"karaoke_generator/health"
+	"karaoke_generator/janitor"
 	"karaoke_generator/progress"
+	"karaoke_generator/queue"
 )
 
 type LyricsRequest struct {
@@ -23,16 +34,18 @@ type LyricsRequest struct {
 	Language string `json:"language"`
 }
 
-// ProcessMessage là struct để gửi cập nhật tiến trình qua WebSocket
-type ProcessMessage struct {
-	Type              string  `json:"type"`
-	Status            string  `json:"status"`
-	Message           string  `json:"message"`
-	Percentage        float64 `json:"percentage"`
-	CurrentStep       string  `json:"current_step"`
-	EstimatedTimeLeft string  `json:"estimated_time_left"`
-	SessionID         string  `json:"sessionId"`
-	Timestamp         int64   `json:"timestamp"`
+// ProcessMessage là message được đẩy tới client qua SSE (/api/progress/{sessionID}/stream)
+// và WebSocket (/api/progress/{sessionID}/ws), giống hệt kết quả của /api/progress/{sessionID}
+type ProcessMessage = progress.ProgressMessage
+
+// Khoảng thời gian gửi heartbeat để proxy không đóng kết nối stream đang rảnh
+const streamHeartbeatInterval = 15 * time.Second
+
+var progressUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// CORS đã cho phép mọi origin nên WebSocket cũng vậy
+	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
 // zipDirectory compresses a directory into a zip file
@@ -96,7 +109,172 @@ func zipDirectory(sourceDir, zipPath string) error {
 	return err
 }
 
+// Thời gian kết quả kiểm tra công cụ được dùng lại trước khi /api/health kiểm tra lại
+const healthReportMaxAge = 10 * time.Second
+
+// Thời gian danh sách model MFA được dùng lại trước khi một job mới kiểm tra lại ngôn ngữ của nó
+const languageReportMaxAge = time.Minute
+
+// Thời gian kết quả kiểm tra công cụ được dùng lại trước khi một job mới kiểm tra lại
+const toolsReportMaxAge = time.Minute
+
+// logHealthReport in kết quả kiểm tra từng công cụ và từng ngôn ngữ ra console
+func logHealthReport(report *health.Report) {
+	for _, check := range report.Checks {
+		fmt.Printf("[HEALTH] %-16s %-8s %s %s\n", check.Name, check.Status, check.Version, check.Detail)
+	}
+	for _, language := range report.Languages {
+		if language.Ready {
+			fmt.Printf("[HEALTH] language %d ready (%s / %s)\n", language.Language, language.Dictionary, language.Acoustic)
+		} else {
+			fmt.Printf("[HEALTH] language %d unavailable, missing %s\n", language.Language, strings.Join(language.Missing, ", "))
+		}
+	}
+	fmt.Println("[HEALTH] toolchain status:", report.Status)
+}
+
+// sessionWorkspace trả về workspace của session, hoặc từ chối request (lỗi 400) khi session ID
+// không đúng định dạng của NewSessionID, để ID như ".." không trỏ ra ngoài thư mục workspace
+func sessionWorkspace(ctx iris.Context, workspaceDir, sessionID string) (function.Workspace, bool) {
+	workspace, err := function.SessionWorkspace(workspaceDir, sessionID)
+	if err != nil {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.JSON(iris.Map{
+			"message": "Invalid session ID",
+			"error":   err.Error(),
+			"status":  "error",
+		})
+		return workspace, false
+	}
+	return workspace, true
+}
+
+// checkTools từ chối job khi một công cụ bị thiếu hoặc không dùng được (conda, Demucs, MFA, ffmpeg,
+// ffprobe, bộ mã hóa Opus...), vì job sẽ chắc chắn lỗi giữa chừng; trả về false (và đã trả lỗi 503)
+func checkTools(ctx iris.Context, checker *health.Checker) bool {
+	failed, ready := checker.ToolsReady(ctx.Request().Context(), toolsReportMaxAge)
+	if ready {
+		return true
+	}
+
+	problems := make([]string, 0, len(failed))
+	for _, check := range failed {
+		problems = append(problems, fmt.Sprintf("%s %s: %s", check.Name, check.Status, check.Detail))
+	}
+	ctx.StatusCode(iris.StatusServiceUnavailable)
+	ctx.JSON(iris.Map{
+		"message": "Required tools are unavailable",
+		"error":   strings.Join(problems, "; "),
+		"checks":  failed,
+		"status":  "error",
+	})
+	return false
+}
+
+// checkLanguage từ chối job của ngôn ngữ không hỗ trợ hoặc chưa cài model MFA;
+// trả về false (và đã trả lỗi) nếu job không thể chạy
+func checkLanguage(ctx iris.Context, checker *health.Checker, language int) bool {
+	if _, _, ok := function.MFAModels(language); !ok {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.JSON(iris.Map{
+			"message":   "Unsupported language",
+			"error":     fmt.Sprintf("language %d is not supported", language),
+			"languages": function.Languages(),
+			"status":    "error",
+		})
+		return false
+	}
+
+	if check, ready := checker.LanguageReady(ctx.Request().Context(), language, languageReportMaxAge); !ready {
+		ctx.StatusCode(iris.StatusServiceUnavailable)
+		ctx.JSON(iris.Map{
+			"message": "Alignment models for this language are not installed",
+			"error":   fmt.Sprintf("missing %s", strings.Join(check.Missing, ", ")),
+			"status":  "error",
+		})
+		return false
+	}
+	return true
+}
+
+// Phần dư cho phép của body ngoài file audio: lyrics, ngôn ngữ và header multipart
+const uploadFormOverhead = 1 << 20
+
+// limitUploadBody giới hạn kích thước body của request upload; trả về false (và đã trả lỗi 413)
+// nếu Content-Length đã vượt quá giới hạn
+func limitUploadBody(ctx iris.Context, limits audio.Limits) bool {
+	if limits.MaxBytes <= 0 {
+		return true
+	}
+	maxBody := limits.MaxBytes + uploadFormOverhead
+	if ctx.GetContentLength() > maxBody {
+		rejectUpload(ctx, iris.StatusRequestEntityTooLarge, "Upload is too large", fmt.Errorf("request body is larger than %d bytes", maxBody), limits)
+		return false
+	}
+	ctx.SetMaxRequestBodySize(maxBody)
+	return true
+}
+
+// rejectUpload trả lỗi 4xx cho một upload không hợp lệ, kèm danh sách định dạng và giới hạn được chấp nhận
+func rejectUpload(ctx iris.Context, status int, message string, err error, limits audio.Limits) {
+	ctx.StatusCode(status)
+	ctx.JSON(iris.Map{
+		"message":         message,
+		"error":           err.Error(),
+		"status":          "error",
+		"allowed_formats": audio.AllowedFormats,
+		"limits": iris.Map{
+			"max_bytes":          limits.MaxBytes,
+			"min_duration_sec":   limits.MinDuration,
+			"max_duration_sec":   limits.MaxDuration,
+			"min_sample_rate_hz": limits.MinSampleRate,
+		},
+	})
+}
+
+// uploadReadError trả lỗi khi không đọc được file upload: 413 nếu body vượt giới hạn, 400 nếu không
+func uploadReadError(ctx iris.Context, message string, err error, limits audio.Limits) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectUpload(ctx, iris.StatusRequestEntityTooLarge, "Upload is too large", err, limits)
+		return
+	}
+	rejectUpload(ctx, iris.StatusBadRequest, message, err, limits)
+}
+
+// validateUpload kiểm tra file audio đã lưu bằng ffprobe; trả về false (và đã trả lỗi) nếu file bị từ chối
+func validateUpload(ctx iris.Context, ffprobePath, path string, limits audio.Limits) (audio.Format, audio.Info, bool) {
+	format, info, err := audio.Validate(ctx.Request().Context(), ffprobePath, path, limits)
+	if err != nil {
+		var invalid *audio.ValidationError
+		if errors.Is(err, audio.ErrFileTooLarge) {
+			rejectUpload(ctx, iris.StatusRequestEntityTooLarge, "Upload is too large", err, limits)
+		} else if errors.As(err, &invalid) {
+			rejectUpload(ctx, iris.StatusUnsupportedMediaType, "Invalid audio file", err, limits)
+		} else {
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{
+				"message": "Failed to inspect audio file",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+		}
+		return format, info, false
+	}
+	return format, info, true
+}
+
 func main() {
+	// Cấu hình đọc từ file YAML/TOML (-config hoặc KARAOKE_CONFIG) rồi ghi đè bằng biến môi trường KARAOKE_*
+	configPath := flag.String("config", os.Getenv("KARAOKE_CONFIG"), "path to a YAML or TOML config file")
+	flag.Parse()
+
+	appConfig, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Println("Failed to load configuration:", err)
+		os.Exit(1)
+	}
+
 	app := iris.New()
 
 	// Allow OPTIONS method for CORS preflight requests
@@ -131,12 +309,88 @@ func main() {
 		ctx.Next()
 	})
 
+	// Lưu tiến trình ra file để các session vẫn còn sau khi khởi động lại (progress.store: memory để chỉ giữ trong bộ nhớ)
+	if appConfig.Progress.Store == "file" {
+		store, err := progress.NewFileStore(appConfig.Progress.StorePath)
+		if err != nil {
+			fmt.Println("Failed to open progress store:", err)
+			os.Exit(1)
+		}
+		progress.SetStore(store)
+	}
+	if interrupted := progress.MarkInterrupted(); len(interrupted) > 0 {
+		fmt.Printf("Marked %d jobs interrupted by the restart: %v\n", len(interrupted), interrupted)
+	}
+
+	// Thời lượng đo được của từng bước, dùng để ước lượng thời gian còn lại cho các job sau
+	estimator, err := progress.NewEstimator(appConfig.Progress.ETAStorePath)
+	if err != nil {
+		fmt.Println("Failed to load step durations, starting without history:", err)
+		estimator, _ = progress.NewEstimator("")
+	}
+	progress.SetEstimator(estimator)
+
+	// Đường dẫn các công cụ bên ngoài, thư mục làm việc, cache stem, timeout và số lần thử lại
+	// của từng bước cùng thông số mã hóa OGG và ASS, được truyền vào từng job
+	jobOptions := appConfig.JobOptions()
+
+	// Kiểm tra conda, ffmpeg, MFA và các model ngay khi khởi động thay vì đợi job của người dùng bị lỗi
+	healthChecker := health.NewChecker(jobOptions.Tools)
+	logHealthReport(healthChecker.Report(context.Background(), 0))
+
+	// Bản build thiếu -tags opus mã hóa stem OGG bằng libopus của ffmpeg
+	if !audio.OpusAvailable {
+		fmt.Println("[HEALTH] built without -tags opus, OGG stems are encoded with ffmpeg -c:a libopus")
+	}
+
+	// Giới hạn của file audio được upload: kích thước, độ dài và sample rate tối thiểu
+	uploadLimits := audio.Limits{
+		MaxBytes:      int64(appConfig.Upload.MaxMB) << 20,
+		MinDuration:   float64(appConfig.Upload.MinAudioSeconds),
+		MaxDuration:   float64(appConfig.Upload.MaxAudioSeconds),
+		MinSampleRate: appConfig.Upload.MinSampleRate,
+	}
+
+	// Hàng đợi job: giới hạn số job Demucs/MFA chạy cùng lúc và số job được phép chờ
+	jobQueue := queue.NewJobQueue(appConfig.Queue.Workers, appConfig.Queue.MaxQueued)
+	jobQueue.Start()
+
 	// Set up upload directory
-	uploadDir := "./uploads"
+	uploadDir := appConfig.Storage.UploadDir
 	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		os.Mkdir(uploadDir, 0755)
+		os.MkdirAll(uploadDir, 0755)
 	}
 
+	// Thư mục tạm chứa các file zip để tải về
+	tempDir := appConfig.Storage.TempDir
+
+	// Dọn dẹp định kỳ các session hết hạn cùng workspace, file upload và file zip tạm của chúng
+	sessionJanitor := janitor.New(janitor.Config{
+		Interval:     appConfig.Janitor.Interval.Duration,
+		CompletedTTL: appConfig.Janitor.SessionTTL.Duration,
+		FailedTTL:    appConfig.Janitor.FailedSessionTTL.Duration,
+		UploadTTL:    appConfig.Janitor.UploadTTL.Duration,
+		TempTTL:      appConfig.Janitor.TempTTL.Duration,
+		UploadDir:    uploadDir,
+		TempDir:      tempDir,
+		WorkspaceDir: jobOptions.WorkspaceDir,
+	}, jobQueue)
+	sessionJanitor.Start()
+
+	// API kiểm tra tình trạng các công cụ: có mặt hay không, phiên bản và model MFA của từng ngôn ngữ
+	app.Get("/api/health", func(ctx iris.Context) {
+		report := healthChecker.Report(ctx.Request().Context(), healthReportMaxAge)
+		status := "success"
+		if report.Status == health.StatusError {
+			ctx.StatusCode(iris.StatusServiceUnavailable)
+			status = "error"
+		}
+		ctx.JSON(iris.Map{
+			"health": report,
+			"status": status,
+		})
+	})
+
 	// Hello world endpoint
 	app.Get("/api/hello", func(ctx iris.Context) {
 		ctx.JSON(iris.Map{
@@ -172,6 +426,42 @@ func main() {
 		ctx.JSON(progressInfo)
 	})
 
+	// API để lấy toàn bộ lịch sử sự kiện và timeline các bước của session
+	app.Get("/api/progress/{sessionID}/history", func(ctx iris.Context) {
+		sessionID := ctx.Params().Get("sessionID")
+
+		history := progress.GetHistory(sessionID)
+		if len(history) == 0 {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{
+				"message": "Session not found",
+				"status":  "error",
+			})
+			return
+		}
+
+		// Tổng thời gian tính từ sự kiện đầu tiên tới sự kiện cuối cùng
+		totalDurationMs := history[len(history)-1].TimestampMs - history[0].TimestampMs
+
+		ctx.JSON(iris.Map{
+			"session_id":        sessionID,
+			"events":            history,
+			"steps":             progress.GetTimeline(sessionID),
+			"total_duration_ms": totalDurationMs,
+			"status":            "success",
+		})
+	})
+
+	// Stream tiến trình qua Server-Sent Events, không cần polling
+	app.Get("/api/progress/{sessionID}/stream", func(ctx iris.Context) {
+		streamProgressSSE(ctx, ctx.Params().Get("sessionID"))
+	})
+
+	// Stream tiến trình qua WebSocket
+	app.Get("/api/progress/{sessionID}/ws", func(ctx iris.Context) {
+		streamProgressWebSocket(ctx, ctx.Params().Get("sessionID"))
+	})
+
 	// API endpoint để cập nhật tiến trình theo cách thủ công (để test)
 	app.Post("/api/progress/update", func(ctx iris.Context) {
 		var request struct {
@@ -208,21 +498,31 @@ func main() {
 
 	// Upload audio endpoint
 	app.Post("/api/upload", func(ctx iris.Context) {
+		if !limitUploadBody(ctx, uploadLimits) {
+			return
+		}
+
 		file, info, err := ctx.FormFile("audio")
 		if err != nil {
-			ctx.StatusCode(iris.StatusBadRequest)
+			uploadReadError(ctx, "Failed to upload file", err, uploadLimits)
+			return
+		}
+
+		defer file.Close()
+
+		// Tên file lưu trên server do server tạo, tên gốc của client chỉ được trả lại như metadata
+		storageID, err := function.NewSessionID()
+		if err != nil {
+			ctx.StatusCode(iris.StatusInternalServerError)
 			ctx.JSON(iris.Map{
-				"message": "Failed to upload file",
+				"message": "Failed to create file",
 				"error":   err.Error(),
 				"status":  "error",
 			})
 			return
 		}
-
-		defer file.Close()
-
-		// Create a unique filename
-		filename := fmt.Sprintf("%s/%s", uploadDir, info.Filename)
+		storedName := function.StoredFilename(storageID, info.Filename)
+		filename := filepath.Join(uploadDir, storedName)
 
 		// Create a new file on the server
 		out, err := os.Create(filename)
@@ -248,11 +548,23 @@ func main() {
 			})
 			return
 		}
+		out.Close()
+
+		// Kiểm tra nội dung file, không tin vào tên file hay Content-Type do client gửi
+		format, audioInfo, ok := validateUpload(ctx, jobOptions.Tools.FFprobePath, filename, uploadLimits)
+		if !ok {
+			os.Remove(filename)
+			return
+		}
 
 		ctx.JSON(iris.Map{
-			"message":  "File uploaded successfully",
-			"filename": info.Filename,
-			"status":   "success",
+			"message":           "File uploaded successfully",
+			"filename":          storedName,
+			"original_filename": info.Filename,
+			"format":            format,
+			"duration":          audioInfo.Duration,
+			"sample_rate":       audioInfo.SampleRate,
+			"status":            "success",
 		})
 	})
 
@@ -286,33 +598,98 @@ func main() {
 
 	// Generate Karaoke from upload endpoint
 	app.Post("/api/generate-karaoke-from-upload", func(ctx iris.Context) {
+		// Từ chối sớm khi hàng đợi đã đầy để không phải lưu file vô ích
+		if jobQueue.IsFull() {
+			ctx.StatusCode(iris.StatusTooManyRequests)
+			ctx.JSON(iris.Map{
+				"message": "Job queue is full, please try again later",
+				"status":  "error",
+			})
+			return
+		}
+
+		// Không nhận job khi thiếu công cụ, job sẽ chắc chắn lỗi sau vài phút xử lý
+		if !checkTools(ctx, healthChecker) {
+			return
+		}
+
+		if !limitUploadBody(ctx, uploadLimits) {
+			return
+		}
+
 		// Lấy file audio đã tải lên
 		file, info, err := ctx.FormFile("audio")
+		if err != nil {
+			uploadReadError(ctx, "Failed to get audio file", err, uploadLimits)
+			return
+		}
+		defer file.Close()
+
+		// Các định dạng audio bổ sung (codec, bitrate, sample rate, số kênh) được mã hóa vào gói kết quả
+		outputProfiles, err := function.ParseOutputProfiles(ctx.FormValue("output_profiles"))
 		if err != nil {
 			ctx.StatusCode(iris.StatusBadRequest)
 			ctx.JSON(iris.Map{
-				"message": "Failed to get audio file",
+				"message": "Invalid output profiles",
 				"error":   err.Error(),
 				"status":  "error",
 			})
 			return
 		}
-		defer file.Close()
+		options := jobOptions
+		options.OutputProfiles = outputProfiles
 
-		// Đảm bảo thư mục input tồn tại
-		inputDir := filepath.Join("function", "input")
-		if err := os.MkdirAll(inputDir, 0755); err != nil {
+		// Tạo một session ID ngẫu nhiên, không phụ thuộc vào tên file do client gửi lên
+		sessionID, err := function.NewSessionID()
+		if err != nil {
 			ctx.StatusCode(iris.StatusInternalServerError)
 			ctx.JSON(iris.Map{
-				"message": "Failed to create input directory",
+				"message": "Failed to create session",
 				"error":   err.Error(),
 				"status":  "error",
 			})
 			return
 		}
 
-		// Lưu file vào thư mục input thay vì uploads
-		audioPath := filepath.Join(inputDir, info.Filename)
+		// Mỗi session có một workspace riêng để các job chạy song song không ghi đè lên nhau
+		workspace, err := function.NewWorkspace(jobOptions.WorkspaceDir, sessionID)
+		// Workspace bị xóa ở mọi nhánh lỗi, chỉ giữ lại khi job đã vào hàng đợi
+		enqueued := false
+		defer func() {
+			if !enqueued {
+				function.RemoveWorkspace(jobOptions.WorkspaceDir, sessionID)
+			}
+		}()
+		if err != nil {
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{
+				"message": "Failed to create session workspace",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
+		inputDir := workspace.InputDir()
+
+		// Lưu file vào thư mục upload của session dưới tên do server đặt; tên gốc chỉ được lưu làm metadata.
+		// File gốc nằm ngoài thư mục input vì đó là corpus của MFA
+		audioPath := filepath.Join(workspace.UploadDir(), function.StoredFilename(function.StoredAudioBase, info.Filename))
+		if err := function.SaveUploadMetadata(workspace, function.UploadMetadata{
+			OriginalFilename: info.Filename,
+			StoredFilename:   filepath.Base(audioPath),
+			Size:             info.Size,
+			UploadedAt:       time.Now(),
+			Title:            strings.TrimSpace(ctx.FormValue("title")),
+			Artist:           strings.TrimSpace(ctx.FormValue("artist")),
+		}); err != nil {
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{
+				"message": "Failed to save audio file",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
 		out, err := os.Create(audioPath)
 		if err != nil {
 			ctx.StatusCode(iris.StatusInternalServerError)
@@ -334,6 +711,13 @@ func main() {
 			})
 			return
 		}
+		out.Close()
+
+		// Từ chối ngay những file không phải audio hợp lệ thay vì để Demucs lỗi sau vài phút
+		format, audioInfo, ok := validateUpload(ctx, jobOptions.Tools.FFprobePath, audioPath, uploadLimits)
+		if !ok {
+			return
+		}
 
 		// Lấy lyrics và ngôn ngữ từ form
 		lyrics := ctx.FormValue("lyrics")
@@ -343,8 +727,7 @@ func main() {
 		}
 
 		// Tạo tên file .lab cho lyrics
-		filename := strings.TrimSuffix(info.Filename, filepath.Ext(info.Filename))
-		labFilename := fmt.Sprintf("%s.lab", filename)
+		labFilename := fmt.Sprintf("%s.lab", function.StoredAudioBase)
 		labPath := filepath.Join(inputDir, labFilename)
 
 		// Lưu nội dung lyrics vào file .lab
@@ -378,27 +761,178 @@ func main() {
 			return
 		}
 
-		// Tạo một session ID dựa trên thời gian và tên file
-		sessionID := fmt.Sprintf("%d_%s", time.Now().Unix(), filename)
+		// Không nhận job nếu thiếu model MFA của ngôn ngữ này, job sẽ chắc chắn lỗi ở bước căn chỉnh
+		if !checkLanguage(ctx, healthChecker, languageInt) {
+			return
+		}
 
-		// Bắt đầu xử lý karaoke trong goroutine riêng biệt
-		go simulateKaraokeProcessing(sessionID, audioPath, labPath, languageInt)
+		// Đưa job vào hàng đợi, worker sẽ xử lý khi có chỗ trống
+		position, err := jobQueue.Enqueue(sessionID, func(jobCtx context.Context) error {
+			return simulateKaraokeProcessing(jobCtx, options, sessionID, audioPath, labPath, languageInt)
+		})
+		if err != nil {
+			status := iris.StatusInternalServerError
+			if errors.Is(err, queue.ErrQueueFull) {
+				status = iris.StatusTooManyRequests
+			} else if errors.Is(err, queue.ErrDuplicateJob) {
+				status = iris.StatusConflict
+			}
+			ctx.StatusCode(status)
+			ctx.JSON(iris.Map{
+				"message": "Failed to queue karaoke job",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
+		enqueued = true
 
 		// Trả về phản hồi thành công với đường dẫn các file và sessionID
 		ctx.JSON(iris.Map{
-			"message":    "Files uploaded successfully",
-			"status":     "success",
-			"session_id": sessionID,
+			"message":        "Files uploaded successfully",
+			"status":         "success",
+			"session_id":     sessionID,
+			"queue_position": position,
 			"request_info": iris.Map{
-				"audio_file":    audioPath,
-				"lyrics_file":   labPath,
-				"filesize":      info.Size,
-				"lyrics_length": len(lyrics),
-				"language":      language,
+				"audio_file":        audioPath,
+				"original_filename": info.Filename,
+				"lyrics_file":       labPath,
+				"filesize":          info.Size,
+				"format":            format,
+				"duration":          audioInfo.Duration,
+				"sample_rate":       audioInfo.SampleRate,
+				"lyrics_length":     len(lyrics),
+				"language":          language,
+				"output_profiles":   outputProfiles,
 			},
 		})
 	})
 
+	// API để hủy một job đang chờ hoặc đang chạy
+	app.Delete("/api/jobs/{sessionID}", func(ctx iris.Context) {
+		sessionID := ctx.Params().Get("sessionID")
+
+		state, err := jobQueue.Cancel(sessionID)
+		if errors.Is(err, queue.ErrJobNotFound) {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{
+				"message": "Job not found",
+				"status":  "error",
+			})
+			return
+		}
+		if errors.Is(err, queue.ErrJobFinished) {
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{
+				"message":   "Job already finished",
+				"status":    "error",
+				"job_state": state,
+			})
+			return
+		}
+
+		// Job chưa chạy: dọn dẹp ngay. Job đang chạy sẽ tự dọn dẹp khi tiến trình con bị dừng.
+		if state == queue.JobQueued {
+			if err := function.RemoveWorkspace(jobOptions.WorkspaceDir, sessionID); err != nil {
+				fmt.Println("Failed to remove workspace of cancelled session:", err)
+			}
+			progress.CancelProgress(sessionID, "Job cancelled before it started")
+			ctx.JSON(iris.Map{
+				"message": "Job cancelled",
+				"status":  "success",
+			})
+			return
+		}
+
+		ctx.StatusCode(iris.StatusAccepted)
+		ctx.JSON(iris.Map{
+			"message": "Job cancellation requested",
+			"status":  "success",
+		})
+	})
+
+	// API để tiếp tục một job bị lỗi hoặc bị gián đoạn từ bước chưa hoàn thành đầu tiên
+	app.Post("/api/jobs/{sessionID}/resume", func(ctx iris.Context) {
+		sessionID := ctx.Params().Get("sessionID")
+
+		workspace, ok := sessionWorkspace(ctx, jobOptions.WorkspaceDir, sessionID)
+		if !ok {
+			return
+		}
+		checkpoint, err := function.LoadCheckpoint(workspace)
+		if err != nil {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{
+				"message": "No checkpoint found for this session",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
+
+		if !checkTools(ctx, healthChecker) || !checkLanguage(ctx, healthChecker, checkpoint.Language) {
+			return
+		}
+
+		position, err := jobQueue.Enqueue(sessionID, func(jobCtx context.Context) error {
+			return simulateKaraokeProcessing(jobCtx, jobOptions, sessionID, checkpoint.AudioFile, checkpoint.LyricsFile, checkpoint.Language)
+		})
+		if err != nil {
+			status := iris.StatusInternalServerError
+			if errors.Is(err, queue.ErrQueueFull) {
+				status = iris.StatusTooManyRequests
+			} else if errors.Is(err, queue.ErrDuplicateJob) {
+				status = iris.StatusConflict
+			}
+			ctx.StatusCode(status)
+			ctx.JSON(iris.Map{
+				"message": "Failed to queue resumed job",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
+
+		completed := make([]string, 0, len(checkpoint.CompletedSteps))
+		for _, step := range checkpoint.CompletedSteps {
+			completed = append(completed, step.Name)
+		}
+
+		ctx.JSON(iris.Map{
+			"message":         "Job resumed",
+			"status":          "success",
+			"session_id":      sessionID,
+			"queue_position":  position,
+			"completed_steps": completed,
+		})
+	})
+
+	// API để xem lần dọn dẹp gần nhất đã thu hồi những gì
+	app.Get("/api/janitor/report", func(ctx iris.Context) {
+		report := sessionJanitor.LastReport()
+		if report == nil {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{
+				"message": "No cleanup has run yet",
+				"status":  "error",
+			})
+			return
+		}
+		ctx.JSON(iris.Map{
+			"report": report,
+			"status": "success",
+		})
+	})
+
+	// API để chạy dọn dẹp ngay lập tức
+	app.Post("/api/janitor/run", func(ctx iris.Context) {
+		report := sessionJanitor.RunOnce()
+		ctx.JSON(iris.Map{
+			"report": report,
+			"status": "success",
+		})
+	})
+
 	// Get supported languages endpoint
 	app.Get("/api/languages", func(ctx iris.Context) {
 		languages := []map[string]string{
@@ -454,8 +988,40 @@ func main() {
 			return
 		}
 
+		// Không trả kết quả của một job thất bại
+		if progressInfo.Status == progress.StatusFailed {
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{
+				"message":  "Processing failed, no results available",
+				"status":   "error",
+				"progress": progressInfo,
+			})
+			return
+		}
+
+		// Job đã bị hủy hoặc bị gián đoạn sẽ không bao giờ tự hoàn thành, client không nên chờ tiếp
+		switch progressInfo.Status {
+		case progress.StatusCancelled:
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{
+				"message":  "Processing was cancelled, no results available",
+				"status":   progressInfo.Status,
+				"progress": progressInfo,
+			})
+			return
+		case progress.StatusInterrupted:
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{
+				"message":    "Processing was interrupted by a server restart, resume the job to continue",
+				"status":     progressInfo.Status,
+				"progress":   progressInfo,
+				"resume_url": fmt.Sprintf("/api/jobs/%s/resume", sessionID),
+			})
+			return
+		}
+
 		// Kiểm tra trạng thái
-		if progressInfo.Percentage < 100 {
+		if progressInfo.Status != progress.StatusComplete {
 			ctx.StatusCode(iris.StatusAccepted)
 			ctx.JSON(iris.Map{
 				"message":  "Processing not completed yet",
@@ -465,8 +1031,12 @@ func main() {
 			return
 		}
 
-		// Đường dẫn đến thư mục chứa dữ liệu đầu ra
-		outputDir := "./function/final_result"
+		// Đường dẫn đến thư mục chứa dữ liệu đầu ra của session
+		workspace, ok := sessionWorkspace(ctx, jobOptions.WorkspaceDir, sessionID)
+		if !ok {
+			return
+		}
+		outputDir := workspace.FinalResultDir()
 
 		// Đảm bảo thư mục tồn tại
 		if _, err := os.Stat(outputDir); os.IsNotExist(err) {
@@ -479,7 +1049,6 @@ func main() {
 		}
 
 		// Tạo thư mục tạm để lưu file zip
-		tempDir := "./temp"
 		if err := os.MkdirAll(tempDir, 0755); err != nil {
 			ctx.StatusCode(iris.StatusInternalServerError)
 			ctx.JSON(iris.Map{
@@ -526,13 +1095,247 @@ func main() {
 		ctx.SendFile(zipPath, zipFileName)
 	})
 
+	// API để tải riêng lời bài hát ở định dạng cho trình phát (LRC, LRC mở rộng theo từng từ, ...)
+	app.Get("/api/lyrics/{sessionID}/{format}", func(ctx iris.Context) {
+		sessionID := ctx.Params().Get("sessionID")
+		format := ctx.Params().Get("format")
+
+		exporter, ok := function.LyricsExporterFor(format)
+		if !ok {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{
+				"message": "Unknown lyrics format",
+				"formats": function.LyricsFormats(),
+				"status":  "error",
+			})
+			return
+		}
+
+		// Lời bài hát chỉ có sau khi job đã hoàn thành
+		progressInfo := progress.GetProgress(sessionID)
+		if progressInfo == nil || progressInfo.Status != progress.StatusComplete {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{
+				"message": "No completed session found",
+				"status":  "error",
+			})
+			return
+		}
+
+		workspace, ok := sessionWorkspace(ctx, jobOptions.WorkspaceDir, sessionID)
+		if !ok {
+			return
+		}
+		lyrics, err := function.LoadSessionLyrics(workspace)
+		if err != nil {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{
+				"message": "Lyrics not found for this session",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
+
+		// offset (ms) dời lời bài hát sớm hơn (dương) hoặc muộn hơn (âm) ở các định dạng hỗ trợ
+		metadata := function.SessionLyricsMetadata(workspace, lyrics)
+		if offset := ctx.URLParam("offset"); offset != "" {
+			metadata.OffsetMs, err = strconv.Atoi(offset)
+			if err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{
+					"message": "Invalid offset",
+					"error":   err.Error(),
+					"status":  "error",
+				})
+				return
+			}
+		}
+
+		data, err := exporter.Render(lyrics, metadata, function.LyricsExportOptions{ASS: jobOptions.ASS})
+		if err != nil {
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{
+				"message": "Failed to export lyrics",
+				"error":   err.Error(),
+				"status":  "error",
+			})
+			return
+		}
+
+		filename := fmt.Sprintf("%s_%s", sessionID, exporter.Filename)
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+		ctx.ContentType(exporter.ContentType)
+		ctx.Write(data)
+	})
+
 	// Start the server
-	app.Listen(":8080")
+	app.Listen(appConfig.Server.Addr)
 }
 
 // Giả lập quá trình xử lý karaoke và gửi cập nhật
-func simulateKaraokeProcessing(sessionID, audioPath, lyricsPath string, language int) {
-	function.GenerateKaraokeFromUpload(audioPath, lyricsPath, sessionID, language)
-	// // Gửi thông báo hoàn thành
+func simulateKaraokeProcessing(ctx context.Context, options function.JobOptions, sessionID, audioPath, lyricsPath string, language int) error {
+	if err := function.GenerateKaraokeFromUpload(ctx, options, audioPath, lyricsPath, sessionID, language); err != nil {
+		// Job bị hủy: tiến trình con đã bị dừng, xóa các file dở dang của session
+		if ctx.Err() != nil {
+			if err := function.RemoveWorkspace(options.WorkspaceDir, sessionID); err != nil {
+				fmt.Println("Failed to remove workspace of cancelled session:", err)
+			}
+			progress.CancelProgress(sessionID, "Job cancelled")
+			return ctx.Err()
+		}
+		reportFailure(sessionID, err)
+		return err
+	}
+
+	// Gửi thông báo hoàn thành
 	progress.UpdateProgress(sessionID, 100, "Process completed", "Completed")
+	return nil
+}
+
+// reportFailure ghi trạng thái thất bại của session kèm bước lỗi, mã lỗi và phần cuối stderr
+func reportFailure(sessionID string, err error) {
+	var stepErr *function.StepError
+	if errors.As(err, &stepErr) {
+		progress.FailProgress(sessionID, stepErr.Step, stepErr.Code, err.Error(), stepErr.StderrTail)
+		return
+	}
+	progress.FailProgress(sessionID, "unknown", queue.ErrCodeInternal, err.Error(), "")
+}
+
+// streamProgressSSE gửi trạng thái hiện tại rồi từng cập nhật của session dưới dạng Server-Sent Events,
+// cho tới khi session kết thúc hoặc client ngắt kết nối
+func streamProgressSSE(ctx iris.Context, sessionID string) {
+	flusher, ok := ctx.ResponseWriter().Flusher()
+	if !ok {
+		ctx.StatusCode(iris.StatusInternalServerError)
+		ctx.JSON(iris.Map{
+			"message": "Streaming not supported",
+			"status":  "error",
+		})
+		return
+	}
+
+	// Đăng ký trước khi đọc trạng thái hiện tại để không bỏ lỡ cập nhật nào ở giữa
+	updates, unsubscribe := progress.Subscribe(sessionID)
+	defer unsubscribe()
+
+	current := progress.GetProgress(sessionID)
+	if current == nil {
+		ctx.StatusCode(iris.StatusNotFound)
+		ctx.JSON(iris.Map{
+			"message": "Session not found",
+			"status":  "error",
+		})
+		return
+	}
+
+	ctx.ContentType("text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+
+	send := func(msg ProcessMessage) error {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(ctx.ResponseWriter(), "event: progress\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := send(*current); err != nil || progress.IsTerminal(current.Status) {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(ctx.ResponseWriter(), ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case msg := <-updates:
+			if err := send(msg); err != nil || progress.IsTerminal(msg.Status) {
+				return
+			}
+		}
+	}
+}
+
+// streamProgressWebSocket gửi trạng thái hiện tại rồi từng cập nhật của session qua WebSocket,
+// sau đó đóng kết nối khi session kết thúc
+func streamProgressWebSocket(ctx iris.Context, sessionID string) {
+	updates, unsubscribe := progress.Subscribe(sessionID)
+	defer unsubscribe()
+
+	current := progress.GetProgress(sessionID)
+	if current == nil {
+		ctx.StatusCode(iris.StatusNotFound)
+		ctx.JSON(iris.Map{
+			"message": "Session not found",
+			"status":  "error",
+		})
+		return
+	}
+
+	conn, err := progressUpgrader.Upgrade(ctx.ResponseWriter(), ctx.Request(), nil)
+	if err != nil {
+		// Upgrade đã tự trả lỗi HTTP cho client
+		fmt.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Client không gửi gì; vòng đọc chỉ để phát hiện khi client đóng kết nối
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg ProcessMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(streamHeartbeatInterval))
+		return conn.WriteJSON(msg)
+	}
+
+	if err := send(*current); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	status := current.Status
+	for !progress.IsTerminal(status) {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamHeartbeatInterval)); err != nil {
+				return
+			}
+		case msg := <-updates:
+			if err := send(msg); err != nil {
+				return
+			}
+			status = msg.Status
+		}
+	}
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session finished"),
+		time.Now().Add(time.Second))
 }
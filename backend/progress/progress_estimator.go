@@ -0,0 +1,264 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// estimatorSmoothing là trọng số của lần đo mới nhất khi cập nhật tốc độ của một bước
+const estimatorSmoothing = 0.3
+
+// StepRate là tốc độ xử lý đã đo của một bước: số giây xử lý cho mỗi giây audio đầu vào
+type StepRate struct {
+	SecondsPerAudioSecond float64 `json:"seconds_per_audio_second"`
+	Samples               int     `json:"samples"`
+}
+
+// Estimator học thời lượng của từng bước từ các job trước, theo độ dài audio,
+// và lưu lại ra file để ước lượng ngày càng chính xác qua các lần khởi động
+type Estimator struct {
+	path  string
+	rates map[string]*StepRate
+	mutex sync.Mutex
+}
+
+// NewEstimator mở (hoặc tạo mới) dữ liệu ước lượng lưu ở path. path rỗng nghĩa là chỉ giữ trong bộ nhớ.
+func NewEstimator(path string) (*Estimator, error) {
+	estimator := &Estimator{path: path, rates: make(map[string]*StepRate)}
+	if path == "" {
+		return estimator, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return estimator, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading step durations: %w", err)
+	}
+	if err := json.Unmarshal(content, &estimator.rates); err != nil {
+		return nil, fmt.Errorf("error parsing step durations %s: %w", path, err)
+	}
+	return estimator, nil
+}
+
+// Record ghi nhận một lần chạy thành công của step trên audioSeconds giây audio
+func (e *Estimator) Record(step string, audioSeconds float64, duration time.Duration) {
+	if audioSeconds <= 0 {
+		return
+	}
+	sample := duration.Seconds() / audioSeconds
+
+	e.mutex.Lock()
+	rate, ok := e.rates[step]
+	if !ok {
+		rate = &StepRate{}
+		e.rates[step] = rate
+	}
+	if rate.Samples == 0 {
+		rate.SecondsPerAudioSecond = sample
+	} else {
+		rate.SecondsPerAudioSecond += estimatorSmoothing * (sample - rate.SecondsPerAudioSecond)
+	}
+	rate.Samples++
+	err := e.flush()
+	e.mutex.Unlock()
+
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to store step durations: %v\n", err)
+	}
+}
+
+// Expected trả về thời lượng dự kiến của step với audioSeconds giây audio, false nếu chưa có dữ liệu
+func (e *Estimator) Expected(step string, audioSeconds float64) (time.Duration, bool) {
+	if audioSeconds <= 0 {
+		return 0, false
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	rate, ok := e.rates[step]
+	if !ok || rate.Samples == 0 {
+		return 0, false
+	}
+	return time.Duration(rate.SecondsPerAudioSecond * audioSeconds * float64(time.Second)), true
+}
+
+// flush ghi dữ liệu ra file tạm rồi đổi tên; phải được gọi khi đang giữ mutex
+func (e *Estimator) flush() error {
+	if e.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(e.rates, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpPath := e.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, e.path)
+}
+
+// sessionPlan là các bước còn lại của một job đang chạy, dùng để tính thời gian còn lại
+type sessionPlan struct {
+	audioSeconds float64
+	remaining    []string
+	current      string
+	startedAt    time.Time
+	firstUpdate  time.Time
+}
+
+var (
+	estimator   *Estimator
+	plans       = make(map[string]*sessionPlan)
+	planMutex   sync.Mutex
+	estimatorMu sync.RWMutex
+)
+
+// SetEstimator đặt Estimator dùng để tính thời gian còn lại, cần gọi lúc khởi động
+func SetEstimator(e *Estimator) {
+	estimatorMu.Lock()
+	estimator = e
+	estimatorMu.Unlock()
+}
+
+func getEstimator() *Estimator {
+	estimatorMu.RLock()
+	defer estimatorMu.RUnlock()
+	return estimator
+}
+
+// PlanSteps khai báo các bước sắp chạy của session và độ dài audio đầu vào (giây),
+// để thời gian còn lại được tính từ thời lượng đo được của các job trước
+func PlanSteps(sessionID string, steps []string, audioSeconds float64) {
+	planMutex.Lock()
+	plans[sessionID] = &sessionPlan{
+		audioSeconds: audioSeconds,
+		remaining:    append([]string(nil), steps...),
+		firstUpdate:  time.Now(),
+	}
+	planMutex.Unlock()
+}
+
+// ReplanSteps thay các bước còn lại của session khi biết thêm bước nào sẽ được bỏ qua,
+// giữ nguyên thời điểm bắt đầu của job và bước đang chạy
+func ReplanSteps(sessionID string, steps []string) {
+	planMutex.Lock()
+	if plan, ok := plans[sessionID]; ok {
+		plan.remaining = append([]string(nil), steps...)
+	}
+	planMutex.Unlock()
+}
+
+// planStepStarted đánh dấu step là bước đang chạy của session
+func planStepStarted(sessionID, step string) {
+	planMutex.Lock()
+	defer planMutex.Unlock()
+
+	if plan, ok := plans[sessionID]; ok {
+		plan.current = step
+		plan.startedAt = time.Now()
+	}
+}
+
+// planStepDone bỏ step khỏi các bước còn lại; nếu step chạy thành công thì học thời lượng của nó
+func planStepDone(sessionID, step string, succeeded bool) {
+	planMutex.Lock()
+	plan, ok := plans[sessionID]
+	if !ok {
+		planMutex.Unlock()
+		return
+	}
+	var duration time.Duration
+	measured := succeeded && plan.current == step
+	if measured {
+		duration = time.Since(plan.startedAt)
+	}
+	if plan.current == step {
+		plan.current = ""
+	}
+	for i, name := range plan.remaining {
+		if name == step {
+			plan.remaining = append(plan.remaining[:i], plan.remaining[i+1:]...)
+			break
+		}
+	}
+	audioSeconds := plan.audioSeconds
+	planMutex.Unlock()
+
+	if e := getEstimator(); measured && e != nil {
+		e.Record(step, audioSeconds, duration)
+	}
+}
+
+// forgetPlan xóa kế hoạch của một session đã kết thúc
+func forgetPlan(sessionID string) {
+	planMutex.Lock()
+	delete(plans, sessionID)
+	planMutex.Unlock()
+}
+
+// estimateTimeLeft ước lượng thời gian còn lại của session. Ưu tiên thời lượng đã học của các bước
+// còn lại; nếu thiếu dữ liệu thì ngoại suy từ tốc độ của chính job này.
+func estimateTimeLeft(sessionID string, percentage float64) (time.Duration, bool) {
+	planMutex.Lock()
+	plan, ok := plans[sessionID]
+	if !ok {
+		planMutex.Unlock()
+		return 0, false
+	}
+	remaining := append([]string(nil), plan.remaining...)
+	current, startedAt := plan.current, plan.startedAt
+	audioSeconds, firstUpdate := plan.audioSeconds, plan.firstUpdate
+	planMutex.Unlock()
+
+	if e := getEstimator(); e != nil {
+		var total time.Duration
+		known := true
+		for _, step := range remaining {
+			expected, ok := e.Expected(step, audioSeconds)
+			if !ok {
+				known = false
+				break
+			}
+			if step == current {
+				// Bước đang chạy chỉ còn phần chưa làm, và không bao giờ âm
+				expected -= time.Since(startedAt)
+				if expected < 0 {
+					expected = 0
+				}
+			}
+			total += expected
+		}
+		if known {
+			return total, true
+		}
+	}
+
+	if percentage <= 0 {
+		return 0, false
+	}
+	elapsed := time.Since(firstUpdate)
+	return time.Duration(float64(elapsed) * (100 - percentage) / percentage), true
+}
+
+// formatTimeLeft đổi thời gian còn lại thành chuỗi hiển thị cho người dùng
+func formatTimeLeft(left time.Duration) string {
+	if left < time.Minute {
+		return "Less than a minute"
+	}
+	minutes := left.Minutes()
+	if minutes < 1.5 {
+		return "About 1 minute"
+	}
+	return fmt.Sprintf("About %.0f minutes", minutes)
+}
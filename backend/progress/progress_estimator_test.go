@@ -0,0 +1,182 @@
+package progress
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useEstimator đặt e làm Estimator trong lúc test chạy
+func useEstimator(t *testing.T, e *Estimator) {
+	t.Helper()
+	SetEstimator(e)
+	t.Cleanup(func() { SetEstimator(nil) })
+}
+
+// newEstimator tạo Estimator chỉ giữ trong bộ nhớ
+func newEstimator(t *testing.T) *Estimator {
+	t.Helper()
+	e, err := NewEstimator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// within báo got có lệch khỏi want không quá tolerance
+func within(got, want, tolerance time.Duration) bool {
+	return got >= want-tolerance && got <= want+tolerance
+}
+
+func TestEstimatorSmoothing(t *testing.T) {
+	e := newEstimator(t)
+	if _, ok := e.Expected("separation", 200); ok {
+		t.Error("Expected returned a duration before any data")
+	}
+
+	// Lần đo đầu tiên được dùng nguyên, các lần sau được làm mượt
+	e.Record("separation", 100, 100*time.Second)
+	e.Record("separation", 100, 200*time.Second)
+	e.Record("separation", 50, 25*time.Second)
+
+	want := 1.0
+	want += estimatorSmoothing * (2.0 - want)
+	want += estimatorSmoothing * (0.5 - want)
+	rate := e.rates["separation"]
+	if rate.Samples != 3 || math.Abs(rate.SecondsPerAudioSecond-want) > 1e-9 {
+		t.Errorf("rate %+v, want %v over 3 samples", rate, want)
+	}
+	if got, ok := e.Expected("separation", 200); !ok || !within(got, time.Duration(want*200*float64(time.Second)), time.Millisecond) {
+		t.Errorf("Expected(200s) = %v, %v", got, ok)
+	}
+
+	// Không có độ dài audio thì không học và không ước lượng được gì
+	e.Record("alignment", 0, time.Minute)
+	if _, ok := e.rates["alignment"]; ok {
+		t.Error("a run without the audio duration was recorded")
+	}
+	if _, ok := e.Expected("separation", 0); ok {
+		t.Error("Expected returned a duration without the audio duration")
+	}
+}
+
+func TestEstimatorPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "step_durations.json")
+	e, err := NewEstimator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Record("separation", 100, 150*time.Second)
+	e.Record("alignment", 100, 30*time.Second)
+
+	// Như khi server khởi động lại
+	reopened, err := NewEstimator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for step, want := range map[string]time.Duration{"separation": 300 * time.Second, "alignment": 60 * time.Second} {
+		if got, ok := reopened.Expected(step, 200); !ok || !within(got, want, time.Millisecond) {
+			t.Errorf("%s after reload: %v, %v, want %v", step, got, ok, want)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEstimator(path); err == nil {
+		t.Error("a corrupt file was accepted")
+	}
+}
+
+func TestEstimateTimeLeftFromSteps(t *testing.T) {
+	e := newEstimator(t)
+	e.Record("separation", 100, 100*time.Second)
+	e.Record("alignment", 100, 50*time.Second)
+	useEstimator(t, e)
+
+	const sessionID = "estimate-steps"
+	t.Cleanup(func() { forgetPlan(sessionID) })
+	PlanSteps(sessionID, []string{"separation", "alignment"}, 100)
+	if left, ok := estimateTimeLeft(sessionID, 0); !ok || !within(left, 150*time.Second, time.Second) {
+		t.Errorf("time left before the job started: %v, %v, want 150s", left, ok)
+	}
+
+	// Bước đang chạy chỉ còn phần chưa làm
+	planStepStarted(sessionID, "separation")
+	plans[sessionID].startedAt = time.Now().Add(-40 * time.Second)
+	if left, ok := estimateTimeLeft(sessionID, 10); !ok || !within(left, 110*time.Second, time.Second) {
+		t.Errorf("time left 40s into separation: %v, %v, want 110s", left, ok)
+	}
+
+	// Một bước chạy lâu hơn dự kiến không làm thời gian còn lại âm
+	plans[sessionID].startedAt = time.Now().Add(-500 * time.Second)
+	if left, ok := estimateTimeLeft(sessionID, 10); !ok || !within(left, 50*time.Second, time.Second) {
+		t.Errorf("time left after separation overran: %v, %v, want 50s", left, ok)
+	}
+}
+
+func TestEstimateTimeLeftFallback(t *testing.T) {
+	e := newEstimator(t)
+	e.Record("separation", 100, 100*time.Second)
+	useEstimator(t, e)
+
+	// alignment chưa có dữ liệu, nên thời gian còn lại được ngoại suy từ tốc độ của chính job này
+	const sessionID = "estimate-fallback"
+	t.Cleanup(func() { forgetPlan(sessionID) })
+	PlanSteps(sessionID, []string{"separation", "alignment"}, 100)
+	plans[sessionID].firstUpdate = time.Now().Add(-60 * time.Second)
+
+	if _, ok := estimateTimeLeft(sessionID, 0); ok {
+		t.Error("estimated a time left with no data and no progress")
+	}
+	if left, ok := estimateTimeLeft(sessionID, 25); !ok || !within(left, 180*time.Second, time.Second) {
+		t.Errorf("time left at 25%% after 60s: %v, %v, want 180s", left, ok)
+	}
+	if _, ok := estimateTimeLeft("no-plan", 50); ok {
+		t.Error("estimated a time left for a session without a plan")
+	}
+}
+
+func TestPlanStepDoneRecords(t *testing.T) {
+	e := newEstimator(t)
+	useEstimator(t, e)
+
+	const sessionID = "plan-step-done"
+	t.Cleanup(func() { forgetPlan(sessionID) })
+	PlanSteps(sessionID, []string{"separation", "alignment", "archive"}, 100)
+
+	planStepStarted(sessionID, "separation")
+	plans[sessionID].startedAt = time.Now().Add(-50 * time.Second)
+	planStepDone(sessionID, "separation", true)
+	if got, ok := e.Expected("separation", 100); !ok || !within(got, 50*time.Second, time.Second) {
+		t.Errorf("separation learned %v, %v, want 50s", got, ok)
+	}
+
+	// Một bước lỗi hoặc bị bỏ qua không được học, nhưng không còn được tính vào thời gian còn lại
+	planStepStarted(sessionID, "alignment")
+	planStepDone(sessionID, "alignment", false)
+	planStepDone(sessionID, "archive", false)
+	if _, ok := e.Expected("alignment", 100); ok {
+		t.Error("a failed step was learned")
+	}
+	if plan := plans[sessionID]; len(plan.remaining) != 0 || plan.current != "" {
+		t.Errorf("plan after every step finished: %+v", plan)
+	}
+}
+
+func TestFormatTimeLeft(t *testing.T) {
+	for left, want := range map[time.Duration]string{
+		30 * time.Second: "Less than a minute",
+		80 * time.Second: "About 1 minute",
+		10 * time.Minute: "About 10 minutes",
+	} {
+		if got := formatTimeLeft(left); got != want {
+			t.Errorf("formatTimeLeft(%v) = %q, want %q", left, got, want)
+		}
+	}
+}
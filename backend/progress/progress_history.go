@@ -0,0 +1,182 @@
+package progress
+
+import (
+	"fmt"
+	"time"
+)
+
+// Các loại sự kiện trong lịch sử của session
+const (
+	// Một cập nhật tiến trình (UpdateProgress, FailProgress, ...)
+	EventProgress = "progress"
+	// Một bước của pipeline bắt đầu
+	EventStepStart = "step_start"
+	// Một bước của pipeline kết thúc, kèm thời lượng
+	EventStepEnd = "step_end"
+	// Một bước của pipeline được bỏ qua
+	EventStepSkipped = "step_skipped"
+	// Một thông báo tự do, ví dụ một lần thử lại
+	EventMessage = "message"
+)
+
+// Trạng thái của một bước trong timeline
+const (
+	StepStatusRunning   = "running"
+	StepStatusCompleted = "completed"
+	StepStatusFailed    = "failed"
+	StepStatusSkipped   = "skipped"
+)
+
+// HistoryEntry là một sự kiện trong lịch sử xử lý của session
+type HistoryEntry struct {
+	Kind       string  `json:"kind"`
+	Step       string  `json:"step"`
+	Message    string  `json:"message"`
+	Status     string  `json:"status,omitempty"`
+	Percentage float64 `json:"percentage,omitempty"`
+	// Thời lượng của bước, chỉ có với sự kiện step_end
+	DurationMs int64 `json:"duration_ms,omitempty"`
+	Timestamp  int64 `json:"timestamp"`
+	// Thời điểm chính xác tới mili giây, dùng để tính thời lượng
+	TimestampMs int64 `json:"timestamp_ms"`
+}
+
+// StepTiming là một dòng trong timeline các bước của session
+type StepTiming struct {
+	Step         string `json:"step"`
+	Status       string `json:"status"`
+	StartedAtMs  int64  `json:"started_at_ms,omitempty"`
+	FinishedAtMs int64  `json:"finished_at_ms,omitempty"`
+	DurationMs   int64  `json:"duration_ms"`
+}
+
+// AddHistory ghi thêm một thông báo vào lịch sử xử lý của session
+func AddHistory(sessionID, step, message string) {
+	appendHistory(sessionID, HistoryEntry{Kind: EventMessage, Step: step, Message: message})
+}
+
+// StepStarted ghi nhận một bước bắt đầu chạy
+func StepStarted(sessionID, step string) {
+	planStepStarted(sessionID, step)
+	appendHistory(sessionID, HistoryEntry{
+		Kind:    EventStepStart,
+		Step:    step,
+		Message: fmt.Sprintf("%s started", step),
+		Status:  StepStatusRunning,
+	})
+}
+
+// StepFinished ghi nhận một bước kết thúc (err nil là thành công) cùng thời lượng kể từ StepStarted
+func StepFinished(sessionID, step string, err error) {
+	planStepDone(sessionID, step, err == nil)
+	now := time.Now()
+	entry := HistoryEntry{
+		Kind:        EventStepEnd,
+		Step:        step,
+		Message:     fmt.Sprintf("%s completed", step),
+		Status:      StepStatusCompleted,
+		Timestamp:   now.Unix(),
+		TimestampMs: now.UnixMilli(),
+	}
+	if err != nil {
+		entry.Message = fmt.Sprintf("%s failed: %v", step, err)
+		entry.Status = StepStatusFailed
+	}
+
+	history := GetHistory(sessionID)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Kind == EventStepStart && history[i].Step == step {
+			entry.DurationMs = entry.TimestampMs - history[i].TimestampMs
+			break
+		}
+	}
+
+	appendHistory(sessionID, entry)
+}
+
+// StepSkipped ghi nhận một bước được bỏ qua và lý do
+func StepSkipped(sessionID, step, reason string) {
+	planStepDone(sessionID, step, false)
+	appendHistory(sessionID, HistoryEntry{
+		Kind:    EventStepSkipped,
+		Step:    step,
+		Message: reason,
+		Status:  StepStatusSkipped,
+	})
+}
+
+// GetHistory trả về bản sao lịch sử xử lý của session
+func GetHistory(sessionID string) []HistoryEntry {
+	manager := GetProgressManager()
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	history, err := manager.store.History(sessionID)
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to load history of %s: %v\n", sessionID, err)
+		return nil
+	}
+	return history
+}
+
+// GetTimeline dựng timeline các bước của session từ lịch sử: mỗi lần chạy một bước là một dòng,
+// theo thứ tự bắt đầu. Một bước chưa kết thúc có thời lượng tính tới hiện tại.
+func GetTimeline(sessionID string) []StepTiming {
+	var timeline []StepTiming
+	open := make(map[string]int)
+
+	for _, entry := range GetHistory(sessionID) {
+		switch entry.Kind {
+		case EventStepStart:
+			open[entry.Step] = len(timeline)
+			timeline = append(timeline, StepTiming{
+				Step:        entry.Step,
+				Status:      StepStatusRunning,
+				StartedAtMs: entry.TimestampMs,
+			})
+		case EventStepEnd:
+			i, ok := open[entry.Step]
+			if !ok {
+				continue
+			}
+			delete(open, entry.Step)
+			timeline[i].Status = entry.Status
+			timeline[i].FinishedAtMs = entry.TimestampMs
+			timeline[i].DurationMs = entry.DurationMs
+		case EventStepSkipped:
+			timeline = append(timeline, StepTiming{
+				Step:         entry.Step,
+				Status:       StepStatusSkipped,
+				StartedAtMs:  entry.TimestampMs,
+				FinishedAtMs: entry.TimestampMs,
+			})
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	for _, i := range open {
+		timeline[i].DurationMs = now - timeline[i].StartedAtMs
+	}
+	return timeline
+}
+
+// appendHistory đóng dấu thời gian cho sự kiện (nếu chưa có) rồi ghi vào store
+func appendHistory(sessionID string, entry HistoryEntry) {
+	manager := GetProgressManager()
+
+	if entry.TimestampMs == 0 {
+		now := time.Now()
+		entry.Timestamp = now.Unix()
+		entry.TimestampMs = now.UnixMilli()
+	}
+
+	manager.mutex.RLock()
+	err := manager.store.AppendHistory(sessionID, entry)
+	manager.mutex.RUnlock()
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to store history of %s: %v\n", sessionID, err)
+	}
+
+	fmt.Printf("[HISTORY] %s %s %s: %s\n", sessionID, entry.Kind, entry.Step, entry.Message)
+}
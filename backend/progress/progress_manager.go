@@ -7,24 +7,46 @@ import (
 	"time"
 )
 
+// Các trạng thái của một session
+const (
+	StatusQueued     = "queued"
+	StatusStart      = "start"
+	StatusProcessing = "processing"
+	StatusComplete   = "complete"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+	// Job bị gián đoạn vì server khởi động lại khi đang chờ hoặc đang chạy
+	StatusInterrupted = "interrupted"
+)
+
 // ProgressMessage là struct để gửi cập nhật tiến trình
 type ProgressMessage struct {
-	Type            string  `json:"type"`
-	Status          string  `json:"status"`
-	Message         string  `json:"message"`
-	Percentage      float64 `json:"percentage"`
-	CurrentStep     string  `json:"current_step"`
+	Type              string  `json:"type"`
+	Status            string  `json:"status"`
+	Message           string  `json:"message"`
+	Percentage        float64 `json:"percentage"`
+	CurrentStep       string  `json:"current_step"`
 	EstimatedTimeLeft string  `json:"estimated_time_left"`
-	SessionID       string  `json:"sessionId"`
-	Timestamp       int64   `json:"timestamp"`
+	SessionID         string  `json:"sessionId"`
+	Timestamp         int64   `json:"timestamp"`
+	// Vị trí trong hàng đợi (1 là job tiếp theo được chạy), chỉ có khi Status là "queued"
+	QueuePosition int `json:"queue_position,omitempty"`
+	// Thông tin lỗi, chỉ có khi Status là "failed"
+	FailedStep string `json:"failed_step,omitempty"`
+	ErrorCode  string `json:"error_code,omitempty"`
+	StderrTail string `json:"stderr_tail,omitempty"`
+	// Thời gian còn lại tính bằng giây, để client tự hiển thị
+	EstimatedSecondsLeft int64 `json:"estimated_seconds_left,omitempty"`
+	// CacheHit cho biết session đang dùng lại kết quả tách stem đã lưu trong cache
+	CacheHit bool `json:"cache_hit,omitempty"`
 }
 
 // ProgressManager quản lý tiến trình cho mỗi phiên (session)
 type ProgressManager struct {
-	// Dùng map để lưu trữ tiến trình theo sessionID
-	sessions     map[string]*ProgressMessage
-	// Đảm bảo thread-safe khi nhiều goroutine cùng truy cập
-	mutex       sync.RWMutex
+	// Nơi lưu tiến trình và lịch sử theo sessionID (bộ nhớ trong hoặc file trên đĩa)
+	store Store
+	// Đảm bảo các thao tác đọc-rồi-ghi trên cùng session không chen nhau
+	mutex sync.RWMutex
 }
 
 // Global instance của ProgressManager
@@ -35,57 +57,245 @@ var once sync.Once
 func GetProgressManager() *ProgressManager {
 	once.Do(func() {
 		progressManager = &ProgressManager{
-			sessions: make(map[string]*ProgressMessage),
+			store: NewMemoryStore(),
 		}
 	})
 	return progressManager
 }
 
+// SetStore thay store của ProgressManager, cần gọi lúc khởi động trước khi có job nào chạy
+func SetStore(store Store) {
+	manager := GetProgressManager()
+
+	manager.mutex.Lock()
+	manager.store = store
+	manager.mutex.Unlock()
+}
+
+// MarkInterrupted đánh dấu các session còn đang chờ hoặc đang chạy trong store là bị gián đoạn.
+// Gọi lúc khởi động: không job nào của lần chạy trước còn sống, nên các session đó sẽ không bao giờ tự hoàn thành.
+func MarkInterrupted() []string {
+	manager := GetProgressManager()
+
+	manager.mutex.RLock()
+	sessions, err := manager.store.List()
+	manager.mutex.RUnlock()
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to list sessions: %v\n", err)
+		return nil
+	}
+
+	var interrupted []string
+	for _, msg := range sessions {
+		// Trạng thái được kiểm tra lại trong lock, vì session có thể đã được cập nhật sau khi liệt kê
+		manager.update(msg.SessionID, func(previous *ProgressMessage) *ProgressMessage {
+			if previous == nil {
+				return nil
+			}
+			switch previous.Status {
+			case StatusQueued, StatusStart, StatusProcessing:
+			default:
+				return nil
+			}
+
+			previous.Status = StatusInterrupted
+			previous.Message = "Interrupted by a server restart, resume the job to continue"
+			previous.EstimatedTimeLeft = "Interrupted"
+			previous.QueuePosition = 0
+			previous.Timestamp = time.Now().Unix()
+			interrupted = append(interrupted, previous.SessionID)
+			return previous
+		})
+	}
+	return interrupted
+}
+
+// ListProgress trả về trạng thái của mọi session đã biết
+func ListProgress() []*ProgressMessage {
+	manager := GetProgressManager()
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	sessions, err := manager.store.List()
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to list sessions: %v\n", err)
+		return nil
+	}
+	return sessions
+}
+
 // UpdateProgress cập nhật tiến trình xử lý với phần trăm và message
 // Đây là hàm chính bạn sẽ gọi từ bất kỳ đâu để cập nhật tiến trình
 func UpdateProgress(sessionID string, percentage float64, message string, currentStep string) {
 	manager := GetProgressManager()
-	
-	// Tính toán thời gian còn lại (đơn giản hóa)
-	var estimatedTimeLeft string
+
+	// Tính toán thời gian còn lại từ thời lượng đo được của các bước còn lại
+	estimatedTimeLeft := "Completed"
+	var estimatedSecondsLeft int64
 	if percentage < 100 {
-		// Giả sử còn 1 phút cho mỗi 10% còn lại
-		remainingMinutes := (100 - percentage) / 10
-		if remainingMinutes < 1 {
-			estimatedTimeLeft = "Less than a minute"
-		} else {
-			estimatedTimeLeft = fmt.Sprintf("About %.0f minutes", remainingMinutes)
+		estimatedTimeLeft = "Calculating"
+		if left, ok := estimateTimeLeft(sessionID, percentage); ok {
+			estimatedTimeLeft = formatTimeLeft(left)
+			estimatedSecondsLeft = int64(left.Seconds())
 		}
-	} else {
-		estimatedTimeLeft = "Completed"
 	}
-	
+
 	// Xác định trạng thái dựa trên phần trăm
-	status := "processing"
+	status := StatusProcessing
 	if percentage <= 0 {
-		status = "start"
+		status = StatusStart
 	} else if percentage >= 100 {
-		status = "complete"
+		status = StatusComplete
 	}
-	
+
 	// Tạo thông điệp tiến trình
 	progressMsg := &ProgressMessage{
-		Type:            "process_update",
-		Status:          status,
-		Message:         message,
-		Percentage:      percentage,
-		CurrentStep:     currentStep,
+		Type:              "process_update",
+		Status:            status,
+		Message:           message,
+		Percentage:        percentage,
+		CurrentStep:       currentStep,
 		EstimatedTimeLeft: estimatedTimeLeft,
-		SessionID:       sessionID,
-		Timestamp:       time.Now().Unix(),
+		SessionID:         sessionID,
+		Timestamp:         time.Now().Unix(),
+
+		EstimatedSecondsLeft: estimatedSecondsLeft,
 	}
-	
-	// Lưu vào bộ nhớ
+
+	manager.save(progressMsg)
+}
+
+// UpdateQueuePosition ghi nhận một session đang chờ trong hàng đợi ở vị trí position
+func UpdateQueuePosition(sessionID string, position int) {
+	GetProgressManager().save(&ProgressMessage{
+		Type:              "process_update",
+		Status:            StatusQueued,
+		Message:           fmt.Sprintf("Waiting in queue (position %d)", position),
+		Percentage:        0,
+		CurrentStep:       "Queued",
+		EstimatedTimeLeft: "Waiting for a free worker",
+		SessionID:         sessionID,
+		Timestamp:         time.Now().Unix(),
+		QueuePosition:     position,
+	})
+}
+
+// FailProgress đánh dấu session thất bại tại bước failedStep.
+// Phần trăm được giữ nguyên để client biết job đã dừng ở đâu.
+func FailProgress(sessionID, failedStep, errorCode, message, stderrTail string) {
+	GetProgressManager().update(sessionID, func(previous *ProgressMessage) *ProgressMessage {
+		var percentage float64
+		if previous != nil {
+			percentage = previous.Percentage
+		}
+		return &ProgressMessage{
+			Type:              "process_update",
+			Status:            StatusFailed,
+			Message:           message,
+			Percentage:        percentage,
+			CurrentStep:       failedStep,
+			EstimatedTimeLeft: "Failed",
+			SessionID:         sessionID,
+			Timestamp:         time.Now().Unix(),
+			FailedStep:        failedStep,
+			ErrorCode:         errorCode,
+			StderrTail:        stderrTail,
+		}
+	})
+}
+
+// CancelProgress đánh dấu session đã bị người dùng hủy
+func CancelProgress(sessionID, message string) {
+	GetProgressManager().update(sessionID, func(previous *ProgressMessage) *ProgressMessage {
+		var percentage float64
+		var currentStep string
+		if previous != nil {
+			percentage = previous.Percentage
+			currentStep = previous.CurrentStep
+		}
+		return &ProgressMessage{
+			Type:              "process_update",
+			Status:            StatusCancelled,
+			Message:           message,
+			Percentage:        percentage,
+			CurrentStep:       currentStep,
+			EstimatedTimeLeft: "Cancelled",
+			SessionID:         sessionID,
+			Timestamp:         time.Now().Unix(),
+		}
+	})
+}
+
+// ReportCacheHit ghi nhận session dùng lại dữ liệu từ cache.
+// Các cập nhật tiến trình sau đó của session vẫn giữ cờ cache_hit.
+func ReportCacheHit(sessionID, step, message string) {
+	GetProgressManager().update(sessionID, func(previous *ProgressMessage) *ProgressMessage {
+		progressMsg := ProgressMessage{
+			Type:              "process_update",
+			Status:            StatusProcessing,
+			CurrentStep:       step,
+			EstimatedTimeLeft: "Calculating",
+			SessionID:         sessionID,
+		}
+		if previous != nil {
+			progressMsg = *previous
+		}
+		progressMsg.Message = message
+		progressMsg.CacheHit = true
+		progressMsg.Timestamp = time.Now().Unix()
+		return &progressMsg
+	})
+}
+
+// save lưu thông điệp vào bộ nhớ và in ra console để theo dõi
+func (manager *ProgressManager) save(progressMsg *ProgressMessage) {
+	manager.update(progressMsg.SessionID, func(*ProgressMessage) *ProgressMessage {
+		return progressMsg
+	})
+}
+
+// update tạo thông điệp mới từ trạng thái hiện tại của session rồi lưu nó, đọc và ghi trong cùng
+// một lần giữ lock để hai cập nhật đồng thời không ghi đè lên nhau. build nhận nil nếu session
+// chưa có tiến trình, và có thể trả về nil để không ghi gì.
+func (manager *ProgressManager) update(sessionID string, build func(previous *ProgressMessage) *ProgressMessage) {
 	manager.mutex.Lock()
-	manager.sessions[sessionID] = progressMsg
+	previous, err := manager.store.Load(sessionID)
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to load progress of %s: %v\n", sessionID, err)
+		previous = nil
+	}
+	progressMsg := build(previous)
+	if progressMsg == nil {
+		manager.mutex.Unlock()
+		return
+	}
+	if previous != nil && previous.CacheHit && progressMsg.Status != StatusQueued {
+		progressMsg.CacheHit = true
+	}
+	err = manager.store.Save(progressMsg)
+	if err == nil {
+		// Mỗi cập nhật cũng là một sự kiện trong lịch sử của session
+		err = manager.store.AppendHistory(progressMsg.SessionID, HistoryEntry{
+			Kind:        EventProgress,
+			Step:        progressMsg.CurrentStep,
+			Message:     progressMsg.Message,
+			Status:      progressMsg.Status,
+			Percentage:  progressMsg.Percentage,
+			Timestamp:   progressMsg.Timestamp,
+			TimestampMs: time.Now().UnixMilli(),
+		})
+	}
+	if IsTerminal(progressMsg.Status) {
+		forgetPlan(progressMsg.SessionID)
+	}
+	// Đẩy cập nhật tới các client đang theo dõi qua SSE/WebSocket, vẫn trong lock để giữ đúng thứ tự
+	progressBroker.publish(*progressMsg)
 	manager.mutex.Unlock()
-	
-	// In ra console để theo dõi
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to store progress of %s: %v\n", progressMsg.SessionID, err)
+	}
+
 	progressJSON, _ := json.Marshal(progressMsg)
 	fmt.Printf("[PROGRESS] %s\n", string(progressJSON))
 }
@@ -93,18 +303,26 @@ func UpdateProgress(sessionID string, percentage float64, message string, curren
 // Hàm lấy tiến trình hiện tại của một session
 func GetProgress(sessionID string) *ProgressMessage {
 	manager := GetProgressManager()
-	
+
 	manager.mutex.RLock()
 	defer manager.mutex.RUnlock()
-	
-	return manager.sessions[sessionID]
+
+	progressMsg, err := manager.store.Load(sessionID)
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to load progress of %s: %v\n", sessionID, err)
+		return nil
+	}
+	return progressMsg
 }
 
 // Hàm xóa tiến trình khi hoàn thành
 func ClearProgress(sessionID string) {
 	manager := GetProgressManager()
-	
+
 	manager.mutex.Lock()
-	delete(manager.sessions, sessionID)
+	err := manager.store.Delete(sessionID)
 	manager.mutex.Unlock()
-} 
\ No newline at end of file
+	if err != nil {
+		fmt.Printf("[PROGRESS] failed to delete progress of %s: %v\n", sessionID, err)
+	}
+}
@@ -0,0 +1,110 @@
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// useMemoryStore cho test một store riêng, trả lại store rỗng khi test kết thúc
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	SetStore(NewMemoryStore())
+	t.Cleanup(func() { SetStore(NewMemoryStore()) })
+}
+
+func TestFailAndCancelKeepProgress(t *testing.T) {
+	useMemoryStore(t)
+
+	UpdateProgress("fail", 40, "alignment processing", "alignment")
+	FailProgress("fail", "alignment", "ALIGNMENT_FAILED", "alignment failed", "no TextGrid")
+	msg := GetProgress("fail")
+	if msg.Status != StatusFailed || msg.Percentage != 40 || msg.FailedStep != "alignment" || msg.ErrorCode != "ALIGNMENT_FAILED" || msg.StderrTail != "no TextGrid" {
+		t.Errorf("failed progress %+v", msg)
+	}
+
+	UpdateProgress("cancel", 25, "separation processing", "separation")
+	CancelProgress("cancel", "Job cancelled")
+	msg = GetProgress("cancel")
+	if msg.Status != StatusCancelled || msg.Percentage != 25 || msg.CurrentStep != "separation" {
+		t.Errorf("cancelled progress %+v", msg)
+	}
+
+	// Session chưa có tiến trình bắt đầu từ 0
+	FailProgress("unknown", "workspace", "WORKSPACE_ERROR", "no workspace", "")
+	if msg := GetProgress("unknown"); msg.Status != StatusFailed || msg.Percentage != 0 {
+		t.Errorf("failed progress of an unknown session %+v", msg)
+	}
+}
+
+func TestReportCacheHit(t *testing.T) {
+	useMemoryStore(t)
+
+	UpdateProgress("hit", 10, "stem_cache_lookup processing", "stem_cache_lookup")
+	ReportCacheHit("hit", "stem_cache_lookup", "Stem cache hit")
+	msg := GetProgress("hit")
+	if !msg.CacheHit || msg.Percentage != 10 || msg.Message != "Stem cache hit" {
+		t.Errorf("progress after the cache hit %+v", msg)
+	}
+
+	// Các cập nhật sau vẫn giữ cờ cache_hit, trừ khi session vào hàng đợi lại
+	UpdateProgress("hit", 50, "alignment processing", "alignment")
+	if !GetProgress("hit").CacheHit {
+		t.Error("cache_hit was lost by a later update")
+	}
+	UpdateQueuePosition("hit", 1)
+	if GetProgress("hit").CacheHit {
+		t.Error("cache_hit was kept by a requeued session")
+	}
+}
+
+func TestConcurrentUpdatesKeepTerminalStatus(t *testing.T) {
+	useMemoryStore(t)
+
+	// ReportCacheHit chép trạng thái hiện tại: nếu đọc và ghi không nằm trong cùng một lock,
+	// nó có thể ghi đè trạng thái failed vừa được lưu bằng bản processing đã cũ
+	for i := 0; i < 200; i++ {
+		sessionID := fmt.Sprintf("race-%d", i)
+		UpdateProgress(sessionID, 10, "stem_cache_lookup processing", "stem_cache_lookup")
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ReportCacheHit(sessionID, "stem_cache_lookup", "Stem cache hit")
+		}()
+		go func() {
+			defer wg.Done()
+			FailProgress(sessionID, "stem_cache_lookup", "STEP_FAILED", "failed", "")
+		}()
+		wg.Wait()
+
+		if msg := GetProgress(sessionID); msg.Status != StatusFailed {
+			t.Fatalf("%s is %q after it failed", sessionID, msg.Status)
+		}
+	}
+}
+
+func TestMarkInterrupted(t *testing.T) {
+	useMemoryStore(t)
+
+	UpdateQueuePosition("queued", 1)
+	UpdateProgress("running", 30, "separation processing", "separation")
+	UpdateProgress("done", 100, "Final files generated", "archive")
+	FailProgress("failed", "alignment", "ALIGNMENT_FAILED", "failed", "")
+
+	interrupted := MarkInterrupted()
+	if len(interrupted) != 2 {
+		t.Errorf("interrupted %v, want queued and running", interrupted)
+	}
+	for sessionID, want := range map[string]string{
+		"queued": StatusInterrupted, "running": StatusInterrupted, "done": StatusComplete, "failed": StatusFailed,
+	} {
+		if got := GetProgress(sessionID).Status; got != want {
+			t.Errorf("%s is %q, want %q", sessionID, got, want)
+		}
+	}
+	if msg := GetProgress("running"); msg.Percentage != 30 || msg.CurrentStep != "separation" {
+		t.Errorf("interrupted progress lost where the job stopped: %+v", msg)
+	}
+}
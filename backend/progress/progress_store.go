@@ -0,0 +1,273 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store là nơi lưu trạng thái tiến trình và lịch sử của các session.
+// ProgressManager chỉ làm việc qua interface này nên có thể thay bộ nhớ trong bằng file trên đĩa.
+type Store interface {
+	// Save ghi đè trạng thái hiện tại của một session
+	Save(msg *ProgressMessage) error
+	// Load trả về trạng thái của session, hoặc nil nếu không có
+	Load(sessionID string) (*ProgressMessage, error)
+	// List trả về trạng thái của mọi session, sắp xếp theo sessionID
+	List() ([]*ProgressMessage, error)
+	// AppendHistory ghi thêm một sự kiện vào lịch sử của session
+	AppendHistory(sessionID string, entry HistoryEntry) error
+	// History trả về lịch sử của session theo thứ tự thời gian
+	History(sessionID string) ([]HistoryEntry, error)
+	// Delete xóa trạng thái và lịch sử của session
+	Delete(sessionID string) error
+}
+
+// MemoryStore lưu mọi thứ trong bộ nhớ, mất hết khi server khởi động lại
+type MemoryStore struct {
+	sessions map[string]*ProgressMessage
+	history  map[string][]HistoryEntry
+	mutex    sync.RWMutex
+}
+
+// NewMemoryStore tạo một store trong bộ nhớ
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string]*ProgressMessage),
+		history:  make(map[string][]HistoryEntry),
+	}
+}
+
+func (s *MemoryStore) Save(msg *ProgressMessage) error {
+	copied := *msg
+	s.mutex.Lock()
+	s.sessions[msg.SessionID] = &copied
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Load(sessionID string) (*ProgressMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	msg, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *msg
+	return &copied, nil
+}
+
+func (s *MemoryStore) List() ([]*ProgressMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]*ProgressMessage, 0, len(s.sessions))
+	for _, msg := range s.sessions {
+		copied := *msg
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SessionID < list[j].SessionID
+	})
+	return list, nil
+}
+
+func (s *MemoryStore) AppendHistory(sessionID string, entry HistoryEntry) error {
+	s.mutex.Lock()
+	s.history[sessionID] = append(s.history[sessionID], entry)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) History(sessionID string) ([]HistoryEntry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]HistoryEntry(nil), s.history[sessionID]...), nil
+}
+
+func (s *MemoryStore) Delete(sessionID string) error {
+	s.mutex.Lock()
+	delete(s.sessions, sessionID)
+	delete(s.history, sessionID)
+	s.mutex.Unlock()
+	return nil
+}
+
+// Đuôi các file của FileStore: mỗi session có một file trạng thái và một file lịch sử
+const (
+	stateFileExt   = ".json"
+	historyFileExt = ".history.jsonl"
+)
+
+// FileStore giữ dữ liệu trong bộ nhớ và ghi ra một thư mục, mỗi session một file trạng thái
+// (ghi đè khi lưu) và một file lịch sử (chỉ ghi thêm từng dòng JSON), nên trạng thái các session
+// vẫn còn sau khi server khởi động lại và mỗi thay đổi chỉ ghi dữ liệu của một session
+type FileStore struct {
+	dir    string
+	memory *MemoryStore
+	// Tuần tự hóa việc ghi file
+	writeMutex sync.Mutex
+}
+
+// NewFileStore mở (hoặc tạo mới) store lưu trong thư mục dir
+func NewFileStore(dir string) (*FileStore, error) {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("progress store %s is a file, progress.store_path must be a directory", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating progress store directory: %w", err)
+	}
+
+	store := &FileStore{dir: dir, memory: NewMemoryStore()}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading progress store: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(name, historyFileExt):
+			history, err := readHistoryFile(path)
+			if err != nil {
+				return nil, err
+			}
+			store.memory.history[strings.TrimSuffix(name, historyFileExt)] = history
+		case strings.HasSuffix(name, stateFileExt):
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading progress store: %w", err)
+			}
+			var msg ProgressMessage
+			if err := json.Unmarshal(content, &msg); err != nil {
+				return nil, fmt.Errorf("error parsing progress store %s: %w", path, err)
+			}
+			msg.SessionID = strings.TrimSuffix(name, stateFileExt)
+			store.memory.sessions[msg.SessionID] = &msg
+		}
+	}
+	return store, nil
+}
+
+// readHistoryFile đọc file lịch sử, bỏ qua dòng cuối bị ghi dở nếu server dừng giữa chừng.
+// Dòng ghi dở được cắt khỏi file, nếu không sự kiện ghi thêm sau đó sẽ bị dính vào nó và mất theo.
+func readHistoryFile(path string) ([]HistoryEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading progress history: %w", err)
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = content[:bytes.LastIndexByte(content, '\n')+1]
+		if err := os.Truncate(path, int64(len(content))); err != nil {
+			return nil, fmt.Errorf("error repairing progress history: %w", err)
+		}
+	}
+
+	var history []HistoryEntry
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+func (s *FileStore) Save(msg *ProgressMessage) error {
+	path, err := s.sessionPath(msg.SessionID, stateFileExt)
+	if err != nil {
+		return err
+	}
+	s.memory.Save(msg)
+
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshaling progress: %w", err)
+	}
+
+	// Ghi ra file tạm rồi đổi tên, để file không bao giờ bị ghi dở
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return fmt.Errorf("error writing progress store: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error writing progress store: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Load(sessionID string) (*ProgressMessage, error) {
+	return s.memory.Load(sessionID)
+}
+
+func (s *FileStore) List() ([]*ProgressMessage, error) {
+	return s.memory.List()
+}
+
+func (s *FileStore) AppendHistory(sessionID string, entry HistoryEntry) error {
+	path, err := s.sessionPath(sessionID, historyFileExt)
+	if err != nil {
+		return err
+	}
+	s.memory.AppendHistory(sessionID, entry)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling progress history: %w", err)
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing progress history: %w", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing progress history: %w", err)
+	}
+	return file.Close()
+}
+
+func (s *FileStore) History(sessionID string) ([]HistoryEntry, error) {
+	return s.memory.History(sessionID)
+}
+
+func (s *FileStore) Delete(sessionID string) error {
+	s.memory.Delete(sessionID)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	for _, ext := range []string{stateFileExt, historyFileExt} {
+		path, err := s.sessionPath(sessionID, ext)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error deleting progress store: %w", err)
+		}
+	}
+	return nil
+}
+
+// sessionPath trả về file của session, từ chối ID có thể trỏ ra ngoài thư mục store
+func (s *FileStore) sessionPath(sessionID, ext string) (string, error) {
+	if sessionID == "" || sessionID == "." || sessionID == ".." || strings.ContainsAny(sessionID, `/\`) {
+		return "", fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	return filepath.Join(s.dir, sessionID+ext), nil
+}
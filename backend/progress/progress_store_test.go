@@ -0,0 +1,210 @@
+package progress
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// reopen mở lại store từ thư mục của nó, như khi server khởi động lại
+func reopen(t *testing.T, dir string) *FileStore {
+	t.Helper()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func sessionIDs(sessions []*ProgressMessage) []string {
+	var ids []string
+	for _, msg := range sessions {
+		ids = append(ids, msg.SessionID)
+	}
+	return ids
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := reopen(t, dir)
+
+	for _, msg := range []*ProgressMessage{
+		{SessionID: "b", Status: StatusProcessing, Percentage: 40, CurrentStep: "demucs"},
+		{SessionID: "a", Status: StatusQueued, QueuePosition: 2},
+		{SessionID: "b", Status: StatusComplete, Percentage: 100, CurrentStep: "archive"},
+	} {
+		if err := store.Save(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := []HistoryEntry{
+		{Kind: EventStepStart, Step: "demucs", TimestampMs: 1000},
+		{Kind: EventStepEnd, Step: "demucs", DurationMs: 2500, TimestampMs: 3500},
+	}
+	for _, entry := range history {
+		if err := store.AppendHistory("b", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store = reopen(t, dir)
+	msg, err := store.Load("b")
+	if err != nil || msg == nil {
+		t.Fatalf("Load(b) = %v, %v", msg, err)
+	}
+	if msg.Status != StatusComplete || msg.Percentage != 100 || msg.CurrentStep != "archive" {
+		t.Errorf("Load(b) = %+v, want the last saved state", msg)
+	}
+	if msg, err := store.Load("missing"); msg != nil || err != nil {
+		t.Errorf("Load(missing) = %v, %v, want nil", msg, err)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); !slices.Equal(ids, []string{"a", "b"}) {
+		t.Errorf("List() = %v, want [a b]", ids)
+	}
+
+	got, err := store.History("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, history) {
+		t.Errorf("History(b) = %+v, want %+v", got, history)
+	}
+
+	if err := store.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	store = reopen(t, dir)
+	if msg, _ := store.Load("b"); msg != nil {
+		t.Errorf("deleted session is still stored: %+v", msg)
+	}
+	if got, _ := store.History("b"); len(got) != 0 {
+		t.Errorf("history of a deleted session is still stored: %+v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b"+historyFileExt)); !os.IsNotExist(err) {
+		t.Errorf("history file of a deleted session remains: %v", err)
+	}
+	// Xóa một session không có file nào không phải là lỗi
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("Delete(missing) = %v", err)
+	}
+}
+
+func TestFileStoreTruncatedHistory(t *testing.T) {
+	dir := t.TempDir()
+	store := reopen(t, dir)
+	if err := store.AppendHistory("s", HistoryEntry{Kind: EventMessage, Message: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Server dừng giữa lúc ghi dòng thứ hai
+	path := filepath.Join(dir, "s"+historyFileExt)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"kind":"message","mess`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	store = reopen(t, dir)
+	history, _ := store.History("s")
+	if len(history) != 1 || history[0].Message != "first" {
+		t.Fatalf("History after a torn write = %+v, want only the first entry", history)
+	}
+
+	// Sự kiện ghi sau khi khởi động lại không bị dính vào dòng ghi dở
+	if err := store.AppendHistory("s", HistoryEntry{Kind: EventMessage, Message: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	store = reopen(t, dir)
+	history, _ = store.History("s")
+	if len(history) != 2 || history[1].Message != "second" {
+		t.Errorf("History after appending to a repaired file = %+v", history)
+	}
+}
+
+func TestFileStoreSessionPath(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "store")
+	store := reopen(t, dir)
+
+	for _, id := range []string{"", ".", "..", "../x", `..\x`, "a/b"} {
+		if err := store.Save(&ProgressMessage{SessionID: id}); err == nil {
+			t.Errorf("Save accepted session ID %q", id)
+		}
+		if err := store.AppendHistory(id, HistoryEntry{}); err == nil {
+			t.Errorf("AppendHistory accepted session ID %q", id)
+		}
+		if err := store.Delete(id); err == nil {
+			t.Errorf("Delete accepted session ID %q", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "x"+stateFileExt)); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the store: %v", err)
+	}
+	if sessions, _ := store.List(); len(sessions) != 0 {
+		t.Errorf("rejected sessions are listed: %v", sessionIDs(sessions))
+	}
+}
+
+func TestNewFileStoreOnFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.json")
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Error("NewFileStore accepted a file")
+	}
+}
+
+func TestMarkInterruptedAfterReload(t *testing.T) {
+	dir := t.TempDir()
+	store := reopen(t, dir)
+	for _, msg := range []*ProgressMessage{
+		{SessionID: "queued", Status: StatusQueued, QueuePosition: 1},
+		{SessionID: "starting", Status: StatusStart},
+		{SessionID: "running", Status: StatusProcessing, Percentage: 55, CurrentStep: "mfa"},
+		{SessionID: "done", Status: StatusComplete, Percentage: 100},
+		{SessionID: "failed", Status: StatusFailed, Percentage: 20},
+	} {
+		if err := store.Save(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SetStore(reopen(t, dir))
+	t.Cleanup(func() { SetStore(NewMemoryStore()) })
+
+	interrupted := MarkInterrupted()
+	if want := []string{"queued", "running", "starting"}; !slices.Equal(interrupted, want) {
+		t.Errorf("MarkInterrupted() = %v, want %v", interrupted, want)
+	}
+
+	// Trạng thái mới được ghi xuống đĩa, phần trăm và bước đang chạy được giữ nguyên
+	store = reopen(t, dir)
+	for id, want := range map[string]string{
+		"queued": StatusInterrupted, "starting": StatusInterrupted, "running": StatusInterrupted,
+		"done": StatusComplete, "failed": StatusFailed,
+	} {
+		msg, _ := store.Load(id)
+		if msg == nil || msg.Status != want {
+			t.Errorf("%s is %+v after the reload, want status %q", id, msg, want)
+		}
+	}
+	if msg, _ := store.Load("running"); msg.Percentage != 55 || msg.CurrentStep != "mfa" {
+		t.Errorf("interrupted session lost its progress: %+v", msg)
+	}
+	if msg, _ := store.Load("queued"); msg.QueuePosition != 0 {
+		t.Errorf("interrupted session kept its queue position %d", msg.QueuePosition)
+	}
+	if history, _ := store.History("running"); len(history) == 0 || history[len(history)-1].Status != StatusInterrupted {
+		t.Errorf("the interruption is missing from the history: %+v", history)
+	}
+}
@@ -0,0 +1,73 @@
+package progress
+
+import "sync"
+
+// subscriberBuffer là số cập nhật được giữ cho một client chậm trước khi bỏ bớt cập nhật cũ
+const subscriberBuffer = 16
+
+// broker phân phát mỗi cập nhật tiến trình tới các client đang theo dõi session
+type broker struct {
+	subscribers map[string]map[chan ProgressMessage]struct{}
+	mutex       sync.Mutex
+}
+
+var progressBroker = &broker{
+	subscribers: make(map[string]map[chan ProgressMessage]struct{}),
+}
+
+// Subscribe đăng ký nhận mọi cập nhật tiến trình của session.
+// Hàm trả về phải được gọi khi client ngắt kết nối để hủy đăng ký.
+func Subscribe(sessionID string) (<-chan ProgressMessage, func()) {
+	ch := make(chan ProgressMessage, subscriberBuffer)
+
+	progressBroker.mutex.Lock()
+	if progressBroker.subscribers[sessionID] == nil {
+		progressBroker.subscribers[sessionID] = make(map[chan ProgressMessage]struct{})
+	}
+	progressBroker.subscribers[sessionID][ch] = struct{}{}
+	progressBroker.mutex.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			progressBroker.mutex.Lock()
+			delete(progressBroker.subscribers[sessionID], ch)
+			if len(progressBroker.subscribers[sessionID]) == 0 {
+				delete(progressBroker.subscribers, sessionID)
+			}
+			progressBroker.mutex.Unlock()
+		})
+	}
+	return ch, unsubscribe
+}
+
+// publish gửi cập nhật tới mọi client của session mà không bao giờ chặn người gọi.
+// Với client đọc không kịp, cập nhật cũ nhất bị bỏ để nhường chỗ cho cập nhật mới.
+func (b *broker) publish(msg ProgressMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers[msg.SessionID] {
+		select {
+		case ch <- msg:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// IsTerminal cho biết trạng thái có phải trạng thái kết thúc, sau đó session không còn cập nhật nữa
+func IsTerminal(status string) bool {
+	switch status {
+	case StatusComplete, StatusFailed, StatusCancelled, StatusInterrupted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package progress
+
+import (
+	"testing"
+)
+
+// drain đọc mọi cập nhật đang chờ trong ch mà không chặn
+func drain(ch <-chan ProgressMessage) []ProgressMessage {
+	var received []ProgressMessage
+	for {
+		select {
+		case msg := <-ch:
+			received = append(received, msg)
+		default:
+			return received
+		}
+	}
+}
+
+func hasSubscribers(sessionID string) bool {
+	progressBroker.mutex.Lock()
+	defer progressBroker.mutex.Unlock()
+	_, ok := progressBroker.subscribers[sessionID]
+	return ok
+}
+
+func TestSubscribeSlowClient(t *testing.T) {
+	useMemoryStore(t)
+
+	// Hai client chưa đọc gì, và một client của session khác
+	slow, unsubscribeSlow := Subscribe("subscribe")
+	defer unsubscribeSlow()
+	other, unsubscribeOther := Subscribe("subscribe")
+	defer unsubscribeOther()
+	unrelated, unsubscribeUnrelated := Subscribe("subscribe-unrelated")
+	defer unsubscribeUnrelated()
+
+	updates := 3 * subscriberBuffer
+	for i := 1; i <= updates; i++ {
+		UpdateProgress("subscribe", float64(i), "separation processing", "separation")
+	}
+	FailProgress("subscribe", "separation", "SEPARATION_FAILED", "separation failed", "")
+
+	for name, ch := range map[string]<-chan ProgressMessage{"slow": slow, "other": other} {
+		received := drain(ch)
+		if len(received) != subscriberBuffer {
+			t.Fatalf("%s client received %d updates, want the %d newest", name, len(received), subscriberBuffer)
+		}
+		// Cập nhật cũ nhất bị bỏ, các cập nhật còn lại giữ đúng thứ tự và kết thúc bằng trạng thái cuối
+		for i, msg := range received[:len(received)-1] {
+			if want := float64(updates - subscriberBuffer + 2 + i); msg.Percentage != want {
+				t.Errorf("%s client update %d is at %v%%, want %v%%", name, i, msg.Percentage, want)
+			}
+		}
+		if last := received[len(received)-1]; last.Status != StatusFailed || !IsTerminal(last.Status) {
+			t.Errorf("%s client's last update is %q, want the terminal %q", name, last.Status, StatusFailed)
+		}
+	}
+	if received := drain(unrelated); len(received) != 0 {
+		t.Errorf("a client of another session received %d updates", len(received))
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	useMemoryStore(t)
+
+	first, unsubscribeFirst := Subscribe("unsubscribe")
+	_, unsubscribeSecond := Subscribe("unsubscribe")
+
+	unsubscribeFirst()
+	// Gọi lại không ảnh hưởng tới client còn lại
+	unsubscribeFirst()
+	if !hasSubscribers("unsubscribe") {
+		t.Fatal("unsubscribing one client dropped the other")
+	}
+	UpdateProgress("unsubscribe", 10, "separation processing", "separation")
+	if received := drain(first); len(received) != 0 {
+		t.Errorf("an unsubscribed client received %d updates", len(received))
+	}
+
+	unsubscribeSecond()
+	if hasSubscribers("unsubscribe") {
+		t.Error("the session is still in the broker after its last client unsubscribed")
+	}
+}
@@ -0,0 +1,247 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"karaoke_generator/progress"
+)
+
+// JobState is the lifecycle state of a queued job
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// ErrQueueFull is returned by Enqueue when the number of waiting jobs reached the limit
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrJobNotFound is returned when no job exists for an ID
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrJobFinished is returned by Cancel when the job already reached a terminal state
+var ErrJobFinished = errors.New("job already finished")
+
+// ErrCodeInternal is the error code reported in the progress of a session whose job panicked
+const ErrCodeInternal = "INTERNAL_ERROR"
+
+// ErrDuplicateJob is returned by Enqueue when a job with the same ID is still queued or running
+var ErrDuplicateJob = errors.New("job already queued or running")
+
+// Job is a unit of work identified by the session ID it belongs to
+type Job struct {
+	ID         string
+	State      JobState
+	Err        error
+	EnqueuedAt time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	run    func(ctx context.Context) error
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// JobQueue runs jobs in FIFO order on a fixed number of workers
+type JobQueue struct {
+	workers   int
+	maxQueued int
+
+	pending []*Job
+	jobs    map[string]*Job
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+}
+
+// NewJobQueue creates a queue with the given number of workers that accepts at most maxQueued waiting jobs
+func NewJobQueue(workers, maxQueued int) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxQueued < 0 {
+		maxQueued = 0
+	}
+	q := &JobQueue{
+		workers:   workers,
+		maxQueued: maxQueued,
+		jobs:      make(map[string]*Job),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Start launches the worker goroutines
+func (q *JobQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+}
+
+// Enqueue adds a job to the end of the queue and returns its 1-based queue position.
+// The context passed to run is cancelled when the job is cancelled.
+func (q *JobQueue) Enqueue(id string, run func(ctx context.Context) error) (int, error) {
+	q.mutex.Lock()
+	if job, ok := q.jobs[id]; ok && (job.State == JobQueued || job.State == JobRunning) {
+		q.mutex.Unlock()
+		return 0, ErrDuplicateJob
+	}
+	if len(q.pending) >= q.maxQueued {
+		q.mutex.Unlock()
+		return 0, ErrQueueFull
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:         id,
+		State:      JobQueued,
+		EnqueuedAt: time.Now(),
+		run:        run,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	q.pending = append(q.pending, job)
+	q.jobs[id] = job
+	position := len(q.pending)
+	// Published under the lock, so a worker can't start the job and report it running first
+	progress.UpdateQueuePosition(id, position)
+	q.cond.Signal()
+	q.mutex.Unlock()
+	return position, nil
+}
+
+// IsFull reports whether a new job would be rejected right now
+func (q *JobQueue) IsFull() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.pending) >= q.maxQueued
+}
+
+// Position returns the 1-based position of a waiting job, or 0 if the job is not waiting
+func (q *JobQueue) Position(id string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, job := range q.pending {
+		if job.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Get returns a snapshot of a job
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Cancel stops a job and returns the state it was in when cancelled.
+// A queued job is removed from the queue right away; a running job has its
+// context cancelled and is marked cancelled once its run function returns.
+func (q *JobQueue) Cancel(id string) (JobState, error) {
+	q.mutex.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mutex.Unlock()
+		return "", ErrJobNotFound
+	}
+
+	state := job.State
+	switch state {
+	case JobQueued:
+		for i, w := range q.pending {
+			if w == job {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		job.State = JobCancelled
+		job.FinishedAt = time.Now()
+		job.cancel()
+		q.reportPositions()
+		q.mutex.Unlock()
+		return state, nil
+	case JobRunning:
+		job.cancel()
+		q.mutex.Unlock()
+		return state, nil
+	default:
+		q.mutex.Unlock()
+		return state, ErrJobFinished
+	}
+}
+
+// Forget drops a finished job from the queue bookkeeping
+func (q *JobQueue) Forget(id string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if job, ok := q.jobs[id]; ok && job.State != JobQueued && job.State != JobRunning {
+		delete(q.jobs, id)
+	}
+}
+
+// reportPositions publishes the queue position of every waiting job; must be called with
+// mutex held, or a worker could start a job and then have it reported as queued again
+func (q *JobQueue) reportPositions() {
+	for i, w := range q.pending {
+		progress.UpdateQueuePosition(w.ID, i+1)
+	}
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.mutex.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		job := q.pending[0]
+		q.pending = q.pending[1:]
+		job.State = JobRunning
+		job.StartedAt = time.Now()
+		// Jobs behind the one that just started moved up by one
+		q.reportPositions()
+		q.mutex.Unlock()
+
+		err := q.execute(job)
+
+		q.mutex.Lock()
+		job.FinishedAt = time.Now()
+		job.Err = err
+		switch {
+		case job.ctx.Err() != nil:
+			job.State = JobCancelled
+		case err != nil:
+			job.State = JobFailed
+		default:
+			job.State = JobDone
+		}
+		job.cancel()
+		q.mutex.Unlock()
+	}
+}
+
+// execute runs a job and turns a panic into a job failure so the worker survives. The job never
+// got to report its own failure, so the session is marked failed here; otherwise its progress
+// would stay "processing" forever.
+func (q *JobQueue) execute(job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job %s panicked: %v", job.ID, r)
+			progress.FailProgress(job.ID, "unknown", ErrCodeInternal, err.Error(), "")
+		}
+	}()
+	return job.run(job.ctx)
+}
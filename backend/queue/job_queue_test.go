@@ -0,0 +1,301 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"karaoke_generator/progress"
+)
+
+// waitForState polls a job until it reaches state
+func waitForState(t *testing.T, q *JobQueue, id string, state JobState) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, ok := q.Get(id)
+		if ok && job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %q, want %q", id, job.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blocker returns a job that signals started and then runs until release is closed or it is cancelled
+func blocker(started chan<- string, release <-chan struct{}, id string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		started <- id
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestEnqueueQueueFull(t *testing.T) {
+	// Not started, so every job keeps waiting
+	q := NewJobQueue(1, 2)
+	noop := func(ctx context.Context) error { return nil }
+
+	for i, id := range []string{"full-a", "full-b"} {
+		position, err := q.Enqueue(id, noop)
+		if err != nil || position != i+1 {
+			t.Fatalf("Enqueue(%s) = %d, %v, want position %d", id, position, err, i+1)
+		}
+	}
+	if !q.IsFull() {
+		t.Error("IsFull() = false with max_queued jobs waiting")
+	}
+	if _, err := q.Enqueue("full-c", noop); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Enqueue past max_queued = %v, want ErrQueueFull", err)
+	}
+	if _, ok := q.Get("full-c"); ok {
+		t.Error("a rejected job is tracked")
+	}
+
+	// Cancelling a waiting job makes room again
+	if _, err := q.Cancel("full-a"); err != nil {
+		t.Fatal(err)
+	}
+	if position, err := q.Enqueue("full-c", noop); err != nil || position != 2 {
+		t.Errorf("Enqueue after a cancel = %d, %v, want position 2", position, err)
+	}
+}
+
+func TestEnqueueDuplicate(t *testing.T) {
+	q := NewJobQueue(1, 4)
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	q.Start()
+
+	if _, err := q.Enqueue("dup", blocker(started, release, "dup")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if _, err := q.Enqueue("dup", blocker(started, release, "dup")); !errors.Is(err, ErrDuplicateJob) {
+		t.Fatalf("Enqueue of a running job = %v, want ErrDuplicateJob", err)
+	}
+
+	// A finished job may be run again, e.g. when it is resumed
+	close(release)
+	waitForState(t, q, "dup", JobDone)
+	if _, err := q.Enqueue("dup", func(ctx context.Context) error { return nil }); err != nil {
+		t.Errorf("Enqueue of a finished job = %v", err)
+	}
+	waitForState(t, q, "dup", JobDone)
+}
+
+func TestFIFOAndPositions(t *testing.T) {
+	q := NewJobQueue(1, 8)
+	started := make(chan string, 8)
+	release := make(chan struct{})
+	q.Start()
+
+	if _, err := q.Enqueue("fifo-running", blocker(started, release, "fifo-running")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	waiting := []string{"fifo-a", "fifo-b", "fifo-c", "fifo-d"}
+	for i, id := range waiting {
+		position, err := q.Enqueue(id, blocker(started, release, id))
+		if err != nil || position != i+1 {
+			t.Fatalf("Enqueue(%s) = %d, %v, want position %d", id, position, err, i+1)
+		}
+	}
+	for i, id := range waiting {
+		if got := q.Position(id); got != i+1 {
+			t.Errorf("Position(%s) = %d, want %d", id, got, i+1)
+		}
+		if msg := progress.GetProgress(id); msg == nil || msg.Status != progress.StatusQueued || msg.QueuePosition != i+1 {
+			t.Errorf("progress of %s is %+v, want queued at position %d", id, msg, i+1)
+		}
+	}
+	if got := q.Position("fifo-running"); got != 0 {
+		t.Errorf("Position of the running job = %d, want 0", got)
+	}
+
+	// The jobs behind a cancelled one move up, in the queue and in their progress
+	if _, err := q.Cancel("fifo-b"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]int{"fifo-a": 1, "fifo-c": 2, "fifo-d": 3} {
+		if got := q.Position(id); got != want {
+			t.Errorf("after cancel, Position(%s) = %d, want %d", id, got, want)
+		}
+		if msg := progress.GetProgress(id); msg == nil || msg.QueuePosition != want {
+			t.Errorf("after cancel, progress of %s is %+v, want position %d", id, msg, want)
+		}
+	}
+
+	close(release)
+	var order []string
+	for range []string{"fifo-a", "fifo-c", "fifo-d"} {
+		order = append(order, <-started)
+	}
+	if want := []string{"fifo-a", "fifo-c", "fifo-d"}; !slices.Equal(order, want) {
+		t.Errorf("jobs ran in order %v, want %v", order, want)
+	}
+	for _, id := range []string{"fifo-running", "fifo-a", "fifo-c", "fifo-d"} {
+		waitForState(t, q, id, JobDone)
+	}
+}
+
+func TestCancelQueued(t *testing.T) {
+	q := NewJobQueue(1, 4)
+	var ran atomic.Bool
+	if _, err := q.Enqueue("cancel-queued", func(ctx context.Context) error {
+		ran.Store(true)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := q.Cancel("cancel-queued")
+	if err != nil || state != JobQueued {
+		t.Fatalf("Cancel = %q, %v, want the queued state", state, err)
+	}
+	job, _ := q.Get("cancel-queued")
+	if job.State != JobCancelled || job.FinishedAt.IsZero() {
+		t.Errorf("cancelled queued job is %q, finished at %v", job.State, job.FinishedAt)
+	}
+	if job.ctx.Err() == nil {
+		t.Error("the context of a cancelled queued job is still live")
+	}
+	if q.Position("cancel-queued") != 0 {
+		t.Error("a cancelled job is still waiting")
+	}
+
+	// Started only now: the cancelled job must never run
+	q.Start()
+	if _, err := q.Enqueue("cancel-queued-next", func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, q, "cancel-queued-next", JobDone)
+	if ran.Load() {
+		t.Error("a job cancelled while queued was run")
+	}
+
+	if _, err := q.Cancel("cancel-queued"); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("second Cancel = %v, want ErrJobFinished", err)
+	}
+	if _, err := q.Cancel("cancel-unknown"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Cancel of an unknown job = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestCancelRunning(t *testing.T) {
+	q := NewJobQueue(1, 4)
+	started := make(chan string, 1)
+	q.Start()
+
+	stopped := make(chan error, 1)
+	if _, err := q.Enqueue("cancel-running", func(ctx context.Context) error {
+		started <- "cancel-running"
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		// A job that swallows the cancellation is still marked cancelled
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	state, err := q.Cancel("cancel-running")
+	if err != nil || state != JobRunning {
+		t.Fatalf("Cancel = %q, %v, want the running state", state, err)
+	}
+	if err := <-stopped; !errors.Is(err, context.Canceled) {
+		t.Errorf("running job saw %v, want context.Canceled", err)
+	}
+	job := waitForState(t, q, "cancel-running", JobCancelled)
+	if job.StartedAt.IsZero() || job.FinishedAt.Before(job.StartedAt) {
+		t.Errorf("cancelled job started at %v and finished at %v", job.StartedAt, job.FinishedAt)
+	}
+}
+
+func TestFailedJobs(t *testing.T) {
+	q := NewJobQueue(1, 4)
+	q.Start()
+
+	failure := errors.New("demucs exited with status 1")
+	if _, err := q.Enqueue("failed-error", func(ctx context.Context) error { return failure }); err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForState(t, q, "failed-error", JobFailed); !errors.Is(job.Err, failure) {
+		t.Errorf("failed job error is %v, want %v", job.Err, failure)
+	}
+
+	// A panic fails the job without taking the worker down
+	if _, err := q.Enqueue("failed-panic", func(ctx context.Context) error { panic("boom") }); err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForState(t, q, "failed-panic", JobFailed); job.Err == nil {
+		t.Error("panicking job has no error")
+	}
+	if _, err := q.Enqueue("failed-after", func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, q, "failed-after", JobDone)
+}
+
+func TestPanicFailsProgress(t *testing.T) {
+	q := NewJobQueue(1, 4)
+	q.Start()
+	t.Cleanup(func() { progress.ClearProgress("panic-progress") })
+
+	// The job panics halfway, before it could report anything itself
+	if _, err := q.Enqueue("panic-progress", func(ctx context.Context) error {
+		progress.UpdateProgress("panic-progress", 40, "alignment processing", "alignment")
+		panic("index out of range")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, q, "panic-progress", JobFailed)
+
+	msg := progress.GetProgress("panic-progress")
+	if msg == nil || msg.Status != progress.StatusFailed || msg.ErrorCode != ErrCodeInternal {
+		t.Fatalf("progress after a panic is %+v, want failed with %s", msg, ErrCodeInternal)
+	}
+	if !progress.IsTerminal(msg.Status) || msg.Percentage != 40 || !strings.Contains(msg.Message, "index out of range") {
+		t.Errorf("progress after a panic is %+v", msg)
+	}
+}
+
+func TestForget(t *testing.T) {
+	q := NewJobQueue(1, 4)
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	q.Start()
+
+	if _, err := q.Enqueue("forget", blocker(started, release, "forget")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// A running job is kept, it would otherwise be enqueued twice
+	q.Forget("forget")
+	if _, ok := q.Get("forget"); !ok {
+		t.Fatal("Forget dropped a running job")
+	}
+
+	close(release)
+	waitForState(t, q, "forget", JobDone)
+	q.Forget("forget")
+	if _, ok := q.Get("forget"); ok {
+		t.Error("Forget kept a finished job")
+	}
+	if _, err := q.Cancel("forget"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Cancel of a forgotten job = %v, want ErrJobNotFound", err)
+	}
+	// Forgetting an unknown job is harmless
+	q.Forget("forget-unknown")
+}